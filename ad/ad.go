@@ -3,14 +3,19 @@
 // implement interface model.Model. In the model's source code:
 //   1. Methods on the type implementing model.Model
 //	    returning a single float64 or nothing are
-//	    differentiated.
+//	    differentiated. Package-level functions returning a
+//	    single float64 or nothing, with at least one float64
+//	    or []float64 parameter, are differentiated as well,
+//	    unless registered as elementals.
 //   2. Within the methods, the following is differentiated:
 //      a) assignments to float64 (including parallel
 //         assignments if all values are of type float64);
 //      b) returns of float64;
 //      c) standalone calls to methods on the type implementing
 //         model.Model (apparently called for side  effects on
-//         the model).
+//         the model) and to differentiated functions;
+//      d) float64 elements of slice, array and struct composite
+//         literals.
 //   3. Imported package name "ad" is reserved.
 //   4. Non-dummy identifiers starting with the prefix for
 //      generated identifiers ("_" by default) are reserved.
@@ -28,12 +33,41 @@
 // are not.
 //
 // Derivatives do not propagate through a function that is not
-// an elemental or a call to a model method. If a derivative is
+// an elemental, a differentiated function, or a call to a
+// model method. If a derivative is
 // not registered for an elemental, calling the elemental in a
 // Observe will cause a run-time error.
 //
 // The differentiated model is put into subpackage "ad" of the
 // model's package, with the same name as the original package.
+//
+// By default, the gradient is computed in reverse mode, on the
+// backward pass over the tape. If Forward is set, the gradient
+// is computed in forward mode, propagating tangents with the
+// values. Forward mode is faster for models with few
+// parameters.
+//
+// A model may implement model.Model32 instead, with float32
+// parameters and result. Float32 is differentiated in the same
+// way as float64, and conversions between float32 and float64
+// propagate the derivatives. A function mixing float32 and
+// float64 in its signature is not differentiated. Elementals
+// may be float32 too. Forward mode is not supported for
+// float32.
+//
+// By default, the differentiated code uses the tape of the
+// current goroutine (see MTSafeOn for concurrent
+// differentiation). If Explicit is set, the tape is carried by
+// the model instead: model types have method Tape() *ad.Tape,
+// and differentiated functions, as well as methods of types
+// without method Tape, get the tape as an added first
+// parameter. Models with different tapes can be differentiated
+// concurrently on any Go version and architecture. Exported
+// functions keep their signatures and call the differentiated
+// code with a new tape. The differentiated model is put into
+// subpackage "adx" rather than "ad", and calls into other
+// packages go to their "adx" variants, such as dist/adx, which
+// get the tape too.
 package ad
 
 import (
@@ -57,6 +91,21 @@ var (
 	// When Fold is true, folded values are substituted instead
 	// of constant expressions.
 	Fold = true
+
+	// When Forward is true, the gradient is computed in
+	// forward mode, with dual numbers, rather than on the
+	// backward pass.
+	Forward = false
+
+	// When Explicit is true, the tape is passed explicitly to
+	// the differentiated code rather than looked up in the tape
+	// store, and differentiation is goroutine-safe without
+	// MTSafeOn. Model types have method Tape() *ad.Tape
+	// returning the tape; differentiated functions, and methods
+	// of types without method Tape, get the tape as the first
+	// parameter. Exported functions are wrapped to keep their
+	// signatures.
+	Explicit = false
 )
 
 const (
@@ -64,40 +113,48 @@ const (
 	infergoImport = "bitbucket.org/dtolpin/infergo/ad"
 )
 
-// modelInterface is used to identify model types
-var modelInterface *types.Interface
+// modelInterface and model32Interface are used to identify
+// model types
+var modelInterface, model32Interface *types.Interface
 
 func init() {
-	modelInterface = types.NewInterface(
+	modelInterface = newModelInterface(types.Typ[types.Float64])
+	model32Interface = newModelInterface(types.Typ[types.Float32])
+}
+
+// newModelInterface returns the model interface for float type
+// typ.
+func newModelInterface(typ types.Type) *types.Interface {
+	return types.NewInterface(
 		[]*types.Func{
 			types.NewFunc(0, nil, "Observe",
 				types.NewSignature(nil,
 					types.NewTuple(
 						types.NewVar(0, nil, "x",
-							types.NewSlice(types.Typ[types.Float64]))),
+							types.NewSlice(typ))),
 					types.NewTuple(
-						types.NewVar(0, nil, "",
-							types.Typ[types.Float64])),
+						types.NewVar(0, nil, "", typ)),
 					false)),
 		},
-		nil)
-	modelInterface.Complete()
+		nil).Complete()
 }
 
 // Structure model contains shared data structures for
 // differentiating the model. Functions operating on *model are
 // defined as method to use shorter names.
 type model struct {
-	path   string
-	fset   *token.FileSet
-	pkg    *ast.Package
-	info   *types.Info
-	prefix string
+	path      string
+	fset      *token.FileSet
+	pkg       *ast.Package
+	info      *types.Info
+	prefix    string
+	literals  map[*ast.FuncLit]bool // composite literal wrappers
+	functions map[types.Object]bool // differentiated functions
 }
 
 // Deriv differentiates a model. The original model is in the
 // package located at mpath. The differentiated model is written
-// to mpath/ad. When a variable is generated by the autodiff code,
+// to mpath/ad, or to mpath/adx if Explicit is set. When a variable is generated by the autodiff code,
 // the variable name has the specified prefix.
 func Deriv(mpath string, prefix string) (err error) {
 	// Read the model.
@@ -268,21 +325,191 @@ func (m *model) deriv() (err error) {
 		}
 	}
 
+	// Composite literal wrappers are not reached from the
+	// method bodies and are rewritten separately.
+	for literal := range m.literals {
+		err = m.rewriteNode(literal)
+		if err != nil {
+			return err
+		}
+	}
+
+	if Explicit {
+		m.wrapExported(methods)
+		m.passTapes(methods)
+	}
+
 	return err
 }
 
+// passTapes adds a new tape as the first argument to calls of
+// unexported differentiated functions, and of differentiated
+// methods of types without method Tape, from code which is not
+// differentiated, when the tape is explicit. Such calls get a
+// frame of their own, which is discarded on return, anyway.
+// Exported functions keep their signatures (see wrapExported).
+func (m *model) passTapes(methods []*ast.FuncDecl) {
+	differentiated := make(map[*ast.FuncDecl]bool)
+	for _, method := range methods {
+		differentiated[method] = true
+	}
+	for _, file := range m.pkg.Files {
+		passed := false
+		for _, d := range file.Decls {
+			if d, ok := d.(*ast.FuncDecl); ok && differentiated[d] {
+				continue
+			}
+			ast.Inspect(d, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				if m.needsTape(file, call) {
+					call.Args = append([]ast.Expr{
+						&ast.CallExpr{Fun: varExpr("NewTape")},
+					}, call.Args...)
+					passed = true
+				}
+				return true
+			})
+		}
+		if passed {
+			astutil.AddImport(m.fset, file, infergoImport)
+		}
+	}
+}
+
+// needsTape returns true iff the call, in code which is not
+// differentiated, is of a differentiated function or method
+// which gets the tape as the first argument. A method of
+// another package is differentiated if the file imports the
+// explicit-tape variant of the package.
+func (m *model) needsTape(file *ast.File, call *ast.CallExpr) bool {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return !fun.IsExported() && m.functions[m.info.ObjectOf(fun)]
+	case *ast.SelectorExpr:
+		t, ok := m.info.Selections[fun]
+		if !ok || t.Kind() != types.MethodVal ||
+			!m.isMethodType(t.Type()) || hasTape(t.Recv()) {
+			return false
+		}
+		pkg := t.Obj().Pkg()
+		if pkg == nil || pkg.Path() == m.path {
+			return true
+		}
+		adPath := pkg.Path() + "/" + subpackage()
+		for _, is := range file.Imports {
+			if is.Path.Value[1:len(is.Path.Value)-1] == adPath {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wrapExported keeps the signatures of exported differentiated
+// functions, which may be called from other packages, when the
+// tape is explicit. The differentiated function Name is renamed
+// to _Name, and Name becomes a wrapper calling _Name with a new
+// tape.
+func (m *model) wrapExported(methods []*ast.FuncDecl) {
+	for _, method := range methods {
+		if method.Recv != nil || !method.Name.IsExported() {
+			continue
+		}
+		name := method.Name.Name
+		method.Name = &ast.Ident{
+			NamePos: method.Name.NamePos,
+			Name:    m.prefix + name,
+		}
+
+		// The tape is the first parameter of the differentiated
+		// function; the wrapper passes the rest through.
+		var params []*ast.Field
+		args := []ast.Expr{&ast.CallExpr{Fun: varExpr("NewTape")}}
+		var ellipsis token.Pos
+		for _, field := range method.Type.Params.List[1:] {
+			nnames := len(field.Names)
+			if nnames == 0 {
+				nnames = 1
+			}
+			var names []*ast.Ident
+			for i := 0; i != nnames; i++ {
+				arg := m.genIdent(fmt.Sprintf("arg%d", len(args)-1))
+				names = append(names, arg)
+				args = append(args, arg)
+			}
+			if _, ok := field.Type.(*ast.Ellipsis); ok {
+				ellipsis = field.Type.Pos()
+			}
+			params = append(params, &ast.Field{
+				Names: names,
+				Type:  field.Type,
+			})
+		}
+		call := &ast.CallExpr{
+			Fun:      &ast.Ident{Name: method.Name.Name},
+			Args:     args,
+			Ellipsis: ellipsis,
+		}
+		var body ast.Stmt = &ast.ExprStmt{X: call}
+		if method.Type.Results != nil {
+			body = &ast.ReturnStmt{Results: []ast.Expr{call}}
+		}
+		wrapper := &ast.FuncDecl{
+			Doc:  method.Doc,
+			Name: &ast.Ident{NamePos: method.Name.NamePos, Name: name},
+			Type: &ast.FuncType{
+				Func:    method.Type.Func,
+				Params:  &ast.FieldList{List: params},
+				Results: method.Type.Results,
+			},
+			Body: &ast.BlockStmt{List: []ast.Stmt{body}},
+		}
+		method.Doc = nil
+
+		// The wrapper goes before the function, where the
+		// documentation comment is.
+		file := m.pkg.Files[m.fset.Position(method.Pos()).Filename]
+		for i, d := range file.Decls {
+			if d == method {
+				file.Decls = append(file.Decls[:i],
+					append([]ast.Decl{wrapper},
+						file.Decls[i:]...)...)
+				break
+			}
+		}
+	}
+}
+
 // collectMethods collects ASTs of methods defined on the
-// models.
+// models and of differentiated package-level functions.
 func (m *model) collectMethods() (
 	methods []*ast.FuncDecl,
 	err error,
 ) {
+	registered := m.registeredElementals()
+	m.functions = make(map[types.Object]bool)
 	// We will mostly have a single model type; a linear
 	// lookup is the way to go (see iaType below).
 	for _, file := range m.pkg.Files {
 		for _, d := range file.Decls {
-			if d, ok := d.(*ast.FuncDecl); ok &&
-				m.isMethodType(m.info.TypeOf(d.Name)) {
+			d, ok := d.(*ast.FuncDecl)
+			if !ok {
+				continue
+			}
+			switch {
+			case m.isMethodType(m.info.TypeOf(d.Name)):
+				methods = append(methods, d)
+			case d.Recv == nil && d.Name.Name != "init" &&
+				isFuncType(m.info.TypeOf(d.Name)):
+				o := m.info.ObjectOf(d.Name)
+				if registered[o] {
+					// The gradient is supplied.
+					continue
+				}
+				m.functions[o] = true
 				methods = append(methods, d)
 			}
 		}
@@ -291,6 +518,91 @@ func (m *model) collectMethods() (
 	return methods, err
 }
 
+// registeredElementals returns the set of package-level
+// functions registered as elementals in the model's package.
+func (m *model) registeredElementals() map[types.Object]bool {
+	registered := make(map[types.Object]bool)
+	for _, file := range m.pkg.Files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			f, ok := m.info.Uses[sel.Sel].(*types.Func)
+			if !ok || f.Pkg() == nil ||
+				f.Pkg().Path() != infergoImport ||
+				f.Name() != "RegisterElemental" &&
+					f.Name() != "RegisterElementalInto" {
+				return true
+			}
+			if id, ok := call.Args[0].(*ast.Ident); ok {
+				registered[m.info.ObjectOf(id)] = true
+			}
+			return true
+		})
+	}
+	return registered
+}
+
+// isFuncType returns true iff typ is the type of a
+// differentiated function: a function returning a single
+// float or nothing with at least one float or float slice
+// parameter.
+func isFuncType(typ types.Type) bool {
+	sig, ok := typ.(*types.Signature)
+	if !ok || sig.Recv() != nil {
+		return false
+	}
+	if _, ok := signatureKind(sig); !ok {
+		return false
+	}
+	results := sig.Results()
+	if !(results == nil ||
+		results.Len() == 0 ||
+		results.Len() == 1 && isReal(results.At(0).Type())) {
+		return false
+	}
+	for i := 0; i != sig.Params().Len(); i++ {
+		t := sig.Params().At(i).Type()
+		if st, ok := t.(*types.Slice); ok {
+			t = st.Elem()
+		}
+		if isReal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureKind returns true iff the float parameters and the
+// result of the signature are float32 rather than float64. The
+// second returned value is false if float32 and float64 are
+// mixed, such functions are not differentiated.
+func signatureKind(sig *types.Signature) (is32, ok bool) {
+	has64, has32 := false, false
+	check := func(vars *types.Tuple, variadic bool) {
+		for i := 0; i != vars.Len(); i++ {
+			t := vars.At(i).Type()
+			if variadic && i == vars.Len()-1 {
+				t = t.(*types.Slice).Elem()
+			}
+			switch {
+			case isFloat(t):
+				has64 = true
+			case isFloat32(t):
+				has32 = true
+			}
+		}
+	}
+	check(sig.Params(), sig.Variadic())
+	check(sig.Results(), false)
+	return has32, !(has64 && has32)
+}
+
 // isMethodType returns true iff typ is a method type of the
 // Model interface.
 func (m *model) isMethodType(typ types.Type) bool {
@@ -301,15 +613,20 @@ func (m *model) isMethodType(typ types.Type) bool {
 	if sig.Recv() == nil || !m.isType(sig.Recv().Type()) {
 		return false
 	}
+	if _, ok := signatureKind(sig); !ok {
+		return false
+	}
 	results := sig.Results()
 	return results == nil ||
 		results.Len() == 0 ||
-		results.Len() == 1 && isFloat(results.At(0).Type())
+		results.Len() == 1 && isReal(results.At(0).Type())
 }
 
-// isType returns true iff typ implements the Model interface.
+// isType returns true iff typ implements the Model interface
+// or its float32 variant.
 func (m *model) isType(typ types.Type) bool {
-	return types.Implements(typ, modelInterface)
+	return types.Implements(typ, modelInterface) ||
+		types.Implements(typ, model32Interface)
 }
 
 // errOnPanic turns panic from astutil.Apply into an error,
@@ -511,10 +828,301 @@ func (m *model) desugar(method *ast.FuncDecl) (err error) {
 			return true
 		},
 		nil)
+	if err != nil {
+		return err
+	}
+
+	// Composite literals are desugared in a separate pass, when
+	// all assignments are already in place.
+	return m.desugarLiterals(method)
+}
+
+// desugarLiterals moves float64 elements of composite literals
+// out of the literals into assignments, so that the assignments
+// are differentiated. A slice literal or a pointer to a literal
+// is wrapped into a function which builds the value and assigns
+// the elements:
+//   func() T {
+//       var _lit T
+//       _lit = T{...}
+//       _lit[i] = ...
+//       return _lit
+//   }()
+// A struct or array literal is copied on assignment; the
+// elements are assigned to the left-hand side of the
+// assignment instead.
+func (m *model) desugarLiterals(method *ast.FuncDecl) (err error) {
+	defer errOnPanic(
+		&err,
+		m.fset.Position(method.Pos()),
+	)()
+
+	astutil.Apply(method,
+		func(c *astutil.Cursor) bool {
+			n := c.Node()
+			if n != nil && n.Pos() != token.NoPos {
+				defer errOnPanic(
+					&err,
+					m.fset.Position(n.Pos()),
+				)()
+			}
+			switch n := n.(type) {
+			case *ast.AssignStmt:
+				if len(n.Lhs) != 1 || len(n.Rhs) != 1 ||
+					c.Index() < 0 {
+					break
+				}
+				lit, ok := n.Rhs[0].(*ast.CompositeLit)
+				if !ok {
+					break
+				}
+				if !m.isAddressable(n.Lhs[0]) {
+					break
+				}
+				switch m.info.TypeOf(lit).Underlying().(type) {
+				case *types.Struct, *types.Array:
+					asgns := m.elements(lit, n.Lhs[0])
+					if len(asgns) == 0 {
+						break
+					}
+					for i := len(asgns) - 1; i >= 0; i-- {
+						c.InsertAfter(asgns[i])
+					}
+					return false
+				}
+			case *ast.UnaryExpr:
+				if n.Op != token.AND {
+					break
+				}
+				if lit, ok := n.X.(*ast.CompositeLit); ok {
+					if wrapper := m.literal(lit, true); wrapper != nil {
+						c.Replace(wrapper)
+						return false
+					}
+				}
+			case *ast.CompositeLit:
+				switch m.info.TypeOf(n).Underlying().(type) {
+				case *types.Slice, *types.Pointer:
+					if wrapper := m.literal(n, false); wrapper != nil {
+						c.Replace(wrapper)
+						return false
+					}
+				default:
+					// Maps and copied values: the elements
+					// cannot be differentiated, but nested
+					// slice literals can.
+					for _, elt := range n.Elts {
+						if kv, ok := elt.(*ast.KeyValueExpr); ok {
+							elt = kv.Value
+						}
+						if m.isDifferentiable(elt) {
+							pos := m.fset.Position(n.Pos())
+							log.Printf("WARNING: %v:%v:%v: cannot "+
+								"differentiate elements of "+
+								"a composite literal which is "+
+								"a map or is not assigned "+
+								"to a variable",
+								pos.Filename, pos.Line, pos.Column)
+							break
+						}
+					}
+				}
+			}
+			return true
+		},
+		nil)
 
 	return err
 }
 
+// literal wraps a slice literal or a pointer to a composite
+// literal. If the address of the literal is taken, addr is
+// true. If there is nothing to differentiate in the literal,
+// literal returns nil.
+func (m *model) literal(
+	lit *ast.CompositeLit,
+	addr bool,
+) ast.Expr {
+	t := m.info.TypeOf(lit)
+	if pt, ok := t.Underlying().(*types.Pointer); ok {
+		// An element of a slice, array or map of pointers,
+		// with the address operator elided.
+		t, addr = pt.Elem(), true
+	}
+	if _, ok := t.Underlying().(*types.Map); ok {
+		return nil
+	}
+
+	id := m.genIdent("lit")
+	var target ast.Expr = id
+	if _, ok := t.Underlying().(*types.Slice); ok && addr {
+		// Pointer to slice, dereference to index.
+		target = &ast.ParenExpr{
+			X: &ast.StarExpr{X: id},
+		}
+	}
+	asgns := m.elements(lit, target)
+	if len(asgns) == 0 {
+		return nil
+	}
+
+	if lit.Type == nil {
+		// The type is elided in a nested literal.
+		lit.Type = m.typeAst(t, lit.Pos())
+	}
+	var value ast.Expr = lit
+	if addr {
+		value = &ast.UnaryExpr{
+			Op: token.AND,
+			X:  lit,
+		}
+		t = types.NewPointer(t)
+	}
+	body := []ast.Stmt{
+		&ast.DeclStmt{
+			Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{
+					&ast.ValueSpec{
+						Names: []*ast.Ident{id},
+						Type:  m.typeAst(t, lit.Pos()),
+					}}}},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{id},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{value},
+		},
+	}
+	body = append(body, asgns...)
+	body = append(body, &ast.ReturnStmt{
+		Results: []ast.Expr{id},
+	})
+	wrapper := &ast.FuncLit{
+		Type: &ast.FuncType{
+			Params: &ast.FieldList{},
+			Results: &ast.FieldList{
+				List: []*ast.Field{
+					&ast.Field{
+						Type: m.typeAst(t, lit.Pos()),
+					}}}},
+		Body: &ast.BlockStmt{List: body},
+	}
+	if m.literals == nil {
+		m.literals = make(map[*ast.FuncLit]bool)
+	}
+	m.literals[wrapper] = true
+	call := &ast.CallExpr{Fun: wrapper}
+	m.info.Types[call] = types.TypeAndValue{Type: t}
+	return call
+}
+
+// elements moves float64 elements of a composite literal,
+// including elements of nested literals, into assignments to
+// the corresponding elements of target, and returns the
+// assignments. The moved elements are replaced by zeros;
+// constants are left in the literal.
+func (m *model) elements(
+	lit *ast.CompositeLit,
+	target ast.Expr,
+) (asgns []ast.Stmt) {
+	t := m.info.TypeOf(lit)
+	if pt, ok := t.Underlying().(*types.Pointer); ok {
+		t = pt.Elem()
+	}
+
+	// element either moves the element value into an
+	// assignment or descends into a nested literal.
+	element := func(value *ast.Expr, lhs ast.Expr, et types.Type) {
+		switch e := (*value).(type) {
+		case *ast.CompositeLit:
+			asgns = append(asgns, m.elements(e, lhs)...)
+			return
+		case *ast.UnaryExpr:
+			if lit, ok := e.X.(*ast.CompositeLit); ok &&
+				e.Op == token.AND {
+				asgns = append(asgns, m.elements(lit, lhs)...)
+				return
+			}
+		}
+		if !m.isDifferentiable(*value) {
+			return
+		}
+		// Register the type of the left-hand side, it is
+		// consulted when the assignment is rewritten.
+		m.info.Types[lhs] = types.TypeAndValue{Type: et}
+		asgns = append(asgns, &ast.AssignStmt{
+			Lhs:    []ast.Expr{lhs},
+			TokPos: (*value).Pos(),
+			Tok:    token.ASSIGN,
+			Rhs:    []ast.Expr{*value},
+		})
+		*value = intExpr(0)
+	}
+
+	switch ut := t.Underlying().(type) {
+	case *types.Slice, *types.Array:
+		var et types.Type
+		if st, ok := ut.(*types.Slice); ok {
+			et = st.Elem()
+		} else {
+			et = ut.(*types.Array).Elem()
+		}
+		index := 0
+		for i, elt := range lit.Elts {
+			value := &lit.Elts[i]
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				key, _ := constant.Int64Val(m.info.Types[kv.Key].Value)
+				index = int(key)
+				value = &kv.Value
+			}
+			element(value, &ast.IndexExpr{
+				X:     target,
+				Index: intExpr(index),
+			}, et)
+			index++
+		}
+	case *types.Struct:
+		for i, elt := range lit.Elts {
+			var field *types.Var
+			value := &lit.Elts[i]
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				field = m.info.ObjectOf(kv.Key.(*ast.Ident)).(*types.Var)
+				value = &kv.Value
+			} else {
+				field = ut.Field(i)
+			}
+			sel := &ast.Ident{Name: field.Name()}
+			m.info.Uses[sel] = field
+			element(value, &ast.SelectorExpr{
+				X:   target,
+				Sel: sel,
+			}, field.Type())
+		}
+	}
+
+	return asgns
+}
+
+// isAddressable returns true iff the left-hand side of an
+// assignment is neither the blank identifier nor a map entry.
+func (m *model) isAddressable(lhs ast.Expr) bool {
+	switch lhs := lhs.(type) {
+	case *ast.Ident:
+		return lhs.Name != "_"
+	case *ast.IndexExpr:
+		_, ok := m.info.TypeOf(lhs.X).(*types.Map)
+		return !ok
+	}
+	return true
+}
+
+// isDifferentiable returns true iff the expression is a float64
+// expression with a value which is not known at compile time.
+func (m *model) isDifferentiable(expr ast.Expr) bool {
+	return isReal(m.info.TypeOf(expr)) &&
+		m.info.Types[expr].Value == nil
+}
+
 // typeAst returns the AST for the given type. Used to
 // generate variable declarations.
 func (m *model) typeAst(t types.Type, p token.Pos) ast.Expr {
@@ -574,18 +1182,85 @@ func (m *model) typeAst(t types.Type, p token.Pos) ast.Expr {
 
 // rewrite rewrites the method using tape-writing calls.
 func (m *model) rewrite(method *ast.FuncDecl) (err error) {
+	err = m.rewriteNode(method)
+	if err != nil {
+		return err
+	}
+
+	// Method entry
+	// Processed after the traversal so that Apply does not see
+	// the added function calls.
+
+	// If we are differentiating Observe, the entry is different
+	// than for other methods. Depending on whether Observe was
+	// called from another model method (on the same or a
+	// different model), or from a unObserve,
+	// the prologue is either like of any other method (Enter)
+	// or the beginning of a tape frame (Setup). LogPrior and
+	// LogLikelihood of a separable model (see model.Separable)
+	// are differentiated as Observe. Any other
+	// method can only be called from Observe
+	// and panicks otherwise. A function called from outside
+	// of a differentiated method gets a frame of its own,
+	// which is discarded on return.
+	var foreign []ast.Stmt
+	switch {
+	case method.Recv == nil:
+		foreign = []ast.Stmt{
+			&ast.ExprStmt{X: m.callExpr("Setup", &ast.Ident{Name: "nil"})},
+			&ast.DeferStmt{Call: m.callExpr("Pop").(*ast.CallExpr)},
+		}
+	case m.isEntry(method):
+		foreign = []ast.Stmt{m.setupStmt(method)}
+	default:
+		foreign = []ast.Stmt{&ast.ExprStmt{
+			X: &ast.CallExpr{
+				Fun: &ast.Ident{Name: "panic"},
+				Args: []ast.Expr{
+					&ast.BasicLit{
+						Value: fmt.Sprintf(
+							"\"%v called outside Observe\"",
+							method.Name.Name),
+						Kind: token.STRING,
+					}}}}}
+	}
+	prologue := &ast.IfStmt{
+		Cond: m.callExpr("Called"),
+		Body: &ast.BlockStmt{
+			List: []ast.Stmt{
+				m.enterStmt(method),
+			}},
+		Else: &ast.BlockStmt{
+			List: foreign}}
+	// The explicit tape is obtained before the prologue.
+	var tape []ast.Stmt
+	if Explicit {
+		tape = m.tapeStmts(method)
+	}
+	method.Body.List = append(append(tape, prologue),
+		method.Body.List...)
+
+	return err
+}
+
+// rewriteNode rewrites the code of a method or of a composite
+// literal wrapper using tape-writing calls.
+func (m *model) rewriteNode(node ast.Node) (err error) {
 	// Apply panics on errors. When Apply panics, we return the
 	// error as do other functions.
 	defer errOnPanic(
 		&err,
-		m.fset.Position(method.Pos()),
+		m.fset.Position(node.Pos()),
 	)()
 
 	// ontape switches rewriting on and off. If pre returns true
 	// but ontape is false, Apply traverses the children but
 	// they are not rewritten (until ontape is true).
 	ontape := false
-	astutil.Apply(method,
+	// is32 is true if the statement being rewritten is
+	// float32.
+	is32 := false
+	astutil.Apply(node,
 		// pre focuses on the parts of the tree that are to be
 		// rewritten.
 		func(c *astutil.Cursor) bool {
@@ -599,21 +1274,19 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 
 			switch n := n.(type) {
 			case *ast.BasicLit:
-				if !isFloat(m.info.TypeOf(n)) {
+				if !isReal(m.info.TypeOf(n)) {
 					return false
 				}
 			case *ast.CompositeLit:
-				pos := m.fset.Position(n.Pos())
-				log.Printf("WARNING: %v:%v:%v: composite literals "+
-					"are not differentiated yet; see "+
-					"https://bitbucket.org/dtolpin/infergo/issues/1.",
-					pos.Filename, pos.Line, pos.Column)
+				// Float64 elements were moved out of the
+				// literal by desugar, the rest are constants
+				// or not differentiated.
 				return false
 			case *ast.IndexExpr, *ast.SelectorExpr,
 				*ast.StarExpr, *ast.UnaryExpr, *ast.BinaryExpr:
 				// Expressions must be of type float64
 				e := n.(ast.Expr)
-				if !isFloat(m.info.TypeOf(e)) {
+				if !isReal(m.info.TypeOf(e)) {
 					return false
 				}
 			case *ast.Ident:
@@ -626,27 +1299,33 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 				if o == nil {
 					return false
 				}
+				// Type names in conversions are not rewritten.
+				if _, ok := o.(*types.TypeName); ok {
+					return false
+				}
 				// We only need identifiers which are constants
 				// or variables but not fields ...
 				if _, ok := c.Parent().(*ast.SelectorExpr); ok {
 					return false
 				}
-				// ... and the type must be float64 or untyped
-				// float.
-				if !isFloat(m.info.TypeOf(n)) {
+				// ... and the type must be float64, float32
+				// or untyped float.
+				if !isReal(m.info.TypeOf(n)) {
 					return false
 				}
 			case *ast.CallExpr:
 				switch {
 				case m.isDifferentiated(n):
 				case m.isElemental(n):
+				case m.isElemental32(n):
 				case m.isVlemental(n):
+				case m.isConversion(n):
 				default:
 					// A function which is neither
 					// differentiated nor elemental is called
 					// with all their arguments unmodified.
-					if isFloat(m.info.TypeOf(n)) {
-						value := callExpr("Value", n)
+					if t := m.info.TypeOf(n); isReal(t) {
+						value := m.callExpr(tapeName("Value", t), n)
 						c.Replace(value)
 					}
 					return false
@@ -656,16 +1335,17 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 					return false
 				}
 				for _, r := range n.Results {
-					if !isFloat(m.info.TypeOf(r)) {
+					if !isReal(m.info.TypeOf(r)) {
 						return false
 					}
 				}
+				is32 = isFloat32(m.info.TypeOf(n.Results[0]))
 				ontape = true
 			case *ast.AssignStmt:
 				// All expressions are float64.
 				for _, r := range n.Rhs {
 					t := m.info.TypeOf(r)
-					if !isFloat(t) {
+					if !isReal(t) {
 						// The returned value is not a float,
 						// but it may be a tuple of floats. We
 						// cannot differentiate it, but since it
@@ -675,7 +1355,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 						if ok {
 							floats := true
 							for i := 0; i != t.Len(); i++ {
-								if !isFloat(t.At(i).Type()) {
+								if !isReal(t.At(i).Type()) {
 									floats = false
 									break
 								}
@@ -692,6 +1372,19 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 						return false
 					}
 				}
+				// All values are of the same float type.
+				is32 = isFloat32(m.info.TypeOf(n.Rhs[0]))
+				for _, r := range n.Rhs[1:] {
+					if isFloat32(m.info.TypeOf(r)) != is32 {
+						pos := m.fset.Position(n.Pos())
+						log.Printf(
+							"WARNING: %v:%v:%v: cannot "+
+								"differentiate assignment "+
+								"of mixed float64 and float32 values",
+							pos.Filename, pos.Line, pos.Column)
+						return false
+					}
+				}
 				// All places are assignable.
 				for _, l := range n.Lhs {
 					switch l := l.(type) {
@@ -737,13 +1430,13 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 
 			switch n := n.(type) {
 			case *ast.BasicLit:
-				value := callExpr("Value", n)
+				value := m.callExpr(tapeName("Value", m.info.TypeOf(n)), n)
 				c.Replace(value)
 			case *ast.Ident:
 				var place ast.Expr
 				if n.Name == "_" {
 					// Dummy identifier, allocate a new place.
-					place = callExpr("Value", floatExpr(0))
+					place = m.callExpr(name32("Value", is32), floatExpr(0))
 				} else {
 					if m.prefix != "" &&
 						strings.HasPrefix(n.Name, m.prefix) {
@@ -757,7 +1450,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 					o := m.info.ObjectOf(n)
 					switch o.(type) {
 					case *types.Const:
-						place = callExpr("Value", n)
+						place = m.callExpr(tapeName("Value", m.info.TypeOf(n)), n)
 					case *types.Var:
 						place = &ast.UnaryExpr{
 							Op: token.AND,
@@ -770,7 +1463,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 				var place ast.Expr
 				if _, ok := m.info.TypeOf(n.X).(*types.Map); ok {
 					// Map entries cannot be differentiated
-					place = callExpr("Value", n)
+					place = m.callExpr(tapeName("Value", m.info.TypeOf(n)), n)
 				} else {
 					place = &ast.UnaryExpr{
 						Op: token.AND,
@@ -783,7 +1476,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 				o := m.info.ObjectOf(n.Sel)
 				switch o.(type) {
 				case *types.Const:
-					place = callExpr("Value", n)
+					place = m.callExpr(tapeName("Value", m.info.TypeOf(n)), n)
 				case *types.Var:
 					place = &ast.UnaryExpr{
 						Op: token.AND,
@@ -792,7 +1485,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 				}
 				c.Replace(place)
 			case *ast.ReturnStmt:
-				ret := callExpr("Return", n.Results...)
+				ret := m.callExpr(name32("Return", is32), n.Results...)
 				n.Results = []ast.Expr{ret}
 				ontape = false
 			case *ast.StarExpr:
@@ -802,13 +1495,13 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 				case token.SUB:
 					var neg ast.Expr
 					if neg = m.fold(n); neg == nil {
-						neg = callExpr("Arithmetic",
+						neg = m.callExpr(tapeName("Arithmetic", m.info.TypeOf(n)),
 							varExpr("OpNeg"),
 							n.X)
 					}
 					c.Replace(neg)
 				case token.ARROW:
-					arrow := callExpr("Value", n)
+					arrow := m.callExpr(tapeName("Value", m.info.TypeOf(n)), n)
 					c.Replace(arrow)
 				default:
 					panic(fmt.Sprintf(
@@ -817,7 +1510,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 			case *ast.BinaryExpr:
 				var bin ast.Expr
 				if bin = m.fold(n); bin == nil {
-					bin = callExpr("Arithmetic",
+					bin = m.callExpr(tapeName("Arithmetic", m.info.TypeOf(n)),
 						map[token.Token]ast.Expr{
 							token.ADD: varExpr("OpAdd"),
 							token.SUB: varExpr("OpSub"),
@@ -830,10 +1523,10 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 			case *ast.AssignStmt:
 				var asgn ast.Expr
 				if len(n.Lhs) == 1 {
-					asgn = callExpr("Assignment",
+					asgn = m.callExpr(name32("Assignment", is32),
 						n.Lhs[0], n.Rhs[0])
 				} else {
-					asgn = callExpr("ParallelAssignment",
+					asgn = m.callExpr(name32("ParallelAssignment", is32),
 						append(n.Lhs, n.Rhs...)...)
 				}
 				stmt := &ast.ExprStmt{X: asgn}
@@ -845,6 +1538,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 					// Collect arguments.
 					var innerArgs, outerArgs []ast.Expr
 					t := m.info.TypeOf(n.Fun).(*types.Signature)
+					callIs32, _ := signatureKind(t)
 					nparams := t.Params().Len()
 					if t.Variadic() {
 						nparams--
@@ -852,7 +1546,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 					nargs := 0
 					for i := 0; i != nparams; i++ {
 						param := t.Params().At(i)
-						if isFloat(param.Type()) {
+						if isReal(param.Type()) {
 							// A float, pass 0 to the actual
 							// function and the differentiated
 							// expression to Call.
@@ -876,7 +1570,7 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 					if t.Variadic() && len(n.Args) > nparams {
 						variadic := t.Params().At(nparams)
 						vt := variadic.Type().(*types.Slice)
-						if isFloat(vt.Elem()) &&
+						if isReal(vt.Elem()) &&
 							n.Ellipsis == token.NoPos {
 							// Variadic float64 arguments, passed
 							// through the wrapper parameter.
@@ -896,20 +1590,74 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 					outerArgs = append([]ast.Expr{intExpr(nargs)},
 						outerArgs...)
 
-					differentiated := callExpr("Call",
+					// Arguments containing composite literal
+					// wrappers write to the tape, and must be
+					// evaluated before the call.
+					var params []*ast.Field
+					var args []ast.Expr
+					for i, arg := range innerArgs {
+						if !m.hasLiteral(arg) {
+							continue
+						}
+						param := m.genIdent(fmt.Sprintf("arg%d", len(args)))
+						params = append(params, &ast.Field{
+							Names: []*ast.Ident{param},
+							Type: m.typeAst(m.info.TypeOf(arg),
+								n.Pos()),
+						})
+						args = append(args, arg)
+						innerArgs[i] = param
+					}
+
+					fun := n.Fun
+					if Explicit && m.takesTape(n) {
+						// Differentiated functions and methods
+						// of types without method Tape get the
+						// tape as the first argument, and
+						// exported functions are renamed (see
+						// wrapExported).
+						innerArgs = append(
+							[]ast.Expr{m.genIdent("tape")},
+							innerArgs...)
+						if id, ok := n.Fun.(*ast.Ident); ok &&
+							id.IsExported() {
+							fun = m.genIdent(id.Name)
+						}
+					}
+
+					var differentiated ast.Expr = m.callExpr(
+						name32("Call", callIs32),
 						append([]ast.Expr{
 							callWrapper(vararg,
-								n.Fun, innerArgs, ellipsis),
+								fun, innerArgs, ellipsis,
+								callIs32),
 						}, outerArgs...)...)
+					if len(args) > 0 {
+						differentiated = argWrapper(params,
+							differentiated, args, callIs32)
+					}
 					c.Replace(differentiated)
 				case m.isElemental(n):
-					elemental := callExpr("Elemental",
+					elemental := m.callExpr("Elemental",
+						append([]ast.Expr{n.Fun}, n.Args...)...)
+					c.Replace(elemental)
+				case m.isElemental32(n):
+					elemental := m.callExpr("Elemental32",
 						append([]ast.Expr{n.Fun}, n.Args...)...)
 					c.Replace(elemental)
 				case m.isVlemental(n):
-					vlemental := callExpr("Vlemental",
+					vlemental := m.callExpr("Vlemental",
 						append([]ast.Expr{n.Fun}, n.Args...)...)
 					c.Replace(vlemental)
+				case m.info.Types[n.Fun].IsType():
+					// The argument is already rewritten, only
+					// conversions between float64 and float32
+					// get here.
+					conversion := "Widen"
+					if isFloat32(m.info.TypeOf(n)) {
+						conversion = "Narrow"
+					}
+					c.Replace(m.callExpr(conversion, n.Args[0]))
 				}
 			case *ast.ExprStmt:
 				ontape = false
@@ -917,45 +1665,27 @@ func (m *model) rewrite(method *ast.FuncDecl) (err error) {
 			return true
 		})
 
-	// Method entry
-	// Processed after the traversal so that Apply does not see
-	// the added function calls.
+	return err
+}
 
-	// If we are differentiating Observe, the entry is different
-	// than for other methods. Depending on whether Observe was
-	// called from another model method (on the same or a
-	// different model), or from a unObserve,
-	// the prologue is either like of any other method (Enter)
-	// or the beginning of a tape frame (Setup). Any other
-	// method can only be called from Observe
-	// and panicks otherwise.
-	var foreign ast.Stmt
-	if method.Name.Name == "Observe" {
-		foreign = m.setupStmt(method)
-	} else {
-		foreign = &ast.ExprStmt{
-			X: &ast.CallExpr{
-				Fun: &ast.Ident{Name: "panic"},
-				Args: []ast.Expr{
-					&ast.BasicLit{
-						Value: fmt.Sprintf(
-							"\"%v called outside Observe\"",
-							method.Name.Name),
-						Kind: token.STRING,
-					}}}}
+// isEntry returns true iff the method may be called from
+// outside of the model and begins a tape frame: Observe, or
+// LogPrior or LogLikelihood with the signature of Observe.
+func (m *model) isEntry(method *ast.FuncDecl) bool {
+	switch method.Name.Name {
+	case "Observe":
+		return true
+	case "LogPrior", "LogLikelihood":
+		t := m.info.TypeOf(method.Name).(*types.Signature)
+		if t.Params().Len() != 1 || t.Results().Len() != 1 {
+			return false
+		}
+		param, ok := t.Params().At(0).Type().(*types.Slice)
+		return ok && isReal(param.Elem()) &&
+			types.Identical(param.Elem(), t.Results().At(0).Type())
+	default:
+		return false
 	}
-	prologue := &ast.IfStmt{
-		Cond: callExpr("Called"),
-		Body: &ast.BlockStmt{
-			List: []ast.Stmt{
-				m.enterStmt(method),
-			}},
-		Else: &ast.BlockStmt{
-			List: []ast.Stmt{foreign}}}
-	method.Body.List = append([]ast.Stmt{prologue},
-		method.Body.List...)
-
-	return err
 }
 
 // setupStmt  returns the ast for the Setup or Enter
@@ -972,7 +1702,15 @@ func (m *model) setupStmt(method *ast.FuncDecl) ast.Stmt {
 	} else {
 		arg = param.Names[0]
 	}
-	setup := &ast.ExprStmt{X: callExpr("Setup", arg)}
+	setupName := "Setup"
+	switch {
+	case isFloat32(m.info.TypeOf(param.Type).(*types.Slice).Elem()):
+		// Forward mode is not supported for float32.
+		setupName = "Setup32"
+	case Forward:
+		setupName = "SetupForward"
+	}
+	setup := &ast.ExprStmt{X: m.callExpr(setupName, arg)}
 	return setup
 }
 
@@ -982,6 +1720,7 @@ func (m *model) enterStmt(method *ast.FuncDecl) ast.Stmt {
 	// Collect float64 parameters. Their values are copied
 	// from the tape.
 	t := m.info.TypeOf(method.Name).(*types.Signature)
+	is32, _ := signatureKind(t)
 	var params []ast.Expr
 	n := t.Params().Len()
 	if t.Variadic() {
@@ -995,12 +1734,12 @@ func (m *model) enterStmt(method *ast.FuncDecl) ast.Stmt {
 	iparam, ifield := 0, 0 // ast indices
 	for i := 0; i != n; i++ {
 		p := t.Params().At(i)
-		if isFloat(p.Type()) {
+		if isReal(p.Type()) {
 			var expr ast.Expr
 			if p.Name() == "_" {
 				// There is no variable to copy the value to,
 				// create a dummy value.
-				expr = callExpr("Value", floatExpr(0))
+				expr = m.callExpr(name32("Value", is32), floatExpr(0))
 			} else {
 				expr = &ast.UnaryExpr{
 					Op: token.AND,
@@ -1016,10 +1755,64 @@ func (m *model) enterStmt(method *ast.FuncDecl) ast.Stmt {
 			ifield = 0
 		}
 	}
-	enter := &ast.ExprStmt{X: callExpr("Enter", params...)}
+	enter := &ast.ExprStmt{X: m.callExpr(name32("Enter", is32), params...)}
 	return enter
 }
 
+// tapeStmts returns the statements making the explicit tape
+// available in the method or function. The tape of a method
+// is returned by method Tape of the receiver; a function, or a
+// method of a type without method Tape, gets the tape as an
+// added first parameter.
+func (m *model) tapeStmts(method *ast.FuncDecl) []ast.Stmt {
+	if method.Recv == nil ||
+		!hasTape(m.info.TypeOf(method.Recv.List[0].Type)) {
+		method.Type.Params.List = append([]*ast.Field{{
+			Names: []*ast.Ident{m.genIdent("tape")},
+			Type: &ast.StarExpr{
+				X: varExpr("Tape"),
+			},
+		}}, method.Type.Params.List...)
+		return nil
+	}
+	recv := method.Recv.List[0]
+	if len(recv.Names) == 0 || recv.Names[0].Name == "_" {
+		recv.Names = []*ast.Ident{m.genIdent("m")}
+	}
+	return []ast.Stmt{&ast.AssignStmt{
+		Lhs: []ast.Expr{m.genIdent("tape")},
+		Tok: token.DEFINE,
+		Rhs: []ast.Expr{&ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   &ast.Ident{Name: recv.Names[0].Name},
+				Sel: &ast.Ident{Name: "Tape"},
+			},
+		}},
+	}}
+}
+
+// hasTape returns true iff type typ has method Tape returning
+// *ad.Tape, required when the tape is explicit.
+func hasTape(typ types.Type) bool {
+	o, _, _ := types.LookupFieldOrMethod(typ, true, nil, "Tape")
+	f, ok := o.(*types.Func)
+	if !ok {
+		return false
+	}
+	sig := f.Type().(*types.Signature)
+	if sig.Params().Len() != 0 || sig.Results().Len() != 1 {
+		return false
+	}
+	pt, ok := sig.Results().At(0).Type().(*types.Pointer)
+	if !ok {
+		return false
+	}
+	nt, ok := pt.Elem().(*types.Named)
+	return ok && nt.Obj().Name() == "Tape" &&
+		nt.Obj().Pkg() != nil &&
+		nt.Obj().Pkg().Path() == infergoImport
+}
+
 // fold constant-folds the expression, if possible. If the expression
 // is not constant, nil is returned.
 func (m *model) fold(expr ast.Expr) ast.Expr {
@@ -1028,7 +1821,8 @@ func (m *model) fold(expr ast.Expr) ast.Expr {
 	}
 	if v := m.info.Types[expr].Value; v != nil {
 		if fv, known := constant.Float64Val(v); known {
-			return callExpr("Value", floatExpr(fv))
+			return m.callExpr(tapeName("Value", m.info.TypeOf(expr)),
+				floatExpr(fv))
 		}
 	}
 	return nil
@@ -1042,8 +1836,11 @@ func (m *model) genIdent(name string) *ast.Ident {
 }
 
 // isDifferentiated returns true iff the call is of a
-// differentiated method
+// differentiated method or function
 func (m *model) isDifferentiated(call *ast.CallExpr) bool {
+	if id, ok := call.Fun.(*ast.Ident); ok {
+		return m.functions[m.info.ObjectOf(id)]
+	}
 	sel, ok := call.Fun.(*ast.SelectorExpr)
 	if !ok {
 		return ok
@@ -1057,6 +1854,7 @@ func (m *model) isDifferentiated(call *ast.CallExpr) bool {
 	if ok {
 		// Fix the import: if the import refers to the
 		// undifferentiated package, add the "/ad" suffix
+		// ("/adx" if the tape is explicit, see subpackage)
 		// to the first import of the package. Remaining
 		// imports of the same package, with different
 		// names, can be used to access the undifferentiated
@@ -1067,12 +1865,13 @@ func (m *model) isDifferentiated(call *ast.CallExpr) bool {
 		// slightly perversive, but does the job.
 		types.TypeString(t.Recv(),
 			func(pkg *types.Package) string {
-				if strings.HasSuffix(pkg.Path(), "/ad") {
+				if strings.HasSuffix(pkg.Path(), "/ad") ||
+					strings.HasSuffix(pkg.Path(), "/adx") {
 					// We are already using a differentiated
 					// model, do nothing.
 					return pkg.Path()
 				}
-				adPath := pkg.Path() + "/ad"
+				adPath := pkg.Path() + "/" + subpackage()
 				pos := m.fset.Position(call.Pos())
 				file := m.pkg.Files[pos.Filename]
 				// Traverse the list of imports to find the
@@ -1097,6 +1896,31 @@ func (m *model) isDifferentiated(call *ast.CallExpr) bool {
 	return ok
 }
 
+// takesTape returns true iff the differentiated function or
+// method called gets the explicit tape as the first argument:
+// the call is of a function, or of a method of a type without
+// method Tape, possibly in another package.
+func (m *model) takesTape(call *ast.CallExpr) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return true
+	}
+	return !hasTape(m.info.Selections[sel].Recv())
+}
+
+// hasLiteral returns true iff the expression contains a
+// composite literal wrapper.
+func (m *model) hasLiteral(expr ast.Expr) bool {
+	found := false
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok && m.literals[lit] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
 // isElemental returns true iff the call is of an elemental
 // function. An elemental function is a function with one or
 // more non-variadic float64 parameters returning float64.
@@ -1126,6 +1950,42 @@ func (m *model) isElemental(call *ast.CallExpr) bool {
 	return true
 }
 
+// isElemental32 returns true iff the call is of a float32
+// elemental function, with one or more non-variadic float32
+// parameters returning float32.
+func (m *model) isElemental32(call *ast.CallExpr) bool {
+	t, ok := m.info.TypeOf(call.Fun).(*types.Signature)
+	if !ok { // a type cast rather than a call
+		return false
+	}
+	if t.Results().Len() != 1 ||
+		!isFloat32(t.Results().At(0).Type()) {
+		return false
+	}
+	if t.Params().Len() == 0 || t.Variadic() {
+		return false
+	}
+	for i := 0; i != t.Params().Len(); i++ {
+		if !isFloat32(t.Params().At(i).Type()) {
+			return false
+		}
+	}
+	return true
+}
+
+// isConversion returns true iff the call is a conversion
+// between float64 and float32 of a non-constant value.
+func (m *model) isConversion(call *ast.CallExpr) bool {
+	if !m.info.Types[call.Fun].IsType() ||
+		m.info.Types[call].Value != nil ||
+		len(call.Args) != 1 {
+		return false
+	}
+	to, from := m.info.TypeOf(call), m.info.TypeOf(call.Args[0])
+	return isFloat(to) && isFloat32(from) ||
+		isFloat32(to) && isFloat(from)
+}
+
 // isVlemental returns true iff the call is of a vector
 // elemental function. An elemental function is a function with
 // one argument of []float64 type returning float64.
@@ -1165,6 +2025,42 @@ func isFloat(typ types.Type) bool {
 			bt.Kind() == types.UntypedFloat)
 }
 
+// isFloat32 returns true iff the kind is float32
+func isFloat32(typ types.Type) bool {
+	bt, ok := typ.(*types.Basic)
+	return ok && bt.Kind() == types.Float32
+}
+
+// isReal returns true iff the type is differentiated, that is
+// either a float kind or float32.
+func isReal(typ types.Type) bool {
+	return isFloat(typ) || isFloat32(typ)
+}
+
+// name32 returns the name of the float32 variant of tape
+// function name if is32 is true, and name otherwise.
+func name32(name string, is32 bool) string {
+	if is32 {
+		return name + "32"
+	}
+	return name
+}
+
+// floatName returns the name of the float type, float32 if
+// is32 is true and float64 otherwise.
+func floatName(is32 bool) string {
+	if is32 {
+		return "float32"
+	}
+	return "float64"
+}
+
+// tapeName returns the name of the tape function for values of
+// type typ.
+func tapeName(name string, typ types.Type) string {
+	return name32(name, isFloat32(typ))
+}
+
 // intExpr returns an Expr for integer literal i.
 func intExpr(i int) ast.Expr {
 	return &ast.BasicLit{
@@ -1193,10 +2089,18 @@ func varExpr(name string) ast.Expr {
 	}
 }
 
-// callExpr returns an Expr for call 'ad.name(args...)'.
-func callExpr(name string, args ...ast.Expr) ast.Expr {
+// callExpr returns an Expr for call 'ad.name(args...)', or
+// for call '_tape.name(args...)' if the tape is explicit.
+func (m *model) callExpr(name string, args ...ast.Expr) ast.Expr {
+	fun := varExpr(name)
+	if Explicit {
+		fun = &ast.SelectorExpr{
+			X:   m.genIdent("tape"),
+			Sel: &ast.Ident{Name: name},
+		}
+	}
 	return &ast.CallExpr{
-		Fun:  varExpr(name),
+		Fun:  fun,
 		Args: args,
 	}
 }
@@ -1208,6 +2112,7 @@ func callWrapper(
 	fun ast.Expr,
 	args []ast.Expr,
 	ellipsis token.Pos,
+	is32 bool,
 ) *ast.FuncLit {
 	return &ast.FuncLit{
 		Type: &ast.FuncType{
@@ -1219,7 +2124,7 @@ func callWrapper(
 						},
 						Type: &ast.ArrayType{
 							Elt: &ast.Ident{
-								Name: "float64",
+								Name: floatName(is32),
 							}}}}}},
 		Body: &ast.BlockStmt{
 			List: []ast.Stmt{
@@ -1232,11 +2137,53 @@ func callWrapper(
 	}
 }
 
+// argWrapper returns an Expr for a differentiated call with
+// arguments evaluated before the call.
+func argWrapper(
+	params []*ast.Field,
+	call ast.Expr,
+	args []ast.Expr,
+	is32 bool,
+) *ast.CallExpr {
+	return &ast.CallExpr{
+		Fun: &ast.FuncLit{
+			Type: &ast.FuncType{
+				Params: &ast.FieldList{
+					List: params,
+				},
+				Results: &ast.FieldList{
+					List: []*ast.Field{
+						&ast.Field{
+							Type: &ast.StarExpr{
+								X: &ast.Ident{
+									Name: floatName(is32),
+								}}}}}},
+			Body: &ast.BlockStmt{
+				List: []ast.Stmt{
+					&ast.ReturnStmt{
+						Results: []ast.Expr{call},
+					}}},
+		},
+		Args: args,
+	}
+}
+
 // Writing
 
+// subpackage returns the name of the subpackage of the
+// differentiated model: "ad", or "adx" if the tape is explicit.
+// The explicit-tape variant of a package, such as dist/adx, can
+// be generated alongside the default one.
+func subpackage() string {
+	if Explicit {
+		return "adx"
+	}
+	return "ad"
+}
+
 // write writes the differentiated model as a Go package source.
 func (m *model) write() (err error) {
-	admpath := filepath.Join(m.path, "ad")
+	admpath := filepath.Join(m.path, subpackage())
 	// Create the directory for the differentiated model.
 	err = os.Mkdir(admpath, os.ModePerm)
 	if err != nil &&
@@ -160,6 +160,52 @@ func (m Model) Sample() float64 {
 				"Observe": true,
 				"Sample":  true,
 			}},
+
+		// Methods and functions
+		{map[string]string{
+			"one.go": `package functions
+
+import "bitbucket.org/dtolpin/infergo/ad"
+
+type Model float64
+
+func (m Model) Observe(x []float64) float64 {
+	return logistic(x[0], x)
+}
+
+func logistic(a float64, xs []float64) float64 {
+	return a * xs[0]
+}
+
+func scale(xs []float64, s float64) {
+	xs[0] *= s
+}
+
+func count(xs []float64) int {
+	return len(xs)
+}
+
+func pi() float64 {
+	return 3.14159
+}
+
+func sigm(x float64) float64 {
+	return x
+}
+
+func init() {
+	ad.RegisterElemental(sigm,
+		func(_ float64, _ ...float64) []float64 {
+			return []float64{1}
+		})
+}
+`,
+		},
+			map[string]bool{
+				"Observe":  true,
+				"logistic": true,
+				"scale":    true,
+			}},
 	} {
 		m, err := parseTestModel(c.model)
 		if err != nil {
@@ -449,6 +495,82 @@ func (m Model) Observe(x []float64) float64 {
 	var b float64
 	b = a
 	return b
+}`,
+		},
+		//====================================================
+		{`package structlit
+
+type Model float64
+
+type Point struct {
+	X, Y float64
+	Name string
+}
+
+func (m Model) Observe(x []float64) float64 {
+	p := Point{x[0], 1, "p"}
+	q := [2]Point{{Y: x[1]}, {}}
+	return p.X + q[0].Y
+}`,
+			//----------------------------------------------------
+			`package structlit
+
+type Model float64
+
+type Point struct {
+	X, Y float64
+	Name string
+}
+
+func (m Model) Observe(x []float64) float64 {
+	var p Point
+	p = Point{0, 1, "p"}
+	p.X = x[0]
+	var q [2]Point
+	q = [2]Point{{Y: 0}, {}}
+	q[0].Y = x[1]
+	return p.X + q[0].Y
+}`,
+		},
+		//====================================================
+		{`package slicelit
+
+type Model float64
+
+type Point struct {
+	X, Y float64
+}
+
+func (m Model) Observe(x []float64) float64 {
+	y := []float64{x[0], 1}
+	p := &Point{Y: x[1]}
+	return y[0] + p.Y
+}`,
+			//----------------------------------------------------
+			`package slicelit
+
+type Model float64
+
+type Point struct {
+	X, Y float64
+}
+
+func (m Model) Observe(x []float64) float64 {
+	var y []float64
+	y = func() []float64 {
+		var _lit []float64
+		_lit = []float64{0, 1}
+		_lit[0] = x[0]
+		return _lit
+	}()
+	var p *Point
+	p = func() *Point {
+		var _lit *Point
+		_lit = &Point{Y: 0}
+		_lit.Y = x[1]
+		return _lit
+	}()
+	return y[0] + p.Y
 }`,
 			//====================================================
 		},
@@ -597,6 +719,63 @@ func (m Model) Pi () float64 {
 		panic("Pi called outside Observe")
 	}
 	return ad.Return(ad.Value(math.Pi))
+}`,
+		},
+		//====================================================
+		{`package separable
+
+type Model float64
+
+func (m Model) Observe(x []float64) float64 {
+	return m.LogPrior(x) + m.LogLikelihood(x)
+}
+
+func (m Model) LogPrior(x []float64) float64 {
+	return -x[0] * x[0]
+}
+
+func (m Model) LogLikelihood(x []float64) float64 {
+	return x[0]
+}`,
+			//----------------------------------------------------
+			`package separable
+
+import "bitbucket.org/dtolpin/infergo/ad"
+
+type Model float64
+
+func (m Model) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpAdd,
+		ad.Call(func(_ []float64) {
+			m.LogPrior(x)
+		}, 0),
+		ad.Call(func(_ []float64) {
+			m.LogLikelihood(x)
+		}, 0)))
+}
+
+func (m Model) LogPrior(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul,
+		ad.Arithmetic(ad.OpNeg, &x[0]), &x[0]))
+}
+
+func (m Model) LogLikelihood(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(&x[0])
 }`,
 		},
 		//====================================================
@@ -853,7 +1032,10 @@ func (m Model) Observe(_ []float64) float64 {
 		//====================================================
 		{`package elemental
 
-import "math"
+import (
+	"math"
+	"bitbucket.org/dtolpin/infergo/ad"
+)
 
 type Model float64
 
@@ -861,6 +1043,13 @@ func first(x []float64) float64 {
 	return x[0]
 }
 
+func init() {
+	ad.RegisterElemental(first,
+		func(_ float64, _ ...float64) []float64 {
+			return []float64{1}
+		})
+}
+
 func (m Model) Observe(x []float64) float64 {
 	y := math.Sin(x[0])
 	z := first(x)
@@ -880,6 +1069,13 @@ func first(x []float64) float64 {
 	return x[0]
 }
 
+func init() {
+	ad.RegisterElemental(first,
+		func(_ float64, _ ...float64) []float64 {
+			return []float64{1}
+		})
+}
+
 func (m Model) Observe(x []float64) float64 {
 	if ad.Called() {
 		ad.Enter()
@@ -928,11 +1124,18 @@ func pi() float64 {
 }
 
 func intpow(a float64, n int) float64 {
-	pow := 1.
-	for i := 0; i != n; i++ {
-		pow *= a
+	if ad.Called() {
+		ad.Enter(&a)
+	} else {
+		ad.Setup(nil)
+		defer ad.Pop()
 	}
-	return pow
+	var pow float64
+	ad.Assignment(&pow, ad.Value(1.))
+	for i := 0; i != n; i = i + 1 {
+		ad.Assignment(&pow, ad.Arithmetic(ad.OpMul, &pow, &a))
+	}
+	return ad.Return(&pow)
 }
 
 func (m Model) Observe(x []float64) float64 {
@@ -944,7 +1147,9 @@ func (m Model) Observe(x []float64) float64 {
 	var y float64
 	ad.Assignment(&y, ad.Value(pi()))
 	var z float64
-	ad.Assignment(&z, ad.Value(intpow(y, 3)))
+	ad.Assignment(&z, ad.Call(func(_ []float64) {
+		intpow(0, 3)
+	}, 1, &y))
 	ad.Assignment(&z, ad.Value(float64(z)))
 	return ad.Return(ad.Arithmetic(ad.OpMul, &y, &z))
 }`,
@@ -1292,10 +1497,164 @@ func (m Model) Observe(x []float64) float64 {
 	} else {
 		ad.Setup(x)
 	}
-	return ad.Return(ad.Call(func (_ []float64) {
-		m.Observe([]float64{x[0]})
-	}, 0))
+	return ad.Return(func(_arg0 []float64) *float64 {
+		return ad.Call(func(_ []float64) {
+			m.Observe(_arg0)
+		}, 0)
+	}(func() []float64 {
+		var _lit []float64
+		_lit = []float64{0}
+		ad.Assignment(&_lit[0], &x[0])
+		return _lit
+	}()))
+}`,
+		},
 		//====================================================
+		{`package function
+
+type Model float64
+
+func logistic(a float64, xs []float64) float64 {
+	return a * xs[0]
+}
+
+func scale(xs []float64, s float64) {
+	xs[0] *= s
+}
+
+func (m Model) Observe(x []float64) float64 {
+	scale(x, 2)
+	return logistic(x[1], x)
+}`,
+			//----------------------------------------------------
+			`package function
+
+import "bitbucket.org/dtolpin/infergo/ad"
+
+type Model float64
+
+func logistic(a float64, xs []float64) float64 {
+	if ad.Called() {
+		ad.Enter(&a)
+	} else {
+		ad.Setup(nil)
+		defer ad.Pop()
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul, &a, &xs[0]))
+}
+
+func scale(xs []float64, s float64) {
+	if ad.Called() {
+		ad.Enter(&s)
+	} else {
+		ad.Setup(nil)
+		defer ad.Pop()
+	}
+	ad.Assignment(&xs[0], ad.Arithmetic(ad.OpMul, &xs[0], &s))
+}
+
+func (m Model) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	ad.Call(func(_ []float64) {
+		scale(x, 0)
+	}, 1, ad.Value(2))
+	return ad.Return(ad.Call(func(_ []float64) {
+		logistic(0, x)
+	}, 1, &x[1]))
+}`,
+		},
+		//====================================================
+		{`package compositestruct
+
+type Model float64
+
+type Point struct {
+	X, Y float64
+}
+
+func (m Model) Observe(x []float64) float64 {
+	p := Point{X: x[0], Y: 1}
+	return p.X
+}`,
+			//----------------------------------------------------
+			`package compositestruct
+
+import "bitbucket.org/dtolpin/infergo/ad"
+
+type Model float64
+
+type Point struct {
+	X, Y float64
+}
+
+func (m Model) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	var p Point
+	p = Point{X: 0, Y: 1}
+	ad.Assignment(&p.X, &x[0])
+	return ad.Return(&p.X)
+}`,
+		},
+		//====================================================
+		{`package float32
+
+import "math"
+
+type Model float32
+
+func sq(a float32) float32 {
+	return a * a
+}
+
+func (m Model) Observe(x []float32) float32 {
+	y := sq(x[0]) + float32(m)
+	z := float32(math.Exp(float64(y)))
+	var n float32 = 1.
+	return z + n
+}`,
+			//----------------------------------------------------
+			`package float32
+
+import (
+	"math"
+	"bitbucket.org/dtolpin/infergo/ad"
+)
+
+type Model float32
+
+func sq(a float32) float32 {
+	if ad.Called() {
+		ad.Enter32(&a)
+	} else {
+		ad.Setup(nil)
+		defer ad.Pop()
+	}
+	return ad.Return32(ad.Arithmetic32(ad.OpMul, &a, &a))
+}
+
+func (m Model) Observe(x []float32) float32 {
+	if ad.Called() {
+		ad.Enter32()
+	} else {
+		ad.Setup32(x)
+	}
+	var y float32
+	ad.Assignment32(&y, ad.Arithmetic32(ad.OpAdd, ad.Call32(func(_ []float32) {
+		sq(0)
+	}, 1, &x[0]), ad.Value32(float32(m))))
+	var z float32
+	ad.Assignment32(&z, ad.Narrow(ad.Elemental(math.Exp, ad.Widen(&y))))
+	var n float32
+	ad.Assignment32(&n, ad.Value32(1.))
+	return ad.Return32(ad.Arithmetic32(ad.OpAdd, &z, &n))
 }`,
 		},
 	} {
@@ -1326,6 +1685,270 @@ func (m Model) Observe(x []float64) float64 {
 	}
 }
 
+func TestRewriteForward(t *testing.T) {
+	Forward = true
+	defer func() { Forward = false }()
+	original := `package forward
+
+type Model float64
+
+func (m Model) Observe(x []float64) float64 {
+	return x[0] * x[1]
+}`
+	differentiated := `package forward
+
+import "bitbucket.org/dtolpin/infergo/ad"
+
+type Model float64
+
+func (m Model) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.SetupForward(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul, &x[0], &x[1]))
+}`
+	m, err := parseTestModel(map[string]string{
+		"original.go": original,
+	})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	err = m.check()
+	if err != nil {
+		t.Fatalf("failed to check %v: %s", m.pkg.Name, err)
+	}
+	err = m.deriv()
+	if err != nil {
+		t.Fatalf("failed to differentiate %v: %s", m.pkg.Name, err)
+	}
+	if !equiv(m.pkg.Files["original.go"], differentiated) {
+		b := new(bytes.Buffer)
+		printer.Fprint(b, m.fset, m.pkg.Files["original.go"])
+		t.Errorf("model %v:\n---\n%v\n---\n"+
+			" not equivalent to \n---\n%v\n---\n",
+			m.pkg.Name,
+			b.String(),
+			differentiated)
+	}
+}
+
+func TestRewriteExplicit(t *testing.T) {
+	Explicit = true
+	defer func() { Explicit = false }()
+	original := `package explicit
+
+import "bitbucket.org/dtolpin/infergo/ad"
+
+type Model struct {
+	tape *ad.Tape
+}
+
+func (m *Model) Tape() *ad.Tape {
+	return m.tape
+}
+
+func sq(a float64) float64 {
+	return a * a
+}
+
+// Cube is exported and keeps the signature.
+func Cube(a float64) float64 {
+	return a * sq(a)
+}
+
+func (_ *Model) Observe(x []float64) float64 {
+	return sq(x[0]) + Cube(x[1])
+}
+
+func count() int {
+	return int(sq(2) + Cube(2))
+}`
+	differentiated := `package explicit
+
+import "bitbucket.org/dtolpin/infergo/ad"
+
+type Model struct {
+	tape *ad.Tape
+}
+
+func (m *Model) Tape() *ad.Tape {
+	return m.tape
+}
+
+func sq(_tape *ad.Tape, a float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&a)
+	} else {
+		_tape.Setup(nil)
+		defer _tape.Pop()
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpMul, &a, &a))
+}
+
+func Cube(_arg0 float64) float64 {
+	return _Cube(ad.NewTape(), _arg0)
+}
+
+func _Cube(_tape *ad.Tape, a float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&a)
+	} else {
+		_tape.Setup(nil)
+		defer _tape.Pop()
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpMul, &a,
+		_tape.Call(func(_ []float64) {
+			sq(_tape, 0)
+		}, 1, &a)))
+}
+
+func (_m *Model) Observe(x []float64) float64 {
+	_tape := _m.Tape()
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpAdd,
+		_tape.Call(func(_ []float64) {
+			sq(_tape, 0)
+		}, 1, &x[0]),
+		_tape.Call(func(_ []float64) {
+			_Cube(_tape, 0)
+		}, 1, &x[1])))
+}
+
+func count() int {
+	return int(sq(ad.NewTape(), 2) + Cube(2))
+}`
+	m, err := parseTestModel(map[string]string{
+		"original.go": original,
+	})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	err = m.check()
+	if err != nil {
+		t.Fatalf("failed to check %v: %s", m.pkg.Name, err)
+	}
+	err = m.deriv()
+	if err != nil {
+		t.Fatalf("failed to differentiate %v: %s", m.pkg.Name, err)
+	}
+	if !equiv(m.pkg.Files["original.go"], differentiated) {
+		b := new(bytes.Buffer)
+		printer.Fprint(b, m.fset, m.pkg.Files["original.go"])
+		t.Errorf("model %v:\n---\n%v\n---\n"+
+			" not equivalent to \n---\n%v\n---\n",
+			m.pkg.Name,
+			b.String(),
+			differentiated)
+	}
+
+	// Methods of types without method Tape, in this or another
+	// package, get the tape as the first argument; calls into
+	// another package go to its explicit-tape variant.
+	original = `package foreign
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/dist"
+)
+
+type Model struct {
+	tape *ad.Tape
+}
+
+func (m *Model) Tape() *ad.Tape {
+	return m.tape
+}
+
+type Prior struct{}
+
+func (p Prior) Observe(x []float64) float64 {
+	return -x[0] * x[0]
+}
+
+func (m *Model) Observe(x []float64) float64 {
+	return Prior{}.Observe(x) + dist.Normal.Logp(0, 1, x[0])
+}
+
+func count(x []float64) int {
+	return int(Prior{}.Observe(x))
+}`
+	differentiated = `package foreign
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/dist/adx"
+)
+
+type Model struct {
+	tape *ad.Tape
+}
+
+func (m *Model) Tape() *ad.Tape {
+	return m.tape
+}
+
+type Prior struct{}
+
+func (p Prior) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpMul,
+		_tape.Arithmetic(ad.OpNeg, &x[0]), &x[0]))
+}
+
+func (m *Model) Observe(x []float64) float64 {
+	_tape := m.Tape()
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpAdd,
+		_tape.Call(func(_ []float64) {
+			Prior{}.Observe(_tape, x)
+		}, 0),
+		_tape.Call(func(_ []float64) {
+			dist.Normal.Logp(_tape, 0, 0, 0)
+		}, 3, _tape.Value(0), _tape.Value(1), &x[0])))
+}
+
+func count(x []float64) int {
+	return int(Prior{}.Observe(ad.NewTape(), x))
+}`
+	m, err = parseTestModel(map[string]string{
+		"original.go": original,
+	})
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	err = m.check()
+	if err != nil {
+		t.Fatalf("failed to check %v: %s", m.pkg.Name, err)
+	}
+	err = m.deriv()
+	if err != nil {
+		t.Fatalf("failed to differentiate %v: %s", m.pkg.Name, err)
+	}
+	if !equiv(m.pkg.Files["original.go"], differentiated) {
+		b := new(bytes.Buffer)
+		printer.Fprint(b, m.fset, m.pkg.Files["original.go"])
+		t.Errorf("model %v:\n---\n%v\n---\n"+
+			" not equivalent to \n---\n%v\n---\n",
+			m.pkg.Name,
+			b.String(),
+			differentiated)
+	}
+}
+
 func TestDerivErrors(t *testing.T) {
 	for _, c := range []struct {
 		erroneous string
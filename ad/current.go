@@ -0,0 +1,184 @@
+package ad
+
+// Operations on the tape of the current goroutine. Each
+// function calls the method of the same name of the tape
+// returned by the tape store; the methods are documented in
+// tape.go, tape32.go, forward.go and hessian.go.
+
+// Setup set ups the tape for the forward pass; see Tape.Setup.
+func Setup(x []float64) {
+	tapes.get().Setup(x)
+}
+
+// SetupForward sets up the tape for the forward pass computing
+// the gradient with dual numbers; see Tape.SetupForward.
+func SetupForward(x []float64) {
+	tapes.get().SetupForward(x)
+}
+
+// Setup32 set ups the tape for the forward pass of a float32
+// function; see Tape.Setup32.
+func Setup32(x []float32) {
+	tapes.get().Setup32(x)
+}
+
+// Value adds value v to the memory and returns the location of
+// the value; see Tape.Value.
+func Value(v float64) *float64 {
+	return tapes.get().Value(v)
+}
+
+// Value32 is Value for float32; see Tape.Value32.
+func Value32(v float32) *float32 {
+	return tapes.get().Value32(v)
+}
+
+// Return returns the result of the differentiated function; see
+// Tape.Return.
+func Return(px *float64) float64 {
+	return tapes.get().Return(px)
+}
+
+// Return32 is Return for float32; see Tape.Return32.
+func Return32(px *float32) float32 {
+	return tapes.get().Return32(px)
+}
+
+// Arithmetic encodes an arithmetic operation; see
+// Tape.Arithmetic.
+func Arithmetic(op int, px ...*float64) *float64 {
+	return tapes.get().Arithmetic(op, px...)
+}
+
+// Arithmetic32 is Arithmetic for float32; see Tape.Arithmetic32.
+func Arithmetic32(op int, px ...*float32) *float32 {
+	return tapes.get().Arithmetic32(op, px...)
+}
+
+// ParallelAssignment encodes a parallel assignment; see
+// Tape.ParallelAssignment.
+func ParallelAssignment(ppx ...*float64) {
+	tapes.get().ParallelAssignment(ppx...)
+}
+
+// ParallelAssignment32 is ParallelAssignment for float32; see
+// Tape.ParallelAssignment32.
+func ParallelAssignment32(ppx ...*float32) {
+	tapes.get().ParallelAssignment32(ppx...)
+}
+
+// Assignment encodes a single-value assignment; see
+// Tape.Assignment.
+func Assignment(p *float64, px *float64) {
+	tapes.get().Assignment(p, px)
+}
+
+// Assignment32 is Assignment for float32; see
+// Tape.Assignment32.
+func Assignment32(p *float32, px *float32) {
+	tapes.get().Assignment32(p, px)
+}
+
+// Elemental encodes a call to the elemental f; see
+// Tape.Elemental.
+func Elemental(f interface{}, px ...*float64) *float64 {
+	return tapes.get().Elemental(f, px...)
+}
+
+// Elemental32 encodes a call to the float32 elemental f; see
+// Tape.Elemental32.
+func Elemental32(f interface{}, px ...*float32) *float32 {
+	return tapes.get().Elemental32(f, px...)
+}
+
+// Vlemental encodes a call to the vector elemental f; see
+// Tape.Vlemental.
+func Vlemental(f func([]float64) float64, x []float64) *float64 {
+	return tapes.get().Vlemental(f, x)
+}
+
+// Widen encodes conversion of a float32 value to float64; see
+// Tape.Widen.
+func Widen(px *float32) *float64 {
+	return tapes.get().Widen(px)
+}
+
+// Narrow encodes conversion of a float64 value to float32; see
+// Tape.Narrow.
+func Narrow(px *float64) *float32 {
+	return tapes.get().Narrow(px)
+}
+
+// Called returns true iff the differentiated function was
+// called from another differentiated function; see
+// Tape.Called.
+func Called() bool {
+	return tapes.get().Called()
+}
+
+// Call wraps a call to a differentiated subfunction; see
+// Tape.Call.
+func Call(
+	f func(_vararg []float64),
+	narg int,
+	px ...*float64,
+) *float64 {
+	return tapes.get().Call(f, narg, px...)
+}
+
+// Call32 is Call for float32; see Tape.Call32.
+func Call32(
+	f func(_vararg []float32),
+	narg int,
+	px ...*float32,
+) *float32 {
+	return tapes.get().Call32(f, narg, px...)
+}
+
+// Enter copies the actual parameters to the formal parameters;
+// see Tape.Enter.
+func Enter(px ...*float64) {
+	tapes.get().Enter(px...)
+}
+
+// Enter32 is Enter for float32; see Tape.Enter32.
+func Enter32(px ...*float32) {
+	tapes.get().Enter32(px...)
+}
+
+// Gradient performs the backward pass on the tape and returns
+// the gradient; see Tape.Gradient.
+func Gradient() []float64 {
+	return tapes.get().Gradient()
+}
+
+// GradientInto is Gradient which stores the gradient in
+// partials; see Tape.GradientInto.
+func GradientInto(partials []float64) {
+	tapes.get().GradientInto(partials)
+}
+
+// Gradient32 returns the gradient of a float32 function; see
+// Tape.Gradient32.
+func Gradient32() []float32 {
+	return tapes.get().Gradient32()
+}
+
+// Hessian computes the Hessian of the differentiated function;
+// see Tape.Hessian.
+func Hessian() [][]float64 {
+	return tapes.get().Hessian()
+}
+
+// HessianVector computes the product of the Hessian of the
+// differentiated function and vector v; see
+// Tape.HessianVector.
+func HessianVector(v []float64) []float64 {
+	return tapes.get().HessianVector(v)
+}
+
+// Pop deallocates current tape fragment from the tape; see
+// Tape.Pop.
+func Pop() {
+	tapes.get().Pop()
+}
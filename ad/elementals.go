@@ -11,7 +11,24 @@ import (
 // may be ignored in the computation of the gradient.
 type ElementalGradientFunc func(value float64, params ...float64) []float64
 
-var elementals map[uintptr]ElementalGradientFunc
+// ElementalGradientIntoFunc is ElementalGradientFunc which
+// stores the partial gradients in grad, of the same length as
+// params, instead of allocating a new vector. Elementals with
+// gradients of this kind are differentiated without garbage.
+type ElementalGradientIntoFunc func(
+	grad []float64,
+	value float64,
+	params ...float64,
+)
+
+// gradients holds the gradient of an elemental, and the
+// non-allocating gradient if one is registered.
+type gradients struct {
+	g  ElementalGradientFunc
+	gi ElementalGradientIntoFunc
+}
+
+var elementals map[uintptr]gradients
 
 // fkey computes map key for a function.
 func fkey(f interface{}) uintptr {
@@ -21,7 +38,21 @@ func fkey(f interface{}) uintptr {
 // RegisterElemental registers the gradient for an elemental
 // function.
 func RegisterElemental(f interface{}, g ElementalGradientFunc) {
-	elementals[fkey(f)] = g
+	elementals[fkey(f)] = gradients{g: g}
+}
+
+// RegisterElementalInto registers the non-allocating gradient
+// for an elemental function. ElementalGradient returns an
+// allocating wrapper of the gradient.
+func RegisterElementalInto(f interface{}, g ElementalGradientIntoFunc) {
+	elementals[fkey(f)] = gradients{
+		g: func(value float64, params ...float64) []float64 {
+			grad := make([]float64, len(params))
+			g(grad, value, params...)
+			return grad
+		},
+		gi: g,
+	}
 }
 
 // ElementalGradient returns the gradient for a function.  If
@@ -29,19 +60,20 @@ func RegisterElemental(f interface{}, g ElementalGradientFunc) {
 // returned value is false. Intended to be called from the
 // backward pass of gradient computation. Exported for testing.
 func ElementalGradient(f interface{}) (ElementalGradientFunc, bool) {
-	g, ok := elementals[fkey(f)]
-	return g, ok
+	gs, ok := elementals[fkey(f)]
+	return gs.g, ok
 }
 
-// Elementals from the math package.
+// Elementals from the math package. The gradients are
+// non-allocating.
 func init() {
-	elementals = make(map[uintptr]ElementalGradientFunc)
-	RegisterElemental(math.Sqrt,
-		func(value float64, _ ...float64) []float64 {
-			return []float64{0.5 / value}
+	elementals = make(map[uintptr]gradients)
+	RegisterElementalInto(math.Sqrt,
+		func(grad []float64, value float64, _ ...float64) {
+			grad[0] = 0.5 / value
 		})
-	RegisterElemental(math.Abs,
-		func(value float64, params ...float64) []float64 {
+	RegisterElementalInto(math.Abs,
+		func(grad []float64, _ float64, params ...float64) {
 			deriv := 0.
 			switch {
 			case params[0] > 0:
@@ -49,49 +81,45 @@ func init() {
 			case params[0] < 0:
 				deriv = -1.
 			}
-			return []float64{deriv}
+			grad[0] = deriv
 		})
 
 	// Exponential and logarithmic
-	RegisterElemental(math.Exp,
-		func(value float64, _ ...float64) []float64 {
-			return []float64{value}
+	RegisterElementalInto(math.Exp,
+		func(grad []float64, value float64, _ ...float64) {
+			grad[0] = value
 		})
-	RegisterElemental(math.Log,
-		func(_ float64, params ...float64) []float64 {
-			return []float64{1 / params[0]}
+	RegisterElementalInto(math.Log,
+		func(grad []float64, _ float64, params ...float64) {
+			grad[0] = 1 / params[0]
 		})
-	RegisterElemental(math.Pow,
-		func(value float64, params ...float64) []float64 {
-			return []float64{
-				params[1] * value / params[0],
-				value * math.Log(params[0]),
-			}
+	RegisterElementalInto(math.Pow,
+		func(grad []float64, value float64, params ...float64) {
+			grad[0] = params[1] * value / params[0]
+			grad[1] = value * math.Log(params[0])
 		})
 
 	// Trigonometric
-	RegisterElemental(math.Sin,
-		func(_ float64, params ...float64) []float64 {
-			return []float64{math.Cos(params[0])}
+	RegisterElementalInto(math.Sin,
+		func(grad []float64, _ float64, params ...float64) {
+			grad[0] = math.Cos(params[0])
 		})
-	RegisterElemental(math.Cos,
-		func(_ float64, params ...float64) []float64 {
-			return []float64{-math.Sin(params[0])}
+	RegisterElementalInto(math.Cos,
+		func(grad []float64, _ float64, params ...float64) {
+			grad[0] = -math.Sin(params[0])
 		})
-	RegisterElemental(math.Tan,
-		func(value float64, _ ...float64) []float64 {
-			return []float64{1 + value*value}
+	RegisterElementalInto(math.Tan,
+		func(grad []float64, value float64, _ ...float64) {
+			grad[0] = 1 + value*value
 		})
 
 	// Error function
-	RegisterElemental(math.Erf,
-		func(_ float64, params ...float64) []float64 {
-			return []float64{
-				2 / math.SqrtPi * math.Exp(-params[0]*params[0])}
+	RegisterElementalInto(math.Erf,
+		func(grad []float64, _ float64, params ...float64) {
+			grad[0] = 2 / math.SqrtPi * math.Exp(-params[0]*params[0])
 		})
-	RegisterElemental(math.Erfc,
-		func(_ float64, params ...float64) []float64 {
-			return []float64{
-				-2 / math.SqrtPi * math.Exp(-params[0]*params[0])}
+	RegisterElementalInto(math.Erfc,
+		func(grad []float64, _ float64, params ...float64) {
+			grad[0] = -2 / math.SqrtPi * math.Exp(-params[0]*params[0])
 		})
 }
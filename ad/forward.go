@@ -0,0 +1,278 @@
+package ad
+
+// Forward mode differentiation with dual numbers
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// forward holds the tangents of a forward-mode frame. Instead of
+// recording instructions on the tape, the tangents are
+// propagated along with the values, and the gradient is
+// available as soon as the differentiated function returns.
+// Tangents are indexed by the slots of places on the tape. The
+// storage covers the slots up to the last slot with a non-zero
+// tangent; the tangents of the slots above are zero.
+type forward struct {
+	n        int       // number of independents
+	base     int       // first slot of the frame
+	tangents []float64 // tangents, by slot
+	args     []int     // tangent offsets of elemental arguments
+}
+
+// SetupForward sets up the tape for the forward pass computing
+// the gradient with dual numbers. The tangent of a place is a
+// vector of partial derivatives with respect to x.
+func (tape *Tape) SetupForward(x []float64) {
+	tape.push(len(x))
+	tape.register(x)
+	// Reuse a released forward state if there is one.
+	var f *forward
+	if len(tape.forwards) > 0 {
+		f = tape.forwards[len(tape.forwards)-1]
+		tape.forwards = tape.forwards[:len(tape.forwards)-1]
+	} else {
+		f = &forward{}
+	}
+	c := &tape.cstack[len(tape.cstack)-1]
+	f.n = len(x)
+	f.base = c.s
+	// Seed the tangents of the parameters.
+	for i := range x {
+		d := f.zero(tape.slots[c.p+1+i])
+		d[i] = 1
+	}
+	c.f = f
+}
+
+// release clears the forward state for reuse.
+func (f *forward) release() {
+	f.tangents = f.tangents[:0]
+	f.args = f.args[:0]
+}
+
+// offset returns the offset of the tangent of the place in
+// slot s, or -1 if the slot is above the storage and the
+// tangent is zero.
+func (f *forward) offset(s int) int {
+	if i := (s - f.base) * f.n; i < len(f.tangents) {
+		return i
+	}
+	return -1
+}
+
+// tangent returns the tangent at offset i, or nil if i is -1.
+func (f *forward) tangent(i int) []float64 {
+	if i < 0 {
+		return nil
+	}
+	return f.tangents[i : i+f.n]
+}
+
+// zero returns the zeroed tangent of the place in slot s,
+// extending the storage to cover the slot. Slices returned by
+// earlier calls to tangent or zero may be invalidated.
+func (f *forward) zero(s int) []float64 {
+	i := (s - f.base) * f.n
+	if i+f.n > len(f.tangents) {
+		// The storage is extended with zeros.
+		for len(f.tangents) != i+f.n {
+			f.tangents = append(f.tangents, 0)
+		}
+		return f.tangents[i:]
+	}
+	d := f.tangents[i : i+f.n]
+	for j := range d {
+		d[j] = 0
+	}
+	return d
+}
+
+// set sets the tangent of the place in slot s to the tangent of
+// the place in slot sx.
+func (f *forward) set(s, sx int) {
+	if s == sx {
+		return
+	}
+	ix := f.offset(sx)
+	if ix < 0 {
+		// The tangent becomes zero.
+		if i := f.offset(s); i >= 0 {
+			d := f.tangents[i : i+f.n]
+			for j := range d {
+				d[j] = 0
+			}
+		}
+		return
+	}
+	d := f.zero(s)
+	copy(d, f.tangent(ix))
+}
+
+// arithmetic runs an arithmetic operation in forward mode and
+// returns the location of the result; see Arithmetic.
+func (f *forward) arithmetic(tape *Tape, op int, px ...*float64) *float64 {
+	p, s := tape.value(0)
+	x, ix := *px[0], f.offset(tape.slot(px[0]))
+	y, iy := 0., -1
+	if len(px) == 2 {
+		y, iy = *px[1], f.offset(tape.slot(px[1]))
+	}
+	switch op {
+	case OpNeg:
+		*p = -x
+	case OpAdd:
+		*p = x + y
+	case OpSub:
+		*p = x - y
+	case OpMul:
+		*p = x * y
+	case OpDiv:
+		*p = x / y
+	default:
+		panic(fmt.Sprintf("bad opcode %v", op))
+	}
+	if ix < 0 && iy < 0 {
+		// The tangent of the result is zero.
+		return p
+	}
+	// The result is a fresh place, thus extending the storage
+	// does not affect tangents of the arguments.
+	d := f.zero(s)
+	dx, dy := f.tangent(ix), f.tangent(iy)
+	switch op {
+	case OpNeg: // -x; d/dx = -1
+		for i := range dx {
+			d[i] = -dx[i]
+		}
+	case OpAdd: // x + y; d/dx = 1; d/dy = 1
+		for i := range dx {
+			d[i] += dx[i]
+		}
+		for i := range dy {
+			d[i] += dy[i]
+		}
+	case OpSub: // x - y; d/dx = 1; d/dy = -1
+		for i := range dx {
+			d[i] += dx[i]
+		}
+		for i := range dy {
+			d[i] -= dy[i]
+		}
+	case OpMul: // x * y; d/dx = y; d/dy = x
+		for i := range dx {
+			d[i] += y * dx[i]
+		}
+		for i := range dy {
+			d[i] += x * dy[i]
+		}
+	case OpDiv: // x / y; d/dx = 1 / y; d/dy = - d/dx * p
+		for i := range dx {
+			d[i] += dx[i] / y
+		}
+		for i := range dy {
+			d[i] -= *p / y * dy[i]
+		}
+	}
+	return p
+}
+
+// parallelAssignment propagates the tangents through a
+// parallel assignment. Values and tangents of the right-hand
+// side are saved before any of the places is updated.
+func (f *forward) parallelAssignment(tape *Tape, ppx ...*float64) {
+	p, px := ppx[:len(ppx)/2], ppx[len(ppx)/2:]
+	// Save values in the tape memory.
+	v0 := len(tape.values)
+	for i := range px {
+		tape.values = append(tape.values, *px[i])
+	}
+	// Save tangents in temporary places.
+	_, s := tape.alloc(len(px))
+	for i := range px {
+		f.set(s+i, tape.slot(px[i]))
+	}
+	for i := range p {
+		*p[i] = tape.values[v0+i]
+		f.set(tape.slot(p[i]), s+i)
+	}
+}
+
+// elemental propagates the tangent through a call to an
+// elemental with gradients gs, the result is in place p with
+// slot s.
+func (f *forward) elemental(
+	tape *Tape,
+	gs gradients,
+	p *float64,
+	s int,
+	px ...*float64,
+) {
+	f.args = f.args[:0]
+	zero := true
+	for _, py := range px {
+		i := f.offset(tape.slot(py))
+		f.args = append(f.args, i)
+		if i >= 0 {
+			zero = false
+		}
+	}
+	if zero {
+		return
+	}
+	// Parameters are copied to tape.values, as on the
+	// backward pass.
+	v0 := len(tape.values)
+	for _, py := range px {
+		tape.values = append(tape.values, *py)
+	}
+	e := elemental{n: len(px), g: gs.g, gi: gs.gi}
+	grad := tape.elementalPartials(&e, *p, tape.values[v0:v0+len(px)])
+	d := f.zero(s)
+	for j, i := range f.args {
+		dy := f.tangent(i)
+		for k := range dy {
+			d[k] += grad[j] * dy[k]
+		}
+	}
+}
+
+// forwardElemental runs a call to the elemental f in forward
+// mode; see Elemental.
+func (tape *Tape) forwardElemental(
+	fw *forward,
+	f interface{},
+	gs gradients,
+	px ...*float64,
+) *float64 {
+	p, s := tape.value(0)
+	switch f := f.(type) {
+	case func(float64) float64:
+		*p = f(*px[0])
+	case func(float64, float64) float64:
+		*p = f(*px[0], *px[1])
+	default:
+		args := make([]reflect.Value, 0)
+		for _, py := range px {
+			args = append(args, reflect.ValueOf(*py))
+		}
+		*p = reflect.ValueOf(f).Call(args)[0].Float()
+	}
+	fw.elemental(tape, gs, p, s, px...)
+	return p
+}
+
+// gradient stores the tangent of the result, in slot s, in
+// partials.
+func (f *forward) gradient(partials []float64, s int) {
+	d := f.tangent(f.offset(s))
+	if d == nil {
+		// The result does not depend on the parameters.
+		for i := range partials {
+			partials[i] = 0
+		}
+		return
+	}
+	copy(partials, d)
+}
@@ -0,0 +1,342 @@
+package ad
+
+// Second-order differentiation: Hessian-vector products and
+// Hessians, by forward-over-reverse differentiation on the tape.
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// The tape is first rewound to the state before the call to the
+// differentiated function. Then, for each direction v, the
+// records are replayed forward, propagating the tangents of
+// places along v, and the adjoints and the tangents of the
+// adjoints are accumulated on the backward pass. The tangent of
+// the gradient is the Hessian-vector product.
+//
+// Second derivatives of elementals are not registered, and are
+// computed by central differences of the elemental gradients.
+// Arithmetic operations are differentiated exactly.
+
+// HessianVector computes the product of the Hessian of the
+// differentiated function and vector v. HessianVector should be
+// called, instead of Gradient, immediately after the call to
+// an automatically differentiated function. The tape frame is
+// popped.
+func (tape *Tape) HessianVector(v []float64) []float64 {
+	c := secondOrderFrame(tape)
+	if len(v) != c.n {
+		panic(fmt.Sprintf("wrong vector size: got %d, want %d",
+			len(v), c.n))
+	}
+	tape.rewind()
+	hv := tape.forwardOverReverse(v)
+	tape.Pop()
+	return hv
+}
+
+// Hessian computes the Hessian of the differentiated function.
+// Hessian should be called, instead of Gradient, immediately
+// after the call to an automatically differentiated function.
+// The tape frame is popped.
+func (tape *Tape) Hessian() [][]float64 {
+	c := secondOrderFrame(tape)
+	n := c.n
+	tape.rewind()
+	hessian := make([][]float64, n)
+	v := make([]float64, n)
+	for i := range hessian {
+		v[i] = 1
+		hessian[i] = tape.forwardOverReverse(v)
+		v[i] = 0
+	}
+	tape.Pop()
+	// Rounding errors and differences of elemental gradients
+	// may break the symmetry.
+	for i := 0; i != n; i++ {
+		for j := 0; j != i; j++ {
+			h := 0.5 * (hessian[i][j] + hessian[j][i])
+			hessian[i][j], hessian[j][i] = h, h
+		}
+	}
+	return hessian
+}
+
+// secondOrderFrame checks that the current frame was recorded
+// on the tape, in float64 only, and returns the frame counters.
+func secondOrderFrame(tape *Tape) *counters {
+	if len(tape.cstack) == 0 {
+		panic("Hessian() called with empty tape")
+	}
+	c := &tape.cstack[len(tape.cstack)-1]
+	if c.f != nil {
+		panic("Hessian() called on a forward-mode frame")
+	}
+	// float32 records are not replayed by forwardOverReverse;
+	// the frame is popped so that the tape stays usable if the
+	// panic is recovered.
+	for ir := c.r; ir != len(tape.records); ir++ {
+		switch tape.records[ir].typ {
+		case typAssignment32, typArithmetic32, typElemental32,
+			typWiden, typNarrow:
+			tape.Pop()
+			panic("float32 is not supported in second-order " +
+				"differentiation")
+		}
+	}
+	return c
+}
+
+// rewind restores the values of the places to the state before
+// the call to the differentiated function.
+func (tape *Tape) rewind() {
+	c := &tape.cstack[len(tape.cstack)-1]
+	for ir := len(tape.records); ir != c.r; {
+		ir--
+		r := &tape.records[ir]
+		if r.typ == typAssignment {
+			for i := 0; i != r.op; i++ {
+				*tape.places[r.p+i] = tape.values[r.v+i]
+			}
+		}
+	}
+}
+
+// forwardOverReverse replays the rewound tape propagating the
+// tangents along v, then runs the backward pass, and returns
+// the Hessian-vector product. The tape is left rewound.
+func (tape *Tape) forwardOverReverse(v []float64) []float64 {
+	c := &tape.cstack[len(tape.cstack)-1]
+
+	// Forward pass: tangents of the arguments are saved, by
+	// place, for the backward pass.
+	tangents := make([]float64, tape.nslots)
+	for i := 0; i != c.n; i++ {
+		tangents[tape.slots[c.p+i+1]] = v[i]
+	}
+	ts := make([]float64, len(tape.places))
+	for ir := c.r; ir != len(tape.records); ir++ {
+		r := &tape.records[ir]
+		switch r.typ {
+		case typDummy:
+		case typAssignment:
+			for i := 0; i != r.op; i++ {
+				tape.values[r.v+i] = *tape.places[r.p+i]
+				ts[r.p+r.op+i] = tangents[tape.slots[r.p+r.op+i]]
+			}
+			if r.op > 1 {
+				for i := 0; i != r.op; i++ {
+					tape.values[r.v+r.op+i] = *tape.places[r.p+r.op+i]
+				}
+				for i := 0; i != r.op; i++ {
+					*tape.places[r.p+i] = tape.values[r.v+r.op+i]
+				}
+			} else {
+				*tape.places[r.p] = *tape.places[r.p+1]
+			}
+			for i := 0; i != r.op; i++ {
+				tangents[tape.slots[r.p+i]] = ts[r.p+r.op+i]
+			}
+		case typArithmetic:
+			x := *tape.places[r.p+1]
+			dx := tangents[tape.slots[r.p+1]]
+			ts[r.p+1] = dx
+			var y, dy float64
+			if r.op != OpNeg {
+				y = *tape.places[r.p+2]
+				dy = tangents[tape.slots[r.p+2]]
+				ts[r.p+2] = dy
+			}
+			var d float64
+			switch r.op {
+			case OpNeg:
+				d = -dx
+			case OpAdd:
+				d = dx + dy
+			case OpSub:
+				d = dx - dy
+			case OpMul:
+				d = dx*y + x*dy
+			case OpDiv:
+				d = (dx - *tape.places[r.p]*dy) / y
+			default:
+				panic(fmt.Sprintf("bad opcode %v", r.op))
+			}
+			tangents[tape.slots[r.p]] = d
+		case typElemental:
+			e := &tape.elementals[r.op]
+			g := elementalGradient(e, *tape.places[r.p],
+				tape.values[r.v:r.v+e.n])
+			d := 0.
+			for i := 0; i != e.n; i++ {
+				dx := tangents[tape.slots[r.p+1+i]]
+				ts[r.p+1+i] = dx
+				d += g[i] * dx
+			}
+			tangents[tape.slots[r.p]] = d
+		default:
+			panic(fmt.Sprintf("bad type %v", r.typ))
+		}
+	}
+
+	// Backward pass: adjoints and their tangents.
+	adjoints := make([]float64, tape.nslots)
+	dadjoints := make([]float64, tape.nslots)
+	adjoints[tape.slots[c.p]] = 1
+	for ir := len(tape.records); ir != c.r; {
+		ir--
+		r := &tape.records[ir]
+		switch r.typ {
+		case typDummy:
+		case typAssignment:
+			// The left-hand side may be on the right-hand side,
+			// collect the adjoints first.
+			a := make([]float64, 2*r.op)
+			for i := 0; i != r.op; i++ {
+				*tape.places[r.p+i] = tape.values[r.v+i]
+				s := tape.slots[r.p+i]
+				a[i], a[r.op+i] = adjoints[s], dadjoints[s]
+				adjoints[s], dadjoints[s] = 0, 0
+			}
+			for i := 0; i != r.op; i++ {
+				s := tape.slots[r.p+r.op+i]
+				adjoints[s] += a[i]
+				dadjoints[s] += a[r.op+i]
+			}
+		case typArithmetic:
+			s := tape.slots[r.p]
+			a, da := adjoints[s], dadjoints[s]
+			px := tape.slots[r.p+1]
+			x, dx := *tape.places[r.p+1], ts[r.p+1]
+			var py int
+			var y, dy float64
+			if r.op != OpNeg {
+				py = tape.slots[r.p+2]
+				y, dy = *tape.places[r.p+2], ts[r.p+2]
+			}
+			switch r.op {
+			case OpNeg: // -x; d/dx = -1
+				adjoints[px] -= a
+				dadjoints[px] -= da
+			case OpAdd: // x + y; d/dx = 1; d/dy = 1
+				adjoints[px] += a
+				dadjoints[px] += da
+				adjoints[py] += a
+				dadjoints[py] += da
+			case OpSub: // x - y; d/dx = 1; d/dy = -1
+				adjoints[px] += a
+				dadjoints[px] += da
+				adjoints[py] -= a
+				dadjoints[py] -= da
+			case OpMul: // x * y; d/dx = y; d/dy = x
+				adjoints[px] += a * y
+				dadjoints[px] += da*y + a*dy
+				adjoints[py] += a * x
+				dadjoints[py] += da*x + a*dx
+			case OpDiv: // x / y; d/dx = 1 / y; d/dy = - x / y^2
+				adjoints[px] += a / y
+				dadjoints[px] += da/y - a*dy/(y*y)
+				adjoints[py] -= a * x / (y * y)
+				dadjoints[py] -= da*x/(y*y) +
+					a*(dx/(y*y)-2*x*dy/(y*y*y))
+			default:
+				panic(fmt.Sprintf("bad opcode %v", r.op))
+			}
+		case typElemental:
+			s := tape.slots[r.p]
+			a, da := adjoints[s], dadjoints[s]
+			e := &tape.elementals[r.op]
+			x := tape.values[r.v : r.v+e.n]
+			dx := make([]float64, e.n)
+			for i := range dx {
+				dx[i] = ts[r.p+1+i]
+			}
+			g := elementalGradient(e, *tape.places[r.p], x)
+			dg := elementalHessianVector(e, x, dx)
+			for i := 0; i != e.n; i++ {
+				py := tape.slots[r.p+1+i]
+				adjoints[py] += a * g[i]
+				dadjoints[py] += da*g[i] + a*dg[i]
+			}
+		default:
+			panic(fmt.Sprintf("bad type %v", r.typ))
+		}
+	}
+
+	hv := make([]float64, c.n)
+	for i := 0; i != c.n; i++ {
+		hv[i] = dadjoints[tape.slots[c.p+i+1]]
+	}
+	return hv
+}
+
+// elementalGradient computes the gradient of an elemental at x,
+// with function value value.
+func elementalGradient(
+	e *elemental,
+	value float64,
+	x []float64,
+) []float64 {
+	g := e.g(value, x...)
+	if len(g) != e.n {
+		panic(fmt.Sprintf(
+			"wrong gradient size: got %d, want %d",
+			len(g), e.n))
+	}
+	return g
+}
+
+// elementalHessianVector computes the product of the Hessian of
+// an elemental at x and vector dx, by central differences of the
+// gradient.
+func elementalHessianVector(e *elemental, x, dx []float64) []float64 {
+	dg := make([]float64, e.n)
+	scale, norm := 1., 0.
+	for i := range x {
+		scale = math.Max(scale, math.Abs(x[i]))
+		norm = math.Max(norm, math.Abs(dx[i]))
+	}
+	if norm == 0 {
+		return dg
+	}
+	// The step balances the truncation and the rounding
+	// errors of the central difference.
+	h := math.Cbrt(epsilon) * scale / norm
+	xh := make([]float64, e.n)
+	for i := range xh {
+		xh[i] = x[i] + h*dx[i]
+	}
+	gp := elementalGradient(e, callElemental(e.f, xh), xh)
+	gp = append([]float64(nil), gp...)
+	for i := range xh {
+		xh[i] = x[i] - h*dx[i]
+	}
+	gm := elementalGradient(e, callElemental(e.f, xh), xh)
+	for i := range dg {
+		dg[i] = (gp[i] - gm[i]) / (2 * h)
+	}
+	return dg
+}
+
+// epsilon is the machine epsilon of float64.
+const epsilon = 0x1p-52
+
+// callElemental calls elemental f on arguments x.
+func callElemental(f interface{}, x []float64) float64 {
+	switch f := f.(type) {
+	case func(float64) float64:
+		return f(x[0])
+	case func(float64, float64) float64:
+		return f(x[0], x[1])
+	case func([]float64) float64:
+		return f(x)
+	default:
+		args := make([]reflect.Value, 0, len(x))
+		for _, y := range x {
+			args = append(args, reflect.ValueOf(y))
+		}
+		return reflect.ValueOf(f).Call(args)[0].Float()
+	}
+}
@@ -0,0 +1,161 @@
+package ad
+
+import (
+	"math"
+	"testing"
+)
+
+// d2dx computes the Hessian and the Hessian-vector product
+// with a vector of ones.
+func d2dx(x []float64, f func(x []float64)) ([][]float64, []float64) {
+	x0 := make([]float64, len(x))
+	copy(x0, x)
+	Setup(x)
+	f(x)
+	h := Hessian()
+	v := make([]float64, len(x))
+	for i := range v {
+		v[i] = 1
+	}
+	Setup(x0)
+	f(x0)
+	hv := HessianVector(v)
+	return h, hv
+}
+
+type hessiancase struct {
+	s string
+	f func(x []float64)
+	x []float64
+	h [][]float64
+}
+
+func TestHessian(t *testing.T) {
+	e := math.E
+	for _, c := range []hessiancase{
+		{"x * y",
+			func(x []float64) {
+				Return(Arithmetic(OpMul, &x[0], &x[1]))
+			},
+			[]float64{1, 2},
+			[][]float64{{0, 1}, {1, 0}}},
+		{"x * x * x",
+			func(x []float64) {
+				Return(Arithmetic(OpMul,
+					Arithmetic(OpMul, &x[0], &x[0]),
+					&x[0]))
+			},
+			[]float64{2},
+			[][]float64{{12}}},
+		{"y = x; y = y * y; -y",
+			func(x []float64) {
+				var y float64
+				Assignment(&y, &x[0])
+				Assignment(&y, Arithmetic(OpMul, &y, &y))
+				Return(Arithmetic(OpNeg, &y))
+			},
+			[]float64{3},
+			[][]float64{{-2}}},
+		{"x / y",
+			func(x []float64) {
+				Return(Arithmetic(OpDiv, &x[0], &x[1]))
+			},
+			[]float64{1, 2},
+			[][]float64{{0, -0.25}, {-0.25, 0.25}}},
+		{"x, y = y, x; x * x * y",
+			func(x []float64) {
+				ParallelAssignment(&x[0], &x[1], &x[1], &x[0])
+				Return(Arithmetic(OpMul,
+					Arithmetic(OpMul, &x[0], &x[0]),
+					&x[1]))
+			},
+			[]float64{1, 2},
+			[][]float64{{0, 4}, {4, 2}}},
+		{"exp(x * y)",
+			func(x []float64) {
+				Return(Elemental(math.Exp,
+					Arithmetic(OpMul, &x[0], &x[1])))
+			},
+			[]float64{1, 1},
+			[][]float64{{e, 2 * e}, {2 * e, e}}},
+		{"vlemental(x, y) - x * y",
+			func(x []float64) {
+				Return(Arithmetic(OpSub,
+					Vlemental(vlemental, x),
+					Arithmetic(OpMul, &x[0], &x[1])))
+			},
+			[]float64{1, 2},
+			[][]float64{{0, 0}, {0, 0}}},
+		{"(x -> x * x)(x) + y",
+			func(x []float64) {
+				Return(Arithmetic(OpAdd,
+					Call(func(_vararg []float64) {
+						func(a float64) float64 {
+							Enter(&a)
+							return Return(Arithmetic(OpMul, &a, &a))
+						}(0)
+					}, 1, &x[0]),
+					&x[1]))
+			},
+			[]float64{3, 1},
+			[][]float64{{2, 0}, {0, 0}}},
+	} {
+		h, hv := d2dx(c.x, c.f)
+		for i := range c.h {
+			hvi := 0.
+			for j := range c.h[i] {
+				if math.Abs(h[i][j]-c.h[i][j]) > 1e-6 {
+					t.Errorf("%s, x=%v: h=%v, wanted h=%v",
+						c.s, c.x, h, c.h)
+				}
+				hvi += c.h[i][j]
+			}
+			if math.Abs(hv[i]-hvi) > 1e-6 {
+				t.Errorf("%s, x=%v: hv=%v, wanted hv[%d]=%v",
+					c.s, c.x, hv, i, hvi)
+			}
+		}
+	}
+}
+
+// The tape must be popped after the Hessian is computed.
+func TestHessianPop(t *testing.T) {
+	tape := tapes.get()
+	lr := len(tape.records)
+	lp := len(tape.places)
+	lc := len(tape.cstack)
+	x := []float64{1, 2}
+	Setup(x)
+	Assignment(&x[0], Arithmetic(OpMul, &x[0], &x[1]))
+	Return(&x[0])
+	Hessian()
+	if lr != len(tape.records) || lp != len(tape.places) ||
+		lc != len(tape.cstack) {
+		t.Errorf("tape not popped")
+	}
+	if x[0] != 1 {
+		t.Errorf("wrong value after Hessian: got %v, want 1", x[0])
+	}
+}
+
+// float32 records cannot be differentiated twice; the frame is
+// popped before the panic.
+func TestHessianFloat32(t *testing.T) {
+	tape := tapes.get()
+	lc := len(tape.cstack)
+	x := []float64{1, 2}
+	Setup(x)
+	y := Narrow(&x[0])
+	Assignment(&x[0], Arithmetic(OpMul, Widen(y), &x[1]))
+	Return(&x[0])
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Errorf("Hessian of a float32 function did not panic")
+		}
+		if lc != len(tape.cstack) {
+			t.Errorf("tape not popped")
+		}
+	}()
+	Hessian()
+}
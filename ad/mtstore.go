@@ -41,7 +41,8 @@ var warnedNoMT = false
 // MTSafeOn enables multithreading support on some versions and
 // architectures only. The caller should check the return value
 // (true if succeeded) or call IsMTSafe if the code depends on
-// the tape being thread-safe.
+// the tape being thread-safe. Explicit tapes (see Explicit)
+// are an alternative which does not depend on the Go runtime.
 func MTSafeOn() bool {
 	if atleast(runtime.Version(), 1, 9, 0) {
 		switch runtime.GOARCH {
@@ -75,14 +76,14 @@ func MTSafeOn() bool {
 	return mtSafe
 }
 
-func (tapes *mtStore) get() *adTape {
+func (tapes *mtStore) get() *Tape {
 	id := goid()
 	tape, ok := tapes.Load(id)
 	if !ok {
 		tape = newTape()
 		tapes.Store(id, tape)
 	}
-	return tape.(*adTape)
+	return tape.(*Tape)
 }
 
 func (tapes *mtStore) drop() {
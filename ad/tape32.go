@@ -0,0 +1,355 @@
+package ad
+
+// float32 tape operations. A float32 model uses the same tape
+// as a float64 model, but float32 places and values are stored
+// separately. The adjoints are float64 for all places.
+// Conversions between float32 and float64 are recorded, and
+// derivatives propagate through them. Forward-mode and
+// second-order differentiation are not supported for float32.
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// reverse32 panics if the current frame is differentiated in
+// forward mode.
+func (tape *Tape) reverse32() {
+	if tape.forward() != nil {
+		panic("float32 is not supported in forward mode")
+	}
+}
+
+// Setup32 set ups the tape for the forward pass of a float32
+// function.
+func (tape *Tape) Setup32(x []float32) {
+	tape.push(len(x))
+	tape.register32(x)
+}
+
+// slot32 returns the slot of float32 location p in the current
+// frame, allocating a new slot if the location was not
+// recorded yet.
+func (tape *Tape) slot32(p *float32) int {
+	bottom := tape.bottom
+	s, ok := tape.index32[p]
+	if ok && s >= bottom {
+		return s
+	}
+	shadow := -1
+	if ok {
+		shadow = s
+	}
+	s = tape.nslots
+	tape.nslots++
+	tape.owners = append(tape.owners, owner{p32: p, shadow: shadow})
+	tape.index32[p] = s
+	return s
+}
+
+// place32 appends float32 location p to the places.
+func (tape *Tape) place32(p *float32) {
+	tape.places32 = append(tape.places32, p)
+	tape.slots32 = append(tape.slots32, tape.slot32(p))
+}
+
+// register32 stores locations of float32 function parameters
+// at the beginning of the current frame's float32 places.
+func (tape *Tape) register32(x []float32) {
+	for i := range x {
+		tape.place32(&x[i])
+	}
+}
+
+// Value32 adds float32 value v to the memory and returns the
+// location of the value.
+func (tape *Tape) Value32(v float32) *float32 {
+	tape.values32 = append(tape.values32, v)
+	return &tape.values32[len(tape.values32)-1]
+}
+
+// Return32 returns the result of the differentiated float32
+// function.
+func (tape *Tape) Return32(px *float32) float32 {
+	// The returned value goes into the first place.
+	c := &tape.cstack[len(tape.cstack)-1]
+	tape.places32[c.p32] = px
+	tape.slots32[c.p32] = tape.slot32(px)
+	return *px
+}
+
+// Arithmetic32 encodes a float32 arithmetic operation and
+// returns the location of the result.
+func (tape *Tape) Arithmetic32(op int, px ...*float32) *float32 {
+	tape.reverse32()
+	p := tape.Value32(0)
+	r := record{
+		typ: typArithmetic32,
+		op:  op,
+		p:   len(tape.places32),
+	}
+	tape.place32(p)
+	for _, py := range px {
+		tape.place32(py)
+	}
+	tape.records = append(tape.records, r)
+	switch op {
+	case OpNeg:
+		*p = -*px[0]
+	case OpAdd:
+		*p = *px[0] + *px[1]
+	case OpSub:
+		*p = *px[0] - *px[1]
+	case OpMul:
+		*p = *px[0] * *px[1]
+	case OpDiv:
+		*p = *px[0] / *px[1]
+	default:
+		panic(fmt.Sprintf("bad opcode %v", r.op))
+	}
+	return p
+}
+
+// ParallelAssignment32 encodes a parallel float32 assignment.
+func (tape *Tape) ParallelAssignment32(ppx ...*float32) {
+	tape.reverse32()
+	p, px := ppx[:len(ppx)/2], ppx[len(ppx)/2:]
+	r := record{
+		typ: typAssignment32,
+		op:  len(p),
+		p:   len(tape.places32),
+		v:   len(tape.values32),
+	}
+	for i := range p {
+		tape.place32(p[i])
+		tape.values32 = append(tape.values32, *p[i])
+	}
+	for i := range px {
+		tape.place32(px[i])
+		tape.values32 = append(tape.values32, *px[i])
+	}
+	tape.records = append(tape.records, r)
+	for i := range p {
+		*p[i] = tape.values32[len(tape.values32)-len(p)+i]
+	}
+}
+
+// Assignment32 encodes a single-value float32 assignment.
+func (tape *Tape) Assignment32(p *float32, px *float32) {
+	tape.reverse32()
+	r := record{
+		typ: typAssignment32,
+		op:  1,
+		p:   len(tape.places32),
+		v:   len(tape.values32),
+	}
+	tape.place32(p)
+	tape.place32(px)
+	tape.values32 = append(tape.values32, *p)
+	tape.records = append(tape.records, r)
+	*p = *px
+}
+
+// Elemental32 encodes a call to the float32 elemental f. The
+// gradient of f is registered as for float64 elementals, and
+// argument values are copied to the float64 tape memory.
+func (tape *Tape) Elemental32(f interface{}, px ...*float32) *float32 {
+	tape.reverse32()
+	gs, ok := elementals[fkey(f)]
+	if !ok {
+		// No gradient attached, thus not an elemental.
+		panic("not an elemental")
+	}
+	p := tape.Value32(0)
+	r := record{
+		typ: typElemental32,
+		op:  len(tape.elementals),
+		p:   len(tape.places32),
+		v:   len(tape.values),
+	}
+	e := elemental{
+		n:  len(px),
+		f:  f,
+		g:  gs.g,
+		gi: gs.gi,
+	}
+	tape.place32(p)
+	for _, py := range px {
+		tape.place32(py)
+		tape.values = append(tape.values, float64(*py))
+	}
+	tape.elementals = append(tape.elementals, e)
+	tape.records = append(tape.records, r)
+	switch f := f.(type) {
+	case func(float32) float32:
+		*p = f(*px[0])
+	case func(float32, float32) float32:
+		*p = f(*px[0], *px[1])
+	default:
+		args := make([]reflect.Value, 0)
+		for _, py := range px {
+			args = append(args, reflect.ValueOf(*py))
+		}
+		*p = float32(reflect.ValueOf(f).Call(args)[0].Float())
+	}
+	return p
+}
+
+// Widen encodes conversion of a float32 value to float64 and
+// returns the location of the result.
+func (tape *Tape) Widen(px *float32) *float64 {
+	p := tape.Value(float64(*px))
+	if f := tape.forward(); f != nil {
+		// Tangents of float32 places are zero.
+		return p
+	}
+	r := record{
+		typ: typWiden,
+		p:   len(tape.places),
+		v:   len(tape.places32),
+	}
+	tape.place(p)
+	tape.place32(px)
+	tape.records = append(tape.records, r)
+	return p
+}
+
+// Narrow encodes conversion of a float64 value to float32 and
+// returns the location of the result.
+func (tape *Tape) Narrow(px *float64) *float32 {
+	tape.reverse32()
+	p := tape.Value32(float32(*px))
+	r := record{
+		typ: typNarrow,
+		p:   len(tape.places32),
+		v:   len(tape.places),
+	}
+	tape.place32(p)
+	tape.place(px)
+	tape.records = append(tape.records, r)
+	return p
+}
+
+// Call32 wraps a call to a differentiated float32 subfunction.
+// narg is the number of non-variadic arguments.
+func (tape *Tape) Call32(
+	f func(_vararg []float32),
+	narg int,
+	px ...*float32,
+) *float32 {
+	var vararg []float32
+	if narg < len(px) {
+		vararg = tape.variadic32(px[narg:])
+	}
+	for _, py := range px[:narg] {
+		tape.place32(py)
+	}
+	icall := len(tape.records)
+	tape.records = append(tape.records, record{typ: typCall})
+	f(vararg)
+	tape.records[icall].typ = typDummy
+	c := &tape.cstack[len(tape.cstack)-1]
+	return tape.places32[c.p32]
+}
+
+// variadic32 wraps variadic float32 arguments into a slice for
+// passing to the underlying call.
+func (tape *Tape) variadic32(px []*float32) []float32 {
+	var sides []*float32
+	v0 := len(tape.values32)
+	for range px { // left-hand side
+		sides = append(sides, tape.Value32(0))
+	}
+	vararg := tape.values32[v0:]
+	sides = append(sides, px...)
+	tape.ParallelAssignment32(sides...)
+	return vararg
+}
+
+// Enter32 copies the actual float32 parameters to the formal
+// parameters.
+func (tape *Tape) Enter32(px ...*float32) {
+	p0 := len(tape.places32) - len(px)
+	tape.ParallelAssignment32(
+		append(px, tape.places32[p0:p0+len(px)]...)...)
+}
+
+// Gradient32 performs the backward pass on the tape and
+// returns the gradient of a float32 function. See Gradient.
+func (tape *Tape) Gradient32() []float32 {
+	if len(tape.cstack) == 0 {
+		panic("Gradient32() called with empty tape")
+	}
+	tape.reverse32()
+	c := &tape.cstack[len(tape.cstack)-1]
+	adjoints := tape.sweep(tape.slots32[c.p32])
+	partials := make([]float32, c.n)
+	for i := 0; i != c.n; i++ {
+		partials[i] = float32(adjoints[tape.slots32[c.p32+i+1]])
+	}
+	tape.Pop()
+	return partials
+}
+
+// backward32 runs the backward pass on a float32 record.
+func (tape *Tape) backward32(r *record, adjoints []float64) {
+	switch r.typ {
+	case typAssignment32:
+		for i := 0; i != r.op; i++ {
+			*tape.places32[r.p+i] = tape.values32[r.v+i]
+		}
+		// The left-hand side may be on the right-hand side;
+		// save the adjoints first. Adjoints are float64 and
+		// cannot be saved in the float32 values.
+		var buf [4]float64
+		a := buf[:]
+		if r.op > len(buf) {
+			a = make([]float64, r.op)
+		}
+		for i := 0; i != r.op; i++ {
+			a[i] = adjoints[tape.slots32[r.p+i]]
+		}
+		for i := 0; i != r.op; i++ {
+			adjoints[tape.slots32[r.p+i]] = 0
+		}
+		for i := 0; i != r.op; i++ {
+			adjoints[tape.slots32[r.p+r.op+i]] += a[i]
+		}
+	case typArithmetic32:
+		a := adjoints[tape.slots32[r.p]]
+		switch r.op {
+		case OpNeg: // -x; d/dx = -1
+			adjoints[tape.slots32[r.p+1]] -= a
+		case OpAdd: // x + y; d/dx = 1; d/dy = 1
+			adjoints[tape.slots32[r.p+1]] += a
+			adjoints[tape.slots32[r.p+2]] += a
+		case OpSub: // x - y; d/dx = 1; d/dy = -1
+			adjoints[tape.slots32[r.p+1]] += a
+			adjoints[tape.slots32[r.p+2]] -= a
+		case OpMul: // x * y; d/dx = y; d/dy = x
+			ax := a * float64(*tape.places32[r.p+2])
+			ay := a * float64(*tape.places32[r.p+1])
+			adjoints[tape.slots32[r.p+1]] += ax
+			adjoints[tape.slots32[r.p+2]] += ay
+		case OpDiv: // x / y; d/dx = 1 / y; d/dy = - d/dx * p
+			ax := a / float64(*tape.places32[r.p+2])
+			ay := -ax * float64(*tape.places32[r.p])
+			adjoints[tape.slots32[r.p+1]] += ax
+			adjoints[tape.slots32[r.p+2]] += ay
+		default:
+			panic(fmt.Sprintf("bad opcode %v", r.op))
+		}
+	case typElemental32:
+		a := adjoints[tape.slots32[r.p]]
+		e := &tape.elementals[r.op]
+		d := tape.elementalPartials(e, float64(*tape.places32[r.p]),
+			tape.values[r.v:r.v+e.n])
+		for i := 0; i != e.n; i++ {
+			adjoints[tape.slots32[r.p+1+i]] += a * d[i]
+		}
+	case typWiden:
+		adjoints[tape.slots32[r.v]] += adjoints[tape.slots[r.p]]
+	case typNarrow:
+		adjoints[tape.slots[r.v]] += adjoints[tape.slots32[r.p]]
+	}
+}
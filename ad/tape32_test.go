@@ -0,0 +1,161 @@
+package ad
+
+// Testing float32 operations on the tape
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ddx32 differentiates the float32 function passed in
+// and returns the gradient.
+func ddx32(x []float32, f func(x []float32)) []float32 {
+	Setup32(x)
+	f(x)
+	return Gradient32()
+}
+
+// testcase32 is testcase for float32 functions.
+type testcase32 struct {
+	s string
+	f func(x []float32)
+	v [][][]float32
+}
+
+// runsuite32 evaluates a sequence of float32 test cases.
+func runsuite32(t *testing.T, suite []testcase32) {
+	for _, c := range suite {
+		for _, v := range c.v {
+			x := make([]float32, len(v[0]))
+			copy(x, v[0])
+			g := ddx32(x, c.f)
+			if !reflect.DeepEqual(g, v[1]) {
+				t.Errorf("%s, x=%v: g=%v, wanted g=%v",
+					c.s, v[0], g, v[1])
+			}
+		}
+	}
+}
+
+// elemental to check float32 elementals
+func prod32(a, b float32) float32 {
+	return a * b
+}
+
+func init() {
+	RegisterElemental(prod32,
+		func(v float64, a ...float64) []float64 {
+			return []float64{a[1], a[0]}
+		})
+}
+
+func TestFloat32(t *testing.T) {
+	runsuite32(t, []testcase32{
+		{"x",
+			func(x []float32) {
+				Return32(&x[0])
+			},
+			[][][]float32{
+				{{0}, {1}},
+				{{1}, {1}}}},
+		{"-x * y",
+			func(x []float32) {
+				Return32(Arithmetic32(OpMul,
+					Arithmetic32(OpNeg, &x[0]), &x[1]))
+			},
+			[][][]float32{
+				{{1, 2}, {-2, -1}},
+				{{3, 1}, {-1, -3}}}},
+		{"x / y - x",
+			func(x []float32) {
+				Return32(Arithmetic32(OpSub,
+					Arithmetic32(OpDiv, &x[0], &x[1]), &x[0]))
+			},
+			[][][]float32{
+				{{1, 2}, {-0.5, -0.25}},
+				{{2, 4}, {-0.75, -0.125}}}},
+		{"x, y = y, x; x + 2 * y",
+			func(x []float32) {
+				ParallelAssignment32(&x[0], &x[1], &x[1], &x[0])
+				Return32(Arithmetic32(OpAdd, &x[0],
+					Arithmetic32(OpMul, Value32(2), &x[1])))
+			},
+			[][][]float32{
+				{{1, 2}, {2, 1}}}},
+		{"z = x; z = z * z",
+			func(x []float32) {
+				var z float32
+				Assignment32(&z, &x[0])
+				Assignment32(&z, Arithmetic32(OpMul, &z, &z))
+				Return32(&z)
+			},
+			[][][]float32{
+				{{1}, {2}},
+				{{3}, {6}}}},
+		{"prod32(x, y)",
+			func(x []float32) {
+				Return32(Elemental32(prod32, &x[0], &x[1]))
+			},
+			[][][]float32{
+				{{1, 2}, {2, 1}}}},
+		{"(x -> x * x)(x)",
+			func(x []float32) {
+				Return32(
+					Call32(func(_vararg []float32) {
+						func(a float32) float32 {
+							Enter32(&a)
+							return Return32(Arithmetic32(OpMul, &a, &a))
+						}(0)
+					}, 1, &x[0]))
+			},
+			[][][]float32{
+				{{1}, {2}},
+				{{2}, {4}}}},
+	})
+}
+
+// Conversions between float32 and float64 propagate the
+// derivatives in both directions.
+func TestConversion(t *testing.T) {
+	runsuite32(t, []testcase32{
+		{"float32(float64(x) * float64(x))",
+			func(x []float32) {
+				y := Widen(&x[0])
+				Return32(Narrow(Arithmetic(OpMul, y, y)))
+			},
+			[][][]float32{
+				{{1}, {2}},
+				{{3}, {6}}}},
+	})
+	// Not in runsuite, float32 is not supported in forward
+	// mode.
+	g := ddx([]float64{1, 2}, func(x []float64) {
+		Return(Arithmetic(OpMul, Widen(Narrow(&x[0])), &x[1]))
+	})
+	if !reflect.DeepEqual(g, []float64{2, 1}) {
+		t.Errorf("float64(float32(x)) * y: g=%v, wanted g=%v",
+			g, []float64{2, 1})
+	}
+}
+
+// Mixed-precision frames are popped like float64 frames.
+func TestPop32(t *testing.T) {
+	tape := tapes.get()
+	lr := len(tape.records)
+	lp := len(tape.places)
+	lp32 := len(tape.places32)
+	lv32 := len(tape.values32)
+	lc := len(tape.cstack)
+	ddx32([]float32{1, 2}, func(x []float32) {
+		Return32(Narrow(Arithmetic(OpAdd,
+			Widen(&x[0]), Widen(&x[1]))))
+	})
+	if lr != len(tape.records) || lp != len(tape.places) ||
+		lp32 != len(tape.places32) || lv32 != len(tape.values32) ||
+		lc != len(tape.cstack) {
+		t.Errorf("tape not popped")
+	}
+	if len(tape.index32) != 0 {
+		t.Errorf("float32 index not cleared")
+	}
+}
@@ -3,6 +3,7 @@ package ad
 // Testing the tape
 
 import (
+	"fmt"
 	"math"
 	"reflect"
 	"testing"
@@ -16,6 +17,12 @@ func ddx(x []float64, f func(x []float64)) []float64 {
 	return Gradient()
 }
 
+func ddxForward(x []float64, f func(x []float64)) []float64 {
+	SetupForward(x)
+	f(x)
+	return Gradient()
+}
+
 // Tape management
 
 // When we pop we must return to where we were before
@@ -31,6 +38,139 @@ func TestPop(t *testing.T) {
 	shouldPop(t, []float64{0, 1}, func(x []float64) {
 		Assignment(&x[1], Arithmetic(OpAdd, &x[0], &x[1]))
 	})
+	// Forward mode
+	ddxForward([]float64{1}, func(x []float64) {
+		Assignment(&x[0], Value(1))
+	})
+	shouldPop(t, []float64{0, 1}, func(x []float64) {
+		Assignment(&x[1], Arithmetic(OpAdd, &x[0], &x[1]))
+	})
+	tape := tapes.get()
+	if len(tape.forwards) != 1 {
+		t.Errorf("forward state not released")
+	}
+}
+
+// Tangent storage does not grow with every reassignment of a
+// place whose tangent becomes zero.
+func TestForwardSlots(t *testing.T) {
+	var y float64
+	var ntangents []int
+	ddxForward([]float64{1, 2}, func(x []float64) {
+		f := tapes.get().cstack[len(tapes.get().cstack)-1].f
+		for i := 0; i != 100; i++ {
+			Assignment(&y, Value(0))
+			Assignment(&y, &x[0])
+			ntangents = append(ntangents, len(f.tangents))
+		}
+	})
+	// The tangent storage covers the slot of y, allocated once.
+	for i := range ntangents {
+		if ntangents[i] != ntangents[0] {
+			t.Errorf("tangent storage grows: got %d, want %d",
+				ntangents[i], ntangents[0])
+			break
+		}
+	}
+}
+
+// Locations recorded in an outer frame are shadowed in a nested
+// frame and restored when the nested frame is popped.
+func TestShadow(t *testing.T) {
+	x := []float64{2, 3}
+	Setup(x)
+	y := Arithmetic(OpMul, &x[0], &x[1])
+	g := ddx(x, func(x []float64) {
+		Return(Arithmetic(OpMul, &x[0], &x[0]))
+	})
+	if !reflect.DeepEqual(g, []float64{4, 0}) {
+		t.Errorf("nested: g=%v, wanted g=%v", g, []float64{4, 0})
+	}
+	Return(Arithmetic(OpAdd, y, &x[1]))
+	g = Gradient()
+	if !reflect.DeepEqual(g, []float64{3, 3}) {
+		t.Errorf("outer: g=%v, wanted g=%v", g, []float64{3, 3})
+	}
+}
+
+// Cells and parameters of an outer frame referenced in a nested
+// frame get new slots there, and their slots are restored when
+// the nested frame is popped.
+func TestShadowBlocks(t *testing.T) {
+	x := []float64{2, 3}
+	Setup(x)
+	y := Arithmetic(OpMul, &x[0], &x[1])
+	g := ddx([]float64{5}, func(z []float64) {
+		Return(Arithmetic(OpMul, Arithmetic(OpMul, y, &x[1]), &z[0]))
+	})
+	if !reflect.DeepEqual(g, []float64{18}) {
+		t.Errorf("nested: g=%v, wanted g=%v", g, []float64{18})
+	}
+	Return(Arithmetic(OpMul, y, &x[1]))
+	g = Gradient()
+	if !reflect.DeepEqual(g, []float64{9, 12}) {
+		t.Errorf("outer: g=%v, wanted g=%v", g, []float64{9, 12})
+	}
+}
+
+// Cells are allocated in blocks; a function with many results
+// spans several blocks.
+func TestCells(t *testing.T) {
+	x := make([]float64, 10*cellBlock)
+	for i := range x {
+		x[i] = float64(i)
+	}
+	for k := 0; k != 2; k++ {
+		g := ddx(x, sumsq)
+		for i := range g {
+			if g[i] != 2*x[i] {
+				t.Fatalf("%d: g[%d]=%v, wanted %v",
+					k, i, g[i], 2*x[i])
+			}
+		}
+	}
+	if tape := tapes.get(); tape.top != 0 || tape.fill != 1 {
+		t.Errorf("cells not released: top=%d, fill=%d",
+			tape.top, tape.fill)
+	}
+}
+
+// Explicit tapes are independent and can be used in multiple
+// goroutines concurrently.
+func TestExplicit(t *testing.T) {
+	// sumexp computes the gradient of the sum of exponents.
+	sumexp := func(tape *Tape, x []float64) []float64 {
+		tape.Setup(x)
+		var y float64
+		tape.Assignment(&y, tape.Value(0))
+		for i := range x {
+			tape.Assignment(&y, tape.Arithmetic(OpAdd, &y,
+				tape.Elemental(math.Exp, &x[i])))
+		}
+		tape.Return(&y)
+		return tape.Gradient()
+	}
+	errs := make(chan string, 4)
+	for k := 0; k != cap(errs); k++ {
+		go func(k int) {
+			tape := NewTape()
+			x := []float64{float64(k), 1}
+			want := []float64{math.Exp(x[0]), math.Exp(x[1])}
+			for i := 0; i != 100; i++ {
+				if g := sumexp(tape, x); !reflect.DeepEqual(g, want) {
+					errs <- fmt.Sprintf("%d: g=%v, wanted g=%v",
+						k, g, want)
+					return
+				}
+			}
+			errs <- ""
+		}(k)
+	}
+	for k := 0; k != cap(errs); k++ {
+		if err := <-errs; err != "" {
+			t.Error(err)
+		}
+	}
 }
 
 func shouldPop(t *testing.T, x []float64, f func(x []float64)) {
@@ -77,11 +217,18 @@ type testcase struct {
 func runsuite(t *testing.T, suite []testcase) {
 	for _, c := range suite {
 		for _, v := range c.v {
+			x := make([]float64, len(v[0]))
+			copy(x, v[0])
 			g := ddx(v[0], c.f)
 			if !reflect.DeepEqual(g, v[1]) {
 				t.Errorf("%s, x=%v: g=%v, wanted g=%v",
 					c.s, v[0], g, v[1])
 			}
+			g = ddxForward(x, c.f)
+			if !reflect.DeepEqual(g, v[1]) {
+				t.Errorf("forward %s, x=%v: g=%v, wanted g=%v",
+					c.s, v[0], g, v[1])
+			}
 		}
 	}
 }
@@ -466,3 +613,167 @@ func TestCall(t *testing.T) {
 				{{1, 2}, {2, 1}}}},
 	})
 }
+
+// GradientInto computes the same gradient as Gradient, and the
+// backward pass does not allocate.
+func TestGradientInto(t *testing.T) {
+	x := []float64{0.5, 1, 2}
+	for _, c := range []struct {
+		s     string
+		setup func(x []float64)
+		f     func(x []float64)
+	}{
+		{"sumsq", Setup, sumsq},
+		{"logsumexp", Setup, logsumexp},
+		{"forward sumsq", SetupForward, sumsq},
+		{"forward logsumexp", SetupForward, logsumexp},
+	} {
+		c.setup(x)
+		c.f(x)
+		want := Gradient()
+		got := make([]float64, len(x))
+		c.setup(x)
+		c.f(x)
+		GradientInto(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: g=%v, wanted g=%v", c.s, got, want)
+		}
+		// The difference between computing the gradient and
+		// popping the tape must be allocation-free.
+		forward := testing.AllocsPerRun(10, func() {
+			c.setup(x)
+			c.f(x)
+			Pop()
+		})
+		backward := testing.AllocsPerRun(10, func() {
+			c.setup(x)
+			c.f(x)
+			GradientInto(got)
+		})
+		if backward != forward {
+			t.Errorf("%s: %v allocations in GradientInto, want 0",
+				c.s, backward-forward)
+		}
+	}
+}
+
+// Benchmarks
+
+// sumsq computes the sum of squares of x.
+func sumsq(x []float64) {
+	var y float64
+	Assignment(&y, Value(0))
+	for i := range x {
+		Assignment(&y, Arithmetic(OpAdd, &y,
+			Arithmetic(OpMul, &x[i], &x[i])))
+	}
+	Return(&y)
+}
+
+// logsumexp computes the logarithm of the sum of exponents of x.
+func logsumexp(x []float64) {
+	var y float64
+	Assignment(&y, Value(0))
+	for i := range x {
+		Assignment(&y, Arithmetic(OpAdd, &y,
+			Elemental(math.Exp, &x[i])))
+	}
+	Return(Elemental(math.Log, &y))
+}
+
+func benchmarkGradient(b *testing.B, n int, f func(x []float64)) {
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = float64(i) / float64(n)
+	}
+	for i := 0; i != b.N; i++ {
+		ddx(x, f)
+	}
+}
+
+func BenchmarkSumsq10(b *testing.B) {
+	benchmarkGradient(b, 10, sumsq)
+}
+
+func BenchmarkSumsq1000(b *testing.B) {
+	benchmarkGradient(b, 1000, sumsq)
+}
+
+func BenchmarkLogsumexp10(b *testing.B) {
+	benchmarkGradient(b, 10, logsumexp)
+}
+
+func BenchmarkLogsumexp1000(b *testing.B) {
+	benchmarkGradient(b, 1000, logsumexp)
+}
+
+// The following models have a single parameter and a long
+// body. Forward mode neither records nor sweeps the tape, and is
+// faster than reverse mode when much of the body does not depend
+// on the parameter, or when the body is too long for the tape to
+// stay in the cache.
+
+// horner evaluates a polynomial of degree n, with all
+// coefficients equal to 1, at x[0].
+func horner(n int) func(x []float64) {
+	return func(x []float64) {
+		var y float64
+		Assignment(&y, Value(0))
+		for i := 0; i != n; i++ {
+			Assignment(&y, Arithmetic(OpAdd,
+				Arithmetic(OpMul, &y, &x[0]), Value(1)))
+		}
+		Return(&y)
+	}
+}
+
+// weighted computes the sum of w[i]*x[0] for 1000 weights
+// computed in the body; the weights do not depend on x[0].
+func weighted(x []float64) {
+	var y float64
+	Assignment(&y, Value(0))
+	for i := 0; i != 1000; i++ {
+		u := Value(float64(i) / 1000)
+		d := Arithmetic(OpSub, u, Value(0.5))
+		w := Arithmetic(OpDiv,
+			Arithmetic(OpMul, d, d),
+			Arithmetic(OpAdd, u, Value(1)))
+		Assignment(&y, Arithmetic(OpAdd, &y,
+			Arithmetic(OpMul, w, &x[0])))
+	}
+	Return(&y)
+}
+
+func benchmarkForward(b *testing.B, n int, f func(x []float64)) {
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = float64(i) / float64(n)
+	}
+	for i := 0; i != b.N; i++ {
+		ddxForward(x, f)
+	}
+}
+
+func BenchmarkHorner1000(b *testing.B) {
+	benchmarkGradient(b, 1, horner(1000))
+}
+
+func BenchmarkForwardHorner1000(b *testing.B) {
+	benchmarkForward(b, 1, horner(1000))
+}
+
+func BenchmarkHorner100000(b *testing.B) {
+	benchmarkGradient(b, 1, horner(100000))
+}
+
+func BenchmarkForwardHorner100000(b *testing.B) {
+	benchmarkForward(b, 1, horner(100000))
+}
+
+func BenchmarkWeighted(b *testing.B) {
+	benchmarkGradient(b, 1, weighted)
+}
+
+func BenchmarkForwardWeighted(b *testing.B) {
+	benchmarkForward(b, 1, weighted)
+}
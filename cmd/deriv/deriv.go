@@ -25,13 +25,18 @@ func init() {
 		"prefix of generated identifiers")
 	flag.BoolVar(&ad.Fold, "fold", ad.Fold,
 		"fold constants")
+	flag.BoolVar(&ad.Forward, "forward", ad.Forward,
+		"differentiate in forward mode")
+	flag.BoolVar(&ad.Explicit, "explicit", ad.Explicit,
+		"pass the tape explicitly, write to 'adx/'")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(),
 			`Generates a differentiated model. Usage:
     %s [flags] [path/to/model/directory/]
 If the path is omitted, the model in the current directory `+
 				`is differentiated. The differentiated model `+
-				`is placed into the 'ad/' subdirectory. Flags:
+				`is placed into the 'ad/' subdirectory ('adx/' `+
+				`with -explicit). Flags:
 `,
 			command)
 		flag.PrintDefaults()
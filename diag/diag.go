@@ -0,0 +1,333 @@
+// Package diag provides convergence diagnostics for samples
+// produced by MCMC algorithms: autocorrelation, effective
+// sample size, potential scale reduction (R-hat), Monte Carlo
+// standard error, and quantiles. Draws of a single parameter
+// are passed as chains, a slice of equal-length chains of
+// draws; a single chain is passed as [][]float64{x}. The
+// estimates follow Vehtari et al., Rank-normalization,
+// folding, and localization: An improved R-hat for assessing
+// convergence of MCMC (https://arxiv.org/abs/1903.08008).
+package diag
+
+import (
+	"math"
+	"sort"
+)
+
+// Param returns the draws of parameter i in the draws of a
+// chain.
+func Param(draws [][]float64, i int) []float64 {
+	x := make([]float64, len(draws))
+	for j := range draws {
+		x[j] = draws[j][i]
+	}
+	return x
+}
+
+// Autocorr returns the autocorrelation of x for lags from 0
+// to maxLag.
+func Autocorr(x []float64, maxLag int) []float64 {
+	a := newAutocov(x)
+	rho := make([]float64, maxLag+1)
+	for k := range rho {
+		rho[k] = a.at(k) / a.at(0)
+	}
+	return rho
+}
+
+// ESS returns the effective sample size of the mean, for
+// split chains, without rank normalization.
+func ESS(chains [][]float64) float64 {
+	return essBasic(split(chains))
+}
+
+// BulkESS returns the bulk effective sample size, for split
+// rank-normalized chains.
+func BulkESS(chains [][]float64) float64 {
+	return essBasic(zScale(split(chains)))
+}
+
+// TailESS returns the tail effective sample size, the minimum
+// of the effective sample sizes of the 5% and 95% quantiles.
+func TailESS(chains [][]float64) float64 {
+	x := pool(chains)
+	return math.Min(
+		essQuantile(chains, Quantile(x, 0.05)),
+		essQuantile(chains, Quantile(x, 0.95)))
+}
+
+// SplitRHat returns the classic potential scale reduction of
+// split chains.
+func SplitRHat(chains [][]float64) float64 {
+	return rhatBasic(split(chains))
+}
+
+// RHat returns the rank-normalized potential scale
+// reduction, the maximum of the bulk and the tail (folded)
+// R-hat. Values above 1.01 indicate that the chains have not
+// mixed.
+func RHat(chains [][]float64) float64 {
+	bulk := rhatBasic(zScale(split(chains)))
+	m := median(pool(chains))
+	folded := make([][]float64, len(chains))
+	for i, c := range chains {
+		folded[i] = make([]float64, len(c))
+		for j, x := range c {
+			folded[i][j] = math.Abs(x - m)
+		}
+	}
+	tail := rhatBasic(zScale(split(folded)))
+	return math.Max(bulk, tail)
+}
+
+// MCSE returns the Monte Carlo standard error of the mean.
+func MCSE(chains [][]float64) float64 {
+	_, variance := meanVar(pool(chains))
+	return math.Sqrt(variance / ESS(chains))
+}
+
+// Quantile returns quantile p of x, interpolating linearly
+// between order statistics (type 7 in R), or NaN if x is empty.
+func Quantile(x []float64, p float64) float64 {
+	return Quantiles(x, p)[0]
+}
+
+// Quantiles returns quantiles ps of x, see Quantile.
+func Quantiles(x []float64, ps ...float64) []float64 {
+	sorted := append([]float64(nil), x...)
+	sort.Float64s(sorted)
+	q := make([]float64, len(ps))
+	for i, p := range ps {
+		if len(sorted) == 0 {
+			q[i] = math.NaN()
+			continue
+		}
+		h := float64(len(sorted)-1) * p
+		j := int(math.Floor(h))
+		if j+1 >= len(sorted) {
+			q[i] = sorted[len(sorted)-1]
+			continue
+		}
+		q[i] = sorted[j] + (h-float64(j))*(sorted[j+1]-sorted[j])
+	}
+	return q
+}
+
+// Helpers
+
+// split splits each chain into halves. The middle draw of a
+// chain of odd length is dropped.
+func split(chains [][]float64) [][]float64 {
+	halves := make([][]float64, 0, 2*len(chains))
+	for _, c := range chains {
+		n := len(c) / 2
+		halves = append(halves, c[:n], c[len(c)-n:])
+	}
+	return halves
+}
+
+// pool concatenates the chains.
+func pool(chains [][]float64) []float64 {
+	var x []float64
+	for _, c := range chains {
+		x = append(x, c...)
+	}
+	return x
+}
+
+// meanVar returns the mean and the variance of x, with n - 1
+// degrees of freedom.
+func meanVar(x []float64) (mean, variance float64) {
+	for _, y := range x {
+		mean += y
+	}
+	mean /= float64(len(x))
+	for _, y := range x {
+		variance += (y - mean) * (y - mean)
+	}
+	variance /= float64(len(x) - 1)
+	return mean, variance
+}
+
+// median returns the median of x.
+func median(x []float64) float64 {
+	return Quantile(x, 0.5)
+}
+
+// zScale replaces the draws by normal scores of their ranks
+// in the pooled draws. Ties get the average rank.
+func zScale(chains [][]float64) [][]float64 {
+	type draw struct {
+		x    float64
+		i, j int
+	}
+	var draws []draw
+	for i, c := range chains {
+		for j, x := range c {
+			draws = append(draws, draw{x, i, j})
+		}
+	}
+	sort.Slice(draws, func(a, b int) bool {
+		return draws[a].x < draws[b].x
+	})
+	z := make([][]float64, len(chains))
+	for i, c := range chains {
+		z[i] = make([]float64, len(c))
+	}
+	s := float64(len(draws))
+	for a := 0; a != len(draws); {
+		b := a + 1
+		for b != len(draws) && draws[b].x == draws[a].x {
+			b++
+		}
+		// Ranks are 1-based.
+		rank := 0.5 * float64(a+1+b)
+		p := (rank - 3./8) / (s + 1./4)
+		for _, d := range draws[a:b] {
+			z[d.i][d.j] = math.Sqrt2 * math.Erfinv(2*p-1)
+		}
+		a = b
+	}
+	return z
+}
+
+// rhatBasic computes R-hat of the chains.
+func rhatBasic(chains [][]float64) float64 {
+	n := float64(len(chains[0]))
+	means := make([]float64, len(chains))
+	within := 0.
+	for i, c := range chains {
+		var variance float64
+		means[i], variance = meanVar(c)
+		within += variance
+	}
+	within /= float64(len(chains))
+	_, between := meanVar(means)
+	between *= n
+	return math.Sqrt((between/within + n - 1) / n)
+}
+
+// essQuantile computes the effective sample size of the
+// quantile with value q.
+func essQuantile(chains [][]float64, q float64) float64 {
+	indicators := make([][]float64, len(chains))
+	for i, c := range chains {
+		indicators[i] = make([]float64, len(c))
+		for j, x := range c {
+			if x <= q {
+				indicators[i][j] = 1
+			}
+		}
+	}
+	return essBasic(split(indicators))
+}
+
+// essBasic computes the effective sample size of the chains
+// using Geyer's initial monotone sequence estimator of the
+// autocorrelation time.
+func essBasic(chains [][]float64) float64 {
+	m := len(chains)
+	n := len(chains[0])
+	if n < 2 {
+		// Too few draws
+		return math.NaN()
+	}
+	acovs := make([]*autocov, m)
+	means := make([]float64, m)
+	within := 0.
+	for i, c := range chains {
+		acovs[i] = newAutocov(c)
+		means[i] = acovs[i].mean
+		within += acovs[i].at(0) * float64(n) / float64(n-1)
+	}
+	within /= float64(m)
+	varPlus := within * float64(n-1) / float64(n)
+	if m > 1 {
+		_, v := meanVar(means)
+		varPlus += v
+	}
+	if varPlus == 0 {
+		// Constant chains
+		return math.NaN()
+	}
+
+	// Autocorrelation at lag k, combined for all chains
+	rhoAt := func(k int) float64 {
+		acov := 0.
+		for _, a := range acovs {
+			acov += a.at(k)
+		}
+		acov /= float64(m)
+		return 1 - (within-acov)/varPlus
+	}
+
+	rho := make([]float64, n)
+	rho[0] = 1
+	rhoEven, rhoOdd := 1., rhoAt(1)
+	rho[1] = rhoOdd
+	// Geyer's initial positive sequence. The bound is that of
+	// Stan, n-4 there, where the loop variable is t+1 and
+	// starts at 1; the largest lag is n-3 in both.
+	t := 0
+	for t < n-5 && rhoEven+rhoOdd > 0 {
+		t += 2
+		rhoEven, rhoOdd = rhoAt(t), rhoAt(t+1)
+		if rhoEven+rhoOdd >= 0 {
+			rho[t], rho[t+1] = rhoEven, rhoOdd
+		}
+	}
+	maxT := t
+	// Used in the improved estimate
+	if rhoEven > 0 {
+		rho[maxT] = rhoEven
+	}
+	// Geyer's initial monotone sequence
+	for t = 2; t <= maxT-2; t += 2 {
+		if rho[t]+rho[t+1] > rho[t-2]+rho[t-1] {
+			rho[t] = (rho[t-2] + rho[t-1]) / 2
+			rho[t+1] = rho[t]
+		}
+	}
+	ess := float64(m * n)
+	// Geyer's truncated estimate
+	tau := -1 + rho[maxT]
+	for _, r := range rho[:maxT] {
+		tau += 2 * r
+	}
+	// The improved estimate reduces variance in the antithetic
+	// case.
+	tau = math.Max(tau, 1/math.Log10(ess))
+	return ess / tau
+}
+
+// autocov computes the autocovariance of a chain on demand.
+type autocov struct {
+	x    []float64 // centered chain
+	mean float64
+	cov  []float64 // autocovariance for lags computed so far
+}
+
+func newAutocov(x []float64) *autocov {
+	a := &autocov{x: make([]float64, len(x))}
+	for _, y := range x {
+		a.mean += y
+	}
+	a.mean /= float64(len(x))
+	for i, y := range x {
+		a.x[i] = y - a.mean
+	}
+	return a
+}
+
+// at returns the biased autocovariance at lag k.
+func (a *autocov) at(k int) float64 {
+	for len(a.cov) <= k {
+		l := len(a.cov)
+		c := 0.
+		for i := 0; i+l < len(a.x); i++ {
+			c += a.x[i] * a.x[i+l]
+		}
+		a.cov = append(a.cov, c/float64(len(a.x)))
+	}
+	return a.cov[k]
+}
@@ -0,0 +1,197 @@
+package diag
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestAutocorr(t *testing.T) {
+	// Biased autocovariance of 1..5: (10, 4, -1, -4, -4)/5.
+	rho := Autocorr([]float64{1, 2, 3, 4, 5}, 4)
+	for k, want := range []float64{1, 0.4, -0.1, -0.4, -0.4} {
+		if math.Abs(rho[k]-want) > 1e-9 {
+			t.Errorf("Wrong autocorrelation at lag %d: "+
+				"got %.4g, want %.4g", k, rho[k], want)
+		}
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	x := []float64{7, 3, 10, 1, 5, 9, 2, 8, 4, 6}
+	for _, c := range []struct {
+		p, q float64
+	}{
+		{0, 1},
+		{0.05, 1.45},
+		{0.25, 3.25},
+		{0.5, 5.5},
+		{0.95, 9.55},
+		{1, 10},
+	} {
+		q := Quantile(x, c.p)
+		if math.Abs(q-c.q) > 1e-9 {
+			t.Errorf("Wrong quantile %.4g: got %.4g, want %.4g",
+				c.p, q, c.q)
+		}
+	}
+	if x[0] != 7 {
+		t.Errorf("Quantile modified the draws")
+	}
+	if q := Quantile(nil, 0.5); !math.IsNaN(q) {
+		t.Errorf("Wrong quantile of no draws: got %.4g, want NaN", q)
+	}
+}
+
+func TestSplitRHat(t *testing.T) {
+	// Split chains {1, 2}, {3, 4}, {3, 4}, {5, 6}:
+	// W = 1/2, B = 16/3, R-hat = sqrt((B/W + 1)/2).
+	for _, c := range []struct {
+		chains [][]float64
+		rhat   float64
+	}{
+		{[][]float64{{1, 2, 3, 4}, {3, 4, 5, 6}}, 2.415229458},
+		// The middle draw of odd-length chains is dropped.
+		{[][]float64{{1, 2, 0, 3, 4}, {3, 4, 9, 5, 6}}, 2.415229458},
+		{[][]float64{{1, 2, 1, 2}}, 1 / math.Sqrt2},
+	} {
+		rhat := SplitRHat(c.chains)
+		if math.Abs(rhat-c.rhat) > 1e-6 {
+			t.Errorf("Wrong split R-hat of %v: got %.6g, want %.6g",
+				c.chains, rhat, c.rhat)
+		}
+	}
+}
+
+// ar1 returns m chains of n draws from the AR(1) process
+// x[t] = phi x[t-1] + e[t] with Normal(shift[i], 1)
+// stationary distribution.
+func ar1(rng *rand.Rand, m, n int, phi float64, shift []float64) [][]float64 {
+	chains := make([][]float64, m)
+	sd := math.Sqrt(1 - phi*phi)
+	for i := range chains {
+		chains[i] = make([]float64, n)
+		x := rng.NormFloat64()
+		for j := range chains[i] {
+			x = phi*x + sd*rng.NormFloat64()
+			chains[i][j] = x
+			if shift != nil {
+				chains[i][j] += shift[i]
+			}
+		}
+	}
+	return chains
+}
+
+func TestESS(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const m, n = 4, 5000
+	for _, c := range []struct {
+		phi float64
+		tol float64
+	}{
+		{0, 0.1},
+		{0.5, 0.1},
+		{0.9, 0.15},
+		{-0.5, 0.15},
+	} {
+		chains := ar1(rng, m, n, c.phi, nil)
+		// Asymptotic effective sample size of AR(1).
+		want := m * n * (1 - c.phi) / (1 + c.phi)
+		for _, e := range []struct {
+			name string
+			ess  func([][]float64) float64
+		}{
+			{"ESS", ESS},
+			{"BulkESS", BulkESS},
+		} {
+			ess := e.ess(chains)
+			if math.Abs(ess-want)/want > c.tol {
+				t.Errorf("Wrong %s for phi=%.2g: got %.4g, want %.4g",
+					e.name, c.phi, ess, want)
+			}
+		}
+	}
+}
+
+func TestTailESS(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const m, n = 4, 5000
+	chains := ar1(rng, m, n, 0, nil)
+	ess := TailESS(chains)
+	if math.Abs(ess-m*n)/(m*n) > 0.15 {
+		t.Errorf("Wrong TailESS of independent draws: "+
+			"got %.4g, want %.4g", ess, float64(m*n))
+	}
+	// Constant tail indicators.
+	if ess := TailESS([][]float64{{1, 1, 1, 1, 1, 1}}); !math.IsNaN(ess) {
+		t.Errorf("Wrong TailESS of constant chain: got %.4g, want NaN",
+			ess)
+	}
+}
+
+func TestRHat(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const m, n = 4, 1000
+	for _, c := range []struct {
+		phi   float64
+		shift []float64
+		mixed bool
+	}{
+		{0, nil, true},
+		{0.5, nil, true},
+		{0, []float64{0, 0, 0, 2}, false},
+		{0.5, []float64{0, 0.5, 1, 1.5}, false},
+	} {
+		chains := ar1(rng, m, n, c.phi, c.shift)
+		for _, r := range []struct {
+			name string
+			rhat func([][]float64) float64
+		}{
+			{"SplitRHat", SplitRHat},
+			{"RHat", RHat},
+		} {
+			rhat := r.rhat(chains)
+			if c.mixed && math.Abs(rhat-1) > 0.01 ||
+				!c.mixed && rhat < 1.1 {
+				t.Errorf("Wrong %s for phi=%.2g, shift=%v: got %.4g",
+					r.name, c.phi, c.shift, rhat)
+			}
+		}
+	}
+
+	// Chains with the same location but different scales are
+	// detected by the folded R-hat only.
+	chains := ar1(rng, m, n, 0, nil)
+	for j := range chains[0] {
+		chains[0][j] *= 3
+	}
+	if rhat := RHat(chains); rhat < 1.1 {
+		t.Errorf("Wrong RHat for different scales: got %.4g", rhat)
+	}
+}
+
+func TestMCSE(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const m, n = 4, 5000
+	for _, phi := range []float64{0, 0.5} {
+		chains := ar1(rng, m, n, phi, nil)
+		// sd/sqrt(ESS) with unit standard deviation
+		want := math.Sqrt((1 + phi) / (1 - phi) / (m * n))
+		mcse := MCSE(chains)
+		if math.Abs(mcse-want)/want > 0.1 {
+			t.Errorf("Wrong MCSE for phi=%.2g: got %.4g, want %.4g",
+				phi, mcse, want)
+		}
+	}
+}
+
+func TestParam(t *testing.T) {
+	x := Param([][]float64{{1, 2}, {3, 4}, {5, 6}}, 1)
+	for i, want := range []float64{2, 4, 6} {
+		if x[i] != want {
+			t.Errorf("Wrong draw %d: got %.4g, want %.4g",
+				i, x[i], want)
+		}
+	}
+}
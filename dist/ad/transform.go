@@ -0,0 +1,387 @@
+package dist
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/mathx"
+	"fmt"
+	"math"
+)
+
+type lower struct{}
+
+var Lower lower
+
+func (t lower) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(0, make([]float64, len(x)-1), x[1:])
+	}, 1, &x[0]))
+}
+
+func (lower) Transform(lo float64, y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter(&lo)
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	ad.Assignment(&logj, ad.Value(0.))
+	for i := range x {
+		ad.Assignment(&y[i], ad.Arithmetic(ad.OpAdd, &lo, ad.Elemental(math.Exp, &x[i])))
+		ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, &x[i]))
+	}
+	return ad.Return(&logj)
+}
+
+func (lower) Inverse(lo float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(y[i] - lo)
+	}
+	return x
+}
+
+type upper struct{}
+
+var Upper upper
+
+func (t upper) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(0, make([]float64, len(x)-1), x[1:])
+	}, 1, &x[0]))
+}
+
+func (upper) Transform(hi float64, y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter(&hi)
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	ad.Assignment(&logj, ad.Value(0.))
+	for i := range x {
+		ad.Assignment(&y[i], ad.Arithmetic(ad.OpSub, &hi, ad.Elemental(math.Exp, &x[i])))
+		ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, &x[i]))
+	}
+	return ad.Return(&logj)
+}
+
+func (upper) Inverse(hi float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(hi - y[i])
+	}
+	return x
+}
+
+type positive struct{}
+
+var Positive positive
+
+func (t positive) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(make([]float64, len(x)), x)
+	}, 0))
+}
+
+func (positive) Transform(y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	ad.Assignment(&logj, ad.Value(0.))
+	for i := range x {
+		ad.Assignment(&y[i], ad.Elemental(math.Exp, &x[i]))
+		ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, &x[i]))
+	}
+	return ad.Return(&logj)
+}
+
+func (positive) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(y[i])
+	}
+	return x
+}
+
+type interval struct{}
+
+var Interval interval
+
+func (t interval) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(0, 0, make([]float64, len(x)-2), x[2:])
+	}, 2, &x[0], &x[1]))
+}
+
+func (interval) Transform(lo, hi float64, y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter(&lo, &hi)
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logw float64
+	ad.Assignment(&logw, ad.Elemental(math.Log, ad.Arithmetic(ad.OpSub, &hi, &lo)))
+	var logj float64
+	ad.Assignment(&logj, ad.Value(0.))
+	for i := range x {
+		ad.Assignment(&y[i], ad.Arithmetic(ad.OpAdd, &lo, ad.Arithmetic(ad.OpMul, (ad.Arithmetic(ad.OpSub, &hi, &lo)), ad.Elemental(mathx.Sigm, &x[i]))))
+		ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, ad.Arithmetic(ad.OpSub, ad.Arithmetic(ad.OpSub, &logw, ad.Elemental(mathx.LogSumExp, ad.Value(0), ad.Arithmetic(ad.OpNeg, &x[i]))), ad.Elemental(mathx.LogSumExp, ad.Value(0), &x[i]))))
+	}
+	return ad.Return(&logj)
+}
+
+func (interval) Inverse(lo, hi float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		p := (y[i] - lo) / (hi - lo)
+		x[i] = math.Log(p) - math.Log(1-p)
+	}
+	return x
+}
+
+type simplex struct{}
+
+var Simplex simplex
+
+func (t simplex) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(make([]float64, len(x)+1), x)
+	}, 0))
+}
+
+func (simplex) Transform(y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x)+1)
+	var logj float64
+	ad.Assignment(&logj, ad.Value(0.))
+	var stick float64
+	ad.Assignment(&stick, ad.Value(1.))
+	for k := range x {
+		var z float64
+		ad.Assignment(&z, ad.Arithmetic(ad.OpSub, &x[k], ad.Elemental(math.Log, ad.Value(float64(len(x)-k)))))
+		ad.Assignment(&y[k], ad.Arithmetic(ad.OpMul, &stick, ad.Elemental(mathx.Sigm, &z)))
+		ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, ad.Arithmetic(ad.OpSub, ad.Arithmetic(ad.OpSub, ad.Elemental(math.Log, &stick), ad.Elemental(mathx.LogSumExp, ad.Value(0), ad.Arithmetic(ad.OpNeg, &z))), ad.Elemental(mathx.LogSumExp, ad.Value(0), &z))))
+		ad.Assignment(&stick, ad.Arithmetic(ad.OpSub, &stick, &y[k]))
+	}
+	ad.Assignment(&y[len(x)], &stick)
+	return ad.Return(&logj)
+}
+
+func (simplex) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y)-1)
+	stick := y[len(x)]
+	for k := len(x) - 1; k >= 0; k-- {
+		stick += y[k]
+		p := y[k] / stick
+		x[k] = math.Log(p) - math.Log(1-p) +
+			math.Log(float64(len(x)-k))
+	}
+	return x
+}
+
+type ordered struct{}
+
+var Ordered ordered
+
+func (t ordered) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(make([]float64, len(x)), x)
+	}, 0))
+}
+
+func (ordered) Transform(y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	ad.Assignment(&logj, ad.Value(0.))
+	for k := range x {
+		if k == 0 {
+			ad.Assignment(&y[k], &x[k])
+		} else {
+			ad.Assignment(&y[k], ad.Arithmetic(ad.OpAdd, &y[k-1], ad.Elemental(math.Exp, &x[k])))
+			ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, &x[k]))
+		}
+	}
+	return ad.Return(&logj)
+}
+
+func (ordered) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y))
+	for k := range y {
+		if k == 0 {
+			x[k] = y[k]
+		} else {
+			x[k] = math.Log(y[k] - y[k-1])
+		}
+	}
+	return x
+}
+
+type unitVector struct{}
+
+var UnitVector unitVector
+
+func (t unitVector) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(make([]float64, len(x)), x)
+	}, 0))
+}
+
+func (unitVector) Transform(y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var r2 float64
+	ad.Assignment(&r2, ad.Value(0.))
+	for i := range x {
+		ad.Assignment(&r2, ad.Arithmetic(ad.OpAdd, &r2, ad.Arithmetic(ad.OpMul, &x[i], &x[i])))
+	}
+	var r float64
+	ad.Assignment(&r, ad.Elemental(math.Sqrt, &r2))
+	for i := range x {
+		ad.Assignment(&y[i], ad.Arithmetic(ad.OpDiv, &x[i], &r))
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul, ad.Value(-0.5), &r2))
+}
+
+func (unitVector) Inverse(y []float64) []float64 {
+	return append([]float64(nil), y...)
+}
+
+type choleskyCorr struct{}
+
+var CholeskyCorr choleskyCorr
+
+func (t choleskyCorr) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	var k int
+
+	k = choleskyOrder(len(x))
+	return ad.Return(ad.Call(func(_ []float64) {
+		t.Transform(make([]float64, k*k), x)
+	}, 0))
+}
+
+func (choleskyCorr) Transform(y, x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	var k int
+
+	k = choleskyOrder(len(x))
+	checkLengths(len(y), k*k)
+	var logj float64
+	ad.Assignment(&logj, ad.Value(0.))
+	var n int
+
+	n = 0
+	for i := 0; i != k; i = i + 1 {
+		var sumSqs float64
+		ad.Assignment(&sumSqs, ad.Value(0.))
+		for j := 0; j != i; j = j + 1 {
+			var z float64
+			ad.Assignment(&z, ad.Arithmetic(ad.OpSub, ad.Arithmetic(ad.OpMul, ad.Value(2), ad.Elemental(mathx.Sigm, ad.Arithmetic(ad.OpMul, ad.Value(2), &x[n]))), ad.Value(1)))
+			ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, ad.Arithmetic(ad.OpSub, ad.Arithmetic(ad.OpSub, ad.Arithmetic(ad.OpMul, ad.Value(2), ad.Elemental(math.Log, ad.Value(2))), ad.Elemental(mathx.LogSumExp, ad.Value(0), ad.Arithmetic(ad.OpMul, ad.Value(-2), &x[n]))), ad.Elemental(mathx.LogSumExp, ad.Value(0), ad.Arithmetic(ad.OpMul, ad.Value(2), &x[n])))))
+			n = n + 1
+			if j > 0 {
+				ad.Assignment(&logj, ad.Arithmetic(ad.OpAdd, &logj, ad.Arithmetic(ad.OpMul, ad.Value(0.5), ad.Elemental(math.Log, ad.Arithmetic(ad.OpSub, ad.Value(1), &sumSqs)))))
+			}
+			ad.Assignment(&y[i*k+j], ad.Arithmetic(ad.OpMul, &z, ad.Elemental(math.Sqrt, ad.Arithmetic(ad.OpSub, ad.Value(1), &sumSqs))))
+			ad.Assignment(&sumSqs, ad.Arithmetic(ad.OpAdd, &sumSqs, ad.Arithmetic(ad.OpMul, &y[i*k+j], &y[i*k+j])))
+		}
+		ad.Assignment(&y[i*k+i], ad.Elemental(math.Sqrt, ad.Arithmetic(ad.OpSub, ad.Value(1), &sumSqs)))
+		for j := i + 1; j != k; j = j + 1 {
+			ad.Assignment(&y[i*k+j], ad.Value(0))
+		}
+	}
+	return ad.Return(&logj)
+}
+
+func (choleskyCorr) Inverse(y []float64) []float64 {
+	k := int(math.Sqrt(float64(len(y))))
+	x := make([]float64, 0, k*(k-1)/2)
+	for i := 1; i < k; i++ {
+		sumSqs := 0.
+		for j := 0; j != i; j++ {
+			l := y[i*k+j]
+			x = append(x, math.Atanh(l/math.Sqrt(1-sumSqs)))
+			sumSqs += l * l
+		}
+	}
+	return x
+}
+
+func choleskyOrder(n int) int {
+	k := int(0.5 + math.Sqrt(0.25+2*float64(n)))
+	if k*(k-1)/2 != n {
+		panic(fmt.Sprintf("%d values do not form "+
+			"a Cholesky factor", n))
+	}
+	return k
+}
+
+func checkLengths(ly, lwant int) {
+	if ly != lwant {
+		panic(fmt.Sprintf("wrong number of constrained values: "+
+			"got %d, want %d", ly, lwant))
+	}
+}
@@ -0,0 +1,242 @@
+package dist
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"math"
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		transform func(y, x []float64) float64
+		inverse   func(y []float64) []float64
+		ny        int
+
+		free func(y []float64) []float64
+		x    []float64
+		y    []float64
+	}{
+		{
+			name: "Lower",
+			transform: func(y, x []float64) float64 {
+				return Lower.Transform(1, y, x)
+			},
+			inverse: func(y []float64) []float64 {
+				return Lower.Inverse(1, y)
+			},
+			ny: 2,
+			x:  []float64{0, math.Log(2)},
+			y:  []float64{2, 3},
+		},
+		{
+			name: "Upper",
+			transform: func(y, x []float64) float64 {
+				return Upper.Transform(1, y, x)
+			},
+			inverse: func(y []float64) []float64 {
+				return Upper.Inverse(1, y)
+			},
+			ny: 2,
+			x:  []float64{0, math.Log(2)},
+			y:  []float64{0, -1},
+		},
+		{
+			name:      "Positive",
+			transform: Positive.Transform,
+			inverse:   Positive.Inverse,
+			ny:        2,
+			x:         []float64{0, 1},
+			y:         []float64{1, math.E},
+		},
+		{
+			name: "Interval",
+			transform: func(y, x []float64) float64 {
+				return Interval.Transform(-1, 3, y, x)
+			},
+			inverse: func(y []float64) []float64 {
+				return Interval.Inverse(-1, 3, y)
+			},
+			ny: 3,
+			x:  []float64{0, math.Log(3), -5},
+			y:  []float64{1, 2, -1 + 4/(1+math.Exp(5))},
+		},
+		{
+			name:      "Simplex",
+			transform: Simplex.Transform,
+			inverse:   Simplex.Inverse,
+			ny:        3,
+			free:      func(y []float64) []float64 { return y[:2] },
+			x:         []float64{0, 0},
+			y:         []float64{1. / 3, 1. / 3, 1. / 3},
+		},
+		{
+			name:      "Simplex",
+			transform: Simplex.Transform,
+			inverse:   Simplex.Inverse,
+			ny:        4,
+			free:      func(y []float64) []float64 { return y[:3] },
+			x:         []float64{1, -1, 0.5},
+		},
+		{
+			name:      "Ordered",
+			transform: Ordered.Transform,
+			inverse:   Ordered.Inverse,
+			ny:        3,
+			x:         []float64{1, 0, math.Log(2)},
+			y:         []float64{1, 2, 4},
+		},
+		{
+			name:      "CholeskyCorr",
+			transform: CholeskyCorr.Transform,
+			inverse:   CholeskyCorr.Inverse,
+			ny:        4,
+			free:      func(y []float64) []float64 { return y[2:3] },
+			x:         []float64{math.Atanh(0.6)},
+			y:         []float64{1, 0, 0.6, 0.8},
+		},
+		{
+			name:      "CholeskyCorr",
+			transform: CholeskyCorr.Transform,
+			inverse:   CholeskyCorr.Inverse,
+			ny:        9,
+			free: func(y []float64) []float64 {
+				return []float64{y[3], y[6], y[7]}
+			},
+			x: []float64{0.5, -1, 0.3},
+		},
+	} {
+		y := make([]float64, c.ny)
+		logj := c.transform(y, c.x)
+		if c.y != nil {
+			for i := range y {
+				if math.Abs(y[i]-c.y[i]) > 1e-9 {
+					t.Errorf("Wrong %s(%v): got %v, want %v",
+						c.name, c.x, y, c.y)
+					break
+				}
+			}
+		}
+		x := c.inverse(y)
+		for i := range x {
+			if math.Abs(x[i]-c.x[i]) > 1e-9 {
+				t.Errorf("Wrong inverse of %s(%v): got %v",
+					c.name, c.x, x)
+				break
+			}
+		}
+		free := c.free
+		if free == nil {
+			free = func(y []float64) []float64 { return y }
+		}
+		if want := numLogJ(c.transform, free, c.x, c.ny); math.Abs(logj-want) > 1e-6 {
+			t.Errorf("Wrong log-Jacobian of %s(%v): got %.6g, want %.6g",
+				c.name, c.x, logj, want)
+		}
+	}
+}
+
+func TestCholeskyCorr(t *testing.T) {
+
+	const k = 4
+	x := []float64{0.5, -1, 0.3, 2, -0.7, 0.1}
+	y := make([]float64, k*k)
+	CholeskyCorr.Transform(y, x)
+	for i := 0; i != k; i++ {
+		norm := 0.
+		for j := 0; j != k; j++ {
+			if j > i && y[i*k+j] != 0 {
+				t.Errorf("Wrong L[%d][%d]: got %.4g, want 0",
+					i, j, y[i*k+j])
+			}
+			norm += y[i*k+j] * y[i*k+j]
+		}
+		if math.Abs(norm-1) > 1e-9 {
+			t.Errorf("Wrong length of row %d: got %.4g, want 1",
+				i, norm)
+		}
+	}
+}
+
+func TestUnitVector(t *testing.T) {
+	y := make([]float64, 2)
+	logj := UnitVector.Transform(y, []float64{3, 4})
+	if math.Abs(y[0]-0.6) > 1e-9 || math.Abs(y[1]-0.8) > 1e-9 {
+		t.Errorf("Wrong UnitVector([3 4]): got %v, want [0.6 0.8]", y)
+	}
+	if math.Abs(logj+12.5) > 1e-9 {
+		t.Errorf("Wrong UnitVector adjustment: got %.4g, want -12.5",
+			logj)
+	}
+}
+
+func numLogJ(
+	transform func(y, x []float64) float64,
+	free func(y []float64) []float64,
+	x []float64,
+	ny int,
+) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(nil)
+		defer ad.Pop()
+	}
+	const h = 1e-6
+	var jac [][]float64
+
+	jac = make([][]float64, len(x))
+	for j := range x {
+		var xp []float64
+
+		xp = append([]float64(nil), x...)
+		var xm []float64
+
+		xm = append([]float64(nil), x...)
+		ad.Assignment(&xp[j], ad.Arithmetic(ad.OpAdd, &xp[j], ad.Value(h)))
+		ad.Assignment(&xm[j], ad.Arithmetic(ad.OpSub, &xm[j], ad.Value(h)))
+		var yp []float64
+
+		yp = make([]float64, ny)
+		var ym []float64
+
+		ym = make([]float64, ny)
+		transform(yp, xp)
+		transform(ym, xm)
+		var (
+			fp []float64
+
+			fm []float64
+		)
+
+		fp, fm = free(yp), free(ym)
+		for i := range fp {
+			if jac[i] == nil {
+				jac[i] = make([]float64, len(x))
+			}
+			ad.Assignment(&jac[i][j], ad.Arithmetic(ad.OpDiv, (ad.Arithmetic(ad.OpSub, &fp[i], &fm[i])), (ad.Arithmetic(ad.OpMul, ad.Value(2), ad.Value(h)))))
+		}
+	}
+	return ad.Return(ad.Value(logAbsDet(jac)))
+}
+
+func logAbsDet(a [][]float64) float64 {
+	logdet := 0.
+	for k := range a {
+		p := k
+		for i := k + 1; i != len(a); i++ {
+			if math.Abs(a[i][k]) > math.Abs(a[p][k]) {
+				p = i
+			}
+		}
+		a[k], a[p] = a[p], a[k]
+		logdet += math.Log(math.Abs(a[k][k]))
+		for i := k + 1; i != len(a); i++ {
+			f := a[i][k] / a[k][k]
+			for j := k; j != len(a); j++ {
+				a[i][j] -= f * a[k][j]
+			}
+		}
+	}
+	return logdet
+}
@@ -0,0 +1,530 @@
+package dist
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/mathx"
+	"fmt"
+	"math"
+)
+
+var (
+	logpi, log2pi float64
+)
+
+func init() {
+	log2 := math.Log(2)
+	logpi = math.Log(math.Pi)
+	log2pi = log2 + logpi
+}
+
+type normal struct{}
+
+var Normal normal
+
+func (dist normal) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	var (
+		mu float64
+
+		sigma float64
+
+		y []float64
+	)
+
+	mu, sigma, y = x[0], x[1], x[2:]
+	if len(y) == 1 {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logp(_tape, 0, 0, 0)
+		}, 3, &mu, &sigma, &y[0]))
+	} else {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logps(_tape, 0, 0, y...)
+		}, 2, &mu, &sigma))
+	}
+}
+
+func (normal) Logp(_tape *ad.Tape, mu, sigma float64, y float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&mu, &sigma, &y)
+	} else {
+		panic("Logp called outside Observe")
+	}
+	var vari float64
+	_tape.Assignment(&vari, _tape.Arithmetic(ad.OpMul, &sigma, &sigma))
+	var logv float64
+	_tape.Assignment(&logv, _tape.Elemental(math.Log, &vari))
+	var d float64
+	_tape.Assignment(&d, _tape.Arithmetic(ad.OpSub, &y, &mu))
+	return _tape.Return(_tape.Arithmetic(ad.OpMul, _tape.Value(-0.5), (_tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpDiv, _tape.Arithmetic(ad.OpMul, &d, &d), &vari), &logv), &log2pi))))
+}
+
+func (normal) Logps(_tape *ad.Tape, mu, sigma float64, y ...float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&mu, &sigma)
+	} else {
+		panic("Logps called outside Observe")
+	}
+	var vari float64
+	_tape.Assignment(&vari, _tape.Arithmetic(ad.OpMul, &sigma, &sigma))
+	var logv float64
+	_tape.Assignment(&logv, _tape.Elemental(math.Log, &vari))
+	var ll float64
+	_tape.Assignment(&ll, _tape.Arithmetic(ad.OpMul, _tape.Arithmetic(ad.OpMul, _tape.Value(-0.5), (_tape.Arithmetic(ad.OpAdd, &logv, &log2pi))), _tape.Value(float64(len(y)))))
+	for i := range y {
+		var d float64
+		_tape.Assignment(&d, _tape.Arithmetic(ad.OpSub, &y[i], &mu))
+		_tape.Assignment(&ll, _tape.Arithmetic(ad.OpSub, &ll, _tape.Arithmetic(ad.OpDiv, _tape.Arithmetic(ad.OpMul, _tape.Arithmetic(ad.OpMul, _tape.Value(0.5), &d), &d), &vari)))
+	}
+	return _tape.Return(&ll)
+}
+
+type cauchy struct{}
+
+var Cauchy cauchy
+
+func (dist cauchy) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	var (
+		mu float64
+
+		sigma float64
+
+		y []float64
+	)
+
+	mu, sigma, y = x[0], x[1], x[2:]
+	if len(y) == 1 {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logp(_tape, 0, 0, 0)
+		}, 3, &mu, &sigma, &y[0]))
+	} else {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logps(_tape, 0, 0, y...)
+		}, 2, &mu, &sigma))
+	}
+}
+
+func (cauchy) Logp(_tape *ad.Tape, x0, gamma float64, y float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&x0, &gamma, &y)
+	} else {
+		panic("Logp called outside Observe")
+	}
+	var logGamma float64
+	_tape.Assignment(&logGamma, _tape.Elemental(math.Log, &gamma))
+	var d float64
+	_tape.Assignment(&d, _tape.Arithmetic(ad.OpDiv, (_tape.Arithmetic(ad.OpSub, &y, &x0)), &gamma))
+	return _tape.Return(_tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpNeg, &logGamma), &logpi), _tape.Elemental(math.Log, _tape.Arithmetic(ad.OpAdd, _tape.Value(1), _tape.Arithmetic(ad.OpMul, &d, &d)))))
+}
+
+func (cauchy) Logps(_tape *ad.Tape, x0, gamma float64, y ...float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&x0, &gamma)
+	} else {
+		panic("Logps called outside Observe")
+	}
+	var logGamma float64
+	_tape.Assignment(&logGamma, _tape.Elemental(math.Log, &gamma))
+	var ll float64
+	_tape.Assignment(&ll, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpNeg, &logGamma), &logpi)), _tape.Value(float64(len(y)))))
+	for i := range y {
+		var d float64
+		_tape.Assignment(&d, _tape.Arithmetic(ad.OpDiv, (_tape.Arithmetic(ad.OpSub, &y[i], &x0)), &gamma))
+		_tape.Assignment(&ll, _tape.Arithmetic(ad.OpSub, &ll, _tape.Elemental(math.Log, _tape.Arithmetic(ad.OpAdd, _tape.Value(1), _tape.Arithmetic(ad.OpMul, &d, &d)))))
+	}
+	return _tape.Return(&ll)
+}
+
+type expon struct{}
+
+var Expon expon
+
+func (dist expon) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	var (
+		lambda float64
+
+		y []float64
+	)
+
+	lambda, y = x[0], x[1:]
+	if len(y) == 1 {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logp(_tape, 0, 0)
+		}, 2, &lambda, &y[0]))
+	} else {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logps(_tape, 0, y...)
+		}, 1, &lambda))
+	}
+}
+
+func (expon) Logp(_tape *ad.Tape, lambda float64, y float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&lambda, &y)
+	} else {
+		panic("Logp called outside Observe")
+	}
+	var logl float64
+	_tape.Assignment(&logl, _tape.Elemental(math.Log, &lambda))
+	return _tape.Return(_tape.Arithmetic(ad.OpSub, &logl, _tape.Arithmetic(ad.OpMul, &lambda, &y)))
+}
+
+func (expon) Logps(_tape *ad.Tape, lambda float64, y ...float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&lambda)
+	} else {
+		panic("Logps called outside Observe")
+	}
+	var logl float64
+	_tape.Assignment(&logl, _tape.Elemental(math.Log, &lambda))
+	var ll float64
+	_tape.Assignment(&ll, _tape.Arithmetic(ad.OpMul, &logl, _tape.Value(float64(len(y)))))
+	for i := range y {
+		_tape.Assignment(&ll, _tape.Arithmetic(ad.OpSub, &ll, _tape.Arithmetic(ad.OpMul, &lambda, &y[i])))
+	}
+	return _tape.Return(&ll)
+}
+
+type gamma struct{}
+
+var Gamma gamma
+
+func (dist gamma) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	var (
+		alpha float64
+
+		beta float64
+
+		y []float64
+	)
+
+	alpha, beta, y = x[0], x[1], x[2:]
+	if len(y) == 1 {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logp(_tape, 0, 0, 0)
+		}, 3, &alpha, &beta, &y[0]))
+	} else {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logps(_tape, 0, 0, y...)
+		}, 2, &alpha, &beta))
+	}
+}
+
+func (gamma) Logp(_tape *ad.Tape, alpha, beta float64, y float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&alpha, &beta, &y)
+	} else {
+		panic("Logp called outside Observe")
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &alpha, _tape.Value(1))), _tape.Elemental(math.Log, &y)), _tape.Arithmetic(ad.OpMul, &beta, &y)), _tape.Elemental(mathx.LogGamma, &alpha)), _tape.Arithmetic(ad.OpMul, &alpha, _tape.Elemental(math.Log, &beta))))
+}
+
+func (gamma) Logps(_tape *ad.Tape, alpha, beta float64, y ...float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&alpha, &beta)
+	} else {
+		panic("Logps called outside Observe")
+	}
+	var ll float64
+	_tape.Assignment(&ll, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpNeg, _tape.Elemental(mathx.LogGamma, &alpha)), _tape.Arithmetic(ad.OpMul, &alpha, _tape.Elemental(math.Log, &beta)))), _tape.Value(float64(len(y)))))
+	for i := range y {
+		_tape.Assignment(&ll, _tape.Arithmetic(ad.OpAdd, &ll, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &alpha, _tape.Value(1))), _tape.Elemental(math.Log, &y[i])), _tape.Arithmetic(ad.OpMul, &beta, &y[i]))))
+	}
+	return _tape.Return(&ll)
+}
+
+type beta struct{}
+
+var Beta beta
+
+func (dist beta) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	var (
+		alpha float64
+
+		beta float64
+
+		y []float64
+	)
+
+	alpha, beta, y = x[0], x[1], x[2:]
+	if len(y) == 1 {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logp(_tape, 0, 0, 0)
+		}, 3, &alpha, &beta, &y[0]))
+	} else {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logps(_tape, 0, 0, y...)
+		}, 2, &alpha, &beta))
+	}
+}
+
+func (beta) Logp(_tape *ad.Tape, alpha, beta float64, y float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&alpha, &beta, &y)
+	} else {
+		panic("Logp called outside Observe")
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &alpha, _tape.Value(1))), _tape.Elemental(math.Log, &y)), _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &beta, _tape.Value(1))), _tape.Elemental(math.Log, _tape.Arithmetic(ad.OpSub, _tape.Value(1), &y)))), _tape.Elemental(mathx.LogGamma, &alpha)), _tape.Elemental(mathx.LogGamma, &beta)), _tape.Elemental(mathx.LogGamma, _tape.Arithmetic(ad.OpAdd, &alpha, &beta))))
+}
+
+func (beta) Logps(_tape *ad.Tape, alpha, beta float64, y ...float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&alpha, &beta)
+	} else {
+		panic("Logps called outside Observe")
+	}
+	var ll float64
+	_tape.Assignment(&ll, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpNeg, _tape.Elemental(mathx.LogGamma, &alpha)), _tape.Elemental(mathx.LogGamma, &beta)), _tape.Elemental(mathx.LogGamma, _tape.Arithmetic(ad.OpAdd, &alpha, &beta)))), _tape.Value(float64(len(y)))))
+	for i := range y {
+		_tape.Assignment(&ll, _tape.Arithmetic(ad.OpAdd, &ll, _tape.Arithmetic(ad.OpAdd, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &alpha, _tape.Value(1))), _tape.Elemental(math.Log, &y[i])), _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &beta, _tape.Value(1))), _tape.Elemental(math.Log, _tape.Arithmetic(ad.OpSub, _tape.Value(1), &y[i]))))))
+	}
+	return _tape.Return(&ll)
+}
+
+type Dirichlet struct {
+	N int
+}
+
+var Dir Dirichlet
+
+func (dist Dirichlet) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	var alpha []float64
+
+	alpha = x[:dist.N]
+	if len(x[dist.N:]) == dist.N {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logp(_tape, alpha, x[dist.N:])
+		}, 0))
+	} else {
+		var ys [][]float64
+
+		ys = make([][]float64, len(x[dist.N:])/dist.N)
+		for i := range ys {
+			ys[i] = x[dist.N*(i+1) : dist.N*(i+2)]
+		}
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logps(_tape, alpha, ys...)
+		}, 0))
+	}
+}
+
+func (dist Dirichlet) Logp(_tape *ad.Tape, alpha []float64, y []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Logp called outside Observe")
+	}
+	var sum float64
+	_tape.Assignment(&sum, _tape.Value(0.))
+	for j := range y {
+		_tape.Assignment(&sum, _tape.Arithmetic(ad.OpAdd, &sum, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &alpha[j], _tape.Value(1))), _tape.Elemental(math.Log, &y[j]))))
+	}
+
+	return _tape.Return(_tape.Arithmetic(ad.OpSub, &sum, _tape.Call(func(_ []float64) {
+		dist.logZ(_tape, alpha)
+	}, 0)))
+}
+
+func (dist Dirichlet) Logps(_tape *ad.Tape, alpha []float64, y ...[]float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Logps called outside Observe")
+	}
+	var logZ float64
+	_tape.Assignment(&logZ, _tape.Call(func(_ []float64) {
+		dist.logZ(_tape, alpha)
+	}, 0))
+	var ll float64
+	_tape.Assignment(&ll, _tape.Arithmetic(ad.OpMul, _tape.Arithmetic(ad.OpNeg, &logZ), _tape.Value(float64(len(y)))))
+	for i := range y {
+		for j := range alpha {
+			_tape.Assignment(&ll, _tape.Arithmetic(ad.OpAdd, &ll, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &alpha[j], _tape.Value(1))), _tape.Elemental(math.Log, &y[i][j]))))
+		}
+	}
+	return _tape.Return(&ll)
+}
+
+func (dist Dirichlet) logZ(_tape *ad.Tape, alpha []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("logZ called outside Observe")
+	}
+	var sumAlpha float64
+	_tape.Assignment(&sumAlpha, _tape.Value(0.))
+	var sumLogGammaAlpha float64
+	_tape.Assignment(&sumLogGammaAlpha, _tape.Value(0.))
+	for i := range alpha {
+		_tape.Assignment(&sumAlpha, _tape.Arithmetic(ad.OpAdd, &sumAlpha, &alpha[i]))
+		_tape.Assignment(&sumLogGammaAlpha, _tape.Arithmetic(ad.OpAdd, &sumLogGammaAlpha, _tape.Elemental(mathx.LogGamma, &alpha[i])))
+	}
+
+	return _tape.Return(_tape.Arithmetic(ad.OpSub, &sumLogGammaAlpha, _tape.Elemental(mathx.LogGamma, &sumAlpha)))
+}
+
+type Categorical struct {
+	N int
+}
+
+var Cat Categorical
+
+func (dist Categorical) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	if len(x) == dist.N+1 {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logp(_tape, x[:dist.N], 0)
+		}, 1, &x[dist.N]))
+	} else {
+		return _tape.Return(_tape.Call(func(_ []float64) {
+			dist.Logps(_tape, x[:dist.N], x[dist.N:]...)
+		}, 0))
+	}
+}
+
+func (dist Categorical) Logp(_tape *ad.Tape,
+	alpha []float64, y float64,
+) float64 {
+	if _tape.Called() {
+		_tape.Enter(&y)
+	} else {
+		panic("Logp called outside Observe")
+	}
+	var i int
+
+	i = int(y)
+	return _tape.Return(_tape.Arithmetic(ad.OpSub, _tape.Elemental(math.Log, &alpha[i]), _tape.Call(func(_ []float64) {
+		dist.logZ(_tape, alpha)
+	}, 0)))
+}
+
+func (dist Categorical) Logps(_tape *ad.Tape,
+	alpha []float64, y ...float64,
+) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Logps called outside Observe")
+	}
+	var logZ float64
+	_tape.Assignment(&logZ, _tape.Call(func(_ []float64) {
+		dist.logZ(_tape, alpha)
+	}, 0))
+	var ll float64
+	_tape.Assignment(&ll, _tape.Arithmetic(ad.OpMul, _tape.Arithmetic(ad.OpNeg, &logZ), _tape.Value(float64(len(y)))))
+	for i := range y {
+		_tape.Assignment(&ll, _tape.Arithmetic(ad.OpAdd, &ll, _tape.Elemental(math.Log, &alpha[int(y[i])])))
+	}
+	return _tape.Return(&ll)
+}
+
+func (dist Categorical) logZ(_tape *ad.Tape, alpha []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("logZ called outside Observe")
+	}
+	var z float64
+	_tape.Assignment(&z, _tape.Value(0.))
+	for _, a := range alpha {
+		_tape.Assignment(&z, _tape.Arithmetic(ad.OpAdd, &z, &a))
+	}
+	return _tape.Return(_tape.Elemental(math.Log, &z))
+}
+
+type d struct{}
+
+func (d) Observe(_tape *ad.Tape, _ []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup([]float64{})
+	}
+	panic("should never be called")
+}
+
+var D d
+
+func (d) SoftMax(_tape *ad.Tape, x, p []float64) {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("SoftMax called outside Observe")
+	}
+	if len(x) != len(p) {
+		panic(fmt.Sprintf("lengths of x and p are different: "+
+			"got len(x)=%v, len(p)=%v", len(x), len(p)))
+	}
+	var max float64
+	_tape.Assignment(&max, _tape.Value(math.Inf(-1)))
+	for i := range x {
+		if x[i] > max {
+			_tape.Assignment(&max, &x[i])
+		}
+	}
+	var z float64
+	_tape.Assignment(&z, _tape.Value(0.))
+	for i := range x {
+		var q float64
+		_tape.Assignment(&q, _tape.Elemental(math.Exp, _tape.Arithmetic(ad.OpSub, &x[i], &max)))
+		_tape.Assignment(&z, _tape.Arithmetic(ad.OpAdd, &z, &q))
+		_tape.Assignment(&p[i], &q)
+	}
+	for i := range p {
+		_tape.Assignment(&p[i], _tape.Arithmetic(ad.OpDiv, &p[i], &z))
+	}
+}
+
+func (d) LogSumExp(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("LogSumExp called outside Observe")
+	}
+	var max float64
+	_tape.Assignment(&max, _tape.Value(math.Inf(-1)))
+	for i := range x {
+		if x[i] > max {
+			_tape.Assignment(&max, &x[i])
+		}
+	}
+	var sumExp float64
+	_tape.Assignment(&sumExp, _tape.Value(0.))
+	for i := range x {
+		_tape.Assignment(&sumExp, _tape.Arithmetic(ad.OpAdd, &sumExp, _tape.Elemental(math.Exp, _tape.Arithmetic(ad.OpSub, &x[i], &max))))
+	}
+
+	return _tape.Return(_tape.Arithmetic(ad.OpAdd, &max, _tape.Elemental(math.Log, &sumExp)))
+}
@@ -0,0 +1,387 @@
+package dist
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/mathx"
+	"fmt"
+	"math"
+)
+
+type lower struct{}
+
+var Lower lower
+
+func (t lower) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, 0, make([]float64, len(x)-1), x[1:])
+	}, 1, &x[0]))
+}
+
+func (lower) Transform(_tape *ad.Tape, lo float64, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&lo)
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	_tape.Assignment(&logj, _tape.Value(0.))
+	for i := range x {
+		_tape.Assignment(&y[i], _tape.Arithmetic(ad.OpAdd, &lo, _tape.Elemental(math.Exp, &x[i])))
+		_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, &x[i]))
+	}
+	return _tape.Return(&logj)
+}
+
+func (lower) Inverse(lo float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(y[i] - lo)
+	}
+	return x
+}
+
+type upper struct{}
+
+var Upper upper
+
+func (t upper) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, 0, make([]float64, len(x)-1), x[1:])
+	}, 1, &x[0]))
+}
+
+func (upper) Transform(_tape *ad.Tape, hi float64, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&hi)
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	_tape.Assignment(&logj, _tape.Value(0.))
+	for i := range x {
+		_tape.Assignment(&y[i], _tape.Arithmetic(ad.OpSub, &hi, _tape.Elemental(math.Exp, &x[i])))
+		_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, &x[i]))
+	}
+	return _tape.Return(&logj)
+}
+
+func (upper) Inverse(hi float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(hi - y[i])
+	}
+	return x
+}
+
+type positive struct{}
+
+var Positive positive
+
+func (t positive) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, make([]float64, len(x)), x)
+	}, 0))
+}
+
+func (positive) Transform(_tape *ad.Tape, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	_tape.Assignment(&logj, _tape.Value(0.))
+	for i := range x {
+		_tape.Assignment(&y[i], _tape.Elemental(math.Exp, &x[i]))
+		_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, &x[i]))
+	}
+	return _tape.Return(&logj)
+}
+
+func (positive) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(y[i])
+	}
+	return x
+}
+
+type interval struct{}
+
+var Interval interval
+
+func (t interval) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, 0, 0, make([]float64, len(x)-2), x[2:])
+	}, 2, &x[0], &x[1]))
+}
+
+func (interval) Transform(_tape *ad.Tape, lo, hi float64, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter(&lo, &hi)
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logw float64
+	_tape.Assignment(&logw, _tape.Elemental(math.Log, _tape.Arithmetic(ad.OpSub, &hi, &lo)))
+	var logj float64
+	_tape.Assignment(&logj, _tape.Value(0.))
+	for i := range x {
+		_tape.Assignment(&y[i], _tape.Arithmetic(ad.OpAdd, &lo, _tape.Arithmetic(ad.OpMul, (_tape.Arithmetic(ad.OpSub, &hi, &lo)), _tape.Elemental(mathx.Sigm, &x[i]))))
+		_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpSub, &logw, _tape.Elemental(mathx.LogSumExp, _tape.Value(0), _tape.Arithmetic(ad.OpNeg, &x[i]))), _tape.Elemental(mathx.LogSumExp, _tape.Value(0), &x[i]))))
+	}
+	return _tape.Return(&logj)
+}
+
+func (interval) Inverse(lo, hi float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		p := (y[i] - lo) / (hi - lo)
+		x[i] = math.Log(p) - math.Log(1-p)
+	}
+	return x
+}
+
+type simplex struct{}
+
+var Simplex simplex
+
+func (t simplex) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, make([]float64, len(x)+1), x)
+	}, 0))
+}
+
+func (simplex) Transform(_tape *ad.Tape, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x)+1)
+	var logj float64
+	_tape.Assignment(&logj, _tape.Value(0.))
+	var stick float64
+	_tape.Assignment(&stick, _tape.Value(1.))
+	for k := range x {
+		var z float64
+		_tape.Assignment(&z, _tape.Arithmetic(ad.OpSub, &x[k], _tape.Elemental(math.Log, _tape.Value(float64(len(x)-k)))))
+		_tape.Assignment(&y[k], _tape.Arithmetic(ad.OpMul, &stick, _tape.Elemental(mathx.Sigm, &z)))
+		_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpSub, _tape.Elemental(math.Log, &stick), _tape.Elemental(mathx.LogSumExp, _tape.Value(0), _tape.Arithmetic(ad.OpNeg, &z))), _tape.Elemental(mathx.LogSumExp, _tape.Value(0), &z))))
+		_tape.Assignment(&stick, _tape.Arithmetic(ad.OpSub, &stick, &y[k]))
+	}
+	_tape.Assignment(&y[len(x)], &stick)
+	return _tape.Return(&logj)
+}
+
+func (simplex) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y)-1)
+	stick := y[len(x)]
+	for k := len(x) - 1; k >= 0; k-- {
+		stick += y[k]
+		p := y[k] / stick
+		x[k] = math.Log(p) - math.Log(1-p) +
+			math.Log(float64(len(x)-k))
+	}
+	return x
+}
+
+type ordered struct{}
+
+var Ordered ordered
+
+func (t ordered) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, make([]float64, len(x)), x)
+	}, 0))
+}
+
+func (ordered) Transform(_tape *ad.Tape, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var logj float64
+	_tape.Assignment(&logj, _tape.Value(0.))
+	for k := range x {
+		if k == 0 {
+			_tape.Assignment(&y[k], &x[k])
+		} else {
+			_tape.Assignment(&y[k], _tape.Arithmetic(ad.OpAdd, &y[k-1], _tape.Elemental(math.Exp, &x[k])))
+			_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, &x[k]))
+		}
+	}
+	return _tape.Return(&logj)
+}
+
+func (ordered) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y))
+	for k := range y {
+		if k == 0 {
+			x[k] = y[k]
+		} else {
+			x[k] = math.Log(y[k] - y[k-1])
+		}
+	}
+	return x
+}
+
+type unitVector struct{}
+
+var UnitVector unitVector
+
+func (t unitVector) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, make([]float64, len(x)), x)
+	}, 0))
+}
+
+func (unitVector) Transform(_tape *ad.Tape, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	checkLengths(len(y), len(x))
+	var r2 float64
+	_tape.Assignment(&r2, _tape.Value(0.))
+	for i := range x {
+		_tape.Assignment(&r2, _tape.Arithmetic(ad.OpAdd, &r2, _tape.Arithmetic(ad.OpMul, &x[i], &x[i])))
+	}
+	var r float64
+	_tape.Assignment(&r, _tape.Elemental(math.Sqrt, &r2))
+	for i := range x {
+		_tape.Assignment(&y[i], _tape.Arithmetic(ad.OpDiv, &x[i], &r))
+	}
+	return _tape.Return(_tape.Arithmetic(ad.OpMul, _tape.Value(-0.5), &r2))
+}
+
+func (unitVector) Inverse(y []float64) []float64 {
+	return append([]float64(nil), y...)
+}
+
+type choleskyCorr struct{}
+
+var CholeskyCorr choleskyCorr
+
+func (t choleskyCorr) Observe(_tape *ad.Tape, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	var k int
+
+	k = choleskyOrder(len(x))
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		t.Transform(_tape, make([]float64, k*k), x)
+	}, 0))
+}
+
+func (choleskyCorr) Transform(_tape *ad.Tape, y, x []float64) float64 {
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		panic("Transform called outside Observe")
+	}
+	var k int
+
+	k = choleskyOrder(len(x))
+	checkLengths(len(y), k*k)
+	var logj float64
+	_tape.Assignment(&logj, _tape.Value(0.))
+	var n int
+
+	n = 0
+	for i := 0; i != k; i = i + 1 {
+		var sumSqs float64
+		_tape.Assignment(&sumSqs, _tape.Value(0.))
+		for j := 0; j != i; j = j + 1 {
+			var z float64
+			_tape.Assignment(&z, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpMul, _tape.Value(2), _tape.Elemental(mathx.Sigm, _tape.Arithmetic(ad.OpMul, _tape.Value(2), &x[n]))), _tape.Value(1)))
+			_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpSub, _tape.Arithmetic(ad.OpMul, _tape.Value(2), _tape.Elemental(math.Log, _tape.Value(2))), _tape.Elemental(mathx.LogSumExp, _tape.Value(0), _tape.Arithmetic(ad.OpMul, _tape.Value(-2), &x[n]))), _tape.Elemental(mathx.LogSumExp, _tape.Value(0), _tape.Arithmetic(ad.OpMul, _tape.Value(2), &x[n])))))
+			n = n + 1
+			if j > 0 {
+				_tape.Assignment(&logj, _tape.Arithmetic(ad.OpAdd, &logj, _tape.Arithmetic(ad.OpMul, _tape.Value(0.5), _tape.Elemental(math.Log, _tape.Arithmetic(ad.OpSub, _tape.Value(1), &sumSqs)))))
+			}
+			_tape.Assignment(&y[i*k+j], _tape.Arithmetic(ad.OpMul, &z, _tape.Elemental(math.Sqrt, _tape.Arithmetic(ad.OpSub, _tape.Value(1), &sumSqs))))
+			_tape.Assignment(&sumSqs, _tape.Arithmetic(ad.OpAdd, &sumSqs, _tape.Arithmetic(ad.OpMul, &y[i*k+j], &y[i*k+j])))
+		}
+		_tape.Assignment(&y[i*k+i], _tape.Elemental(math.Sqrt, _tape.Arithmetic(ad.OpSub, _tape.Value(1), &sumSqs)))
+		for j := i + 1; j != k; j = j + 1 {
+			_tape.Assignment(&y[i*k+j], _tape.Value(0))
+		}
+	}
+	return _tape.Return(&logj)
+}
+
+func (choleskyCorr) Inverse(y []float64) []float64 {
+	k := int(math.Sqrt(float64(len(y))))
+	x := make([]float64, 0, k*(k-1)/2)
+	for i := 1; i < k; i++ {
+		sumSqs := 0.
+		for j := 0; j != i; j++ {
+			l := y[i*k+j]
+			x = append(x, math.Atanh(l/math.Sqrt(1-sumSqs)))
+			sumSqs += l * l
+		}
+	}
+	return x
+}
+
+func choleskyOrder(n int) int {
+	k := int(0.5 + math.Sqrt(0.25+2*float64(n)))
+	if k*(k-1)/2 != n {
+		panic(fmt.Sprintf("%d values do not form "+
+			"a Cholesky factor", n))
+	}
+	return k
+}
+
+func checkLengths(ly, lwant int) {
+	if ly != lwant {
+		panic(fmt.Sprintf("wrong number of constrained values: "+
+			"got %d, want %d", ly, lwant))
+	}
+}
@@ -0,0 +1,358 @@
+package dist
+
+// Transforms of constrained parameters
+
+// A transform maps unconstrained parameters x to constrained
+// values y, writing y and returning the logarithm of the
+// absolute value of the Jacobian determinant, log|dy/dx|.
+// The log-Jacobian must be added to the log-likelihood when a
+// prior is specified on the constrained values, for example
+//
+//	tau := make([]float64, 1)
+//	ll := Positive.Transform(tau, x[1:2])
+//	ll += Cauchy.Logp(0, 10, tau[0])
+//
+// Transform is differentiated and can be called inside
+// Observe. Inverse maps constrained values back to
+// unconstrained parameters, for initialization.
+
+import (
+	"bitbucket.org/dtolpin/infergo/mathx"
+	"fmt"
+	"math"
+)
+
+// Lower bounded transform
+type lower struct{}
+
+// Lower bounded transform, singleton instance
+var Lower lower
+
+// Observe implements the Model interface. The parameter
+// vector is lo, unconstrained values.
+func (t lower) Observe(x []float64) float64 {
+	return t.Transform(x[0], make([]float64, len(x)-1), x[1:])
+}
+
+// Transform computes y = lo + exp(x).
+func (lower) Transform(lo float64, y, x []float64) float64 {
+	checkLengths(len(y), len(x))
+	logj := 0.
+	for i := range x {
+		y[i] = lo + math.Exp(x[i])
+		logj += x[i]
+	}
+	return logj
+}
+
+// Inverse computes x = log(y - lo).
+func (lower) Inverse(lo float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(y[i] - lo)
+	}
+	return x
+}
+
+// Upper bounded transform
+type upper struct{}
+
+// Upper bounded transform, singleton instance
+var Upper upper
+
+// Observe implements the Model interface. The parameter
+// vector is hi, unconstrained values.
+func (t upper) Observe(x []float64) float64 {
+	return t.Transform(x[0], make([]float64, len(x)-1), x[1:])
+}
+
+// Transform computes y = hi - exp(x).
+func (upper) Transform(hi float64, y, x []float64) float64 {
+	checkLengths(len(y), len(x))
+	logj := 0.
+	for i := range x {
+		y[i] = hi - math.Exp(x[i])
+		logj += x[i]
+	}
+	return logj
+}
+
+// Inverse computes x = log(hi - y).
+func (upper) Inverse(hi float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(hi - y[i])
+	}
+	return x
+}
+
+// Positive transform
+type positive struct{}
+
+// Positive transform, singleton instance
+var Positive positive
+
+// Observe implements the Model interface. The parameter
+// vector is unconstrained values.
+func (t positive) Observe(x []float64) float64 {
+	return t.Transform(make([]float64, len(x)), x)
+}
+
+// Transform computes y = exp(x).
+func (positive) Transform(y, x []float64) float64 {
+	checkLengths(len(y), len(x))
+	logj := 0.
+	for i := range x {
+		y[i] = math.Exp(x[i])
+		logj += x[i]
+	}
+	return logj
+}
+
+// Inverse computes x = log(y).
+func (positive) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		x[i] = math.Log(y[i])
+	}
+	return x
+}
+
+// Interval (lower and upper bounded) transform
+type interval struct{}
+
+// Interval transform, singleton instance
+var Interval interval
+
+// Observe implements the Model interface. The parameter
+// vector is lo, hi, unconstrained values.
+func (t interval) Observe(x []float64) float64 {
+	return t.Transform(x[0], x[1], make([]float64, len(x)-2), x[2:])
+}
+
+// Transform computes y = lo + (hi - lo) sigm(x).
+func (interval) Transform(lo, hi float64, y, x []float64) float64 {
+	checkLengths(len(y), len(x))
+	logw := math.Log(hi - lo)
+	logj := 0.
+	for i := range x {
+		y[i] = lo + (hi-lo)*mathx.Sigm(x[i])
+		// log sigm(x) + log (1 - sigm(x)), robustly
+		logj += logw - mathx.LogSumExp(0, -x[i]) -
+			mathx.LogSumExp(0, x[i])
+	}
+	return logj
+}
+
+// Inverse computes x = logit((y - lo)/(hi - lo)).
+func (interval) Inverse(lo, hi float64, y []float64) []float64 {
+	x := make([]float64, len(y))
+	for i := range y {
+		p := (y[i] - lo) / (hi - lo)
+		x[i] = math.Log(p) - math.Log(1-p)
+	}
+	return x
+}
+
+// Simplex transform
+type simplex struct{}
+
+// Simplex transform, singleton instance
+var Simplex simplex
+
+// Observe implements the Model interface. The parameter
+// vector is unconstrained values.
+func (t simplex) Observe(x []float64) float64 {
+	return t.Transform(make([]float64, len(x)+1), x)
+}
+
+// Transform maps K-1 unconstrained values x to point y on the
+// K-simplex by stick-breaking. y[k] takes fraction
+// sigm(x[k] - log(K-1-k)) of the remaining stick, so that
+// x = 0 maps to the center of the simplex.
+func (simplex) Transform(y, x []float64) float64 {
+	checkLengths(len(y), len(x)+1)
+	logj := 0.
+	stick := 1.
+	for k := range x {
+		z := x[k] - math.Log(float64(len(x)-k))
+		y[k] = stick * mathx.Sigm(z)
+		logj += math.Log(stick) - mathx.LogSumExp(0, -z) -
+			mathx.LogSumExp(0, z)
+		stick -= y[k]
+	}
+	y[len(x)] = stick
+	return logj
+}
+
+// Inverse maps point y on the K-simplex to K-1 unconstrained
+// values.
+func (simplex) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y)-1)
+	stick := y[len(x)]
+	for k := len(x) - 1; k >= 0; k-- {
+		stick += y[k]
+		p := y[k] / stick
+		x[k] = math.Log(p) - math.Log(1-p) +
+			math.Log(float64(len(x)-k))
+	}
+	return x
+}
+
+// Ordered transform
+type ordered struct{}
+
+// Ordered transform, singleton instance
+var Ordered ordered
+
+// Observe implements the Model interface. The parameter
+// vector is unconstrained values.
+func (t ordered) Observe(x []float64) float64 {
+	return t.Transform(make([]float64, len(x)), x)
+}
+
+// Transform maps x to ascending y: y[0] = x[0],
+// y[k] = y[k-1] + exp(x[k]).
+func (ordered) Transform(y, x []float64) float64 {
+	checkLengths(len(y), len(x))
+	logj := 0.
+	for k := range x {
+		if k == 0 {
+			y[k] = x[k]
+		} else {
+			y[k] = y[k-1] + math.Exp(x[k])
+			logj += x[k]
+		}
+	}
+	return logj
+}
+
+// Inverse computes x[0] = y[0], x[k] = log(y[k] - y[k-1]).
+func (ordered) Inverse(y []float64) []float64 {
+	x := make([]float64, len(y))
+	for k := range y {
+		if k == 0 {
+			x[k] = y[k]
+		} else {
+			x[k] = math.Log(y[k] - y[k-1])
+		}
+	}
+	return x
+}
+
+// Unit vector transform
+type unitVector struct{}
+
+// Unit vector transform, singleton instance
+var UnitVector unitVector
+
+// Observe implements the Model interface. The parameter
+// vector is unconstrained values.
+func (t unitVector) Observe(x []float64) float64 {
+	return t.Transform(make([]float64, len(x)), x)
+}
+
+// Transform computes y = x/|x|. The transform is not
+// one-to-one, and instead of the log-Jacobian returns -|x|²/2,
+// the log-density of standard normal x up to a constant, which
+// makes the density of x proper.
+func (unitVector) Transform(y, x []float64) float64 {
+	checkLengths(len(y), len(x))
+	r2 := 0.
+	for i := range x {
+		r2 += x[i] * x[i]
+	}
+	r := math.Sqrt(r2)
+	for i := range x {
+		y[i] = x[i] / r
+	}
+	return -0.5 * r2
+}
+
+// Inverse returns a copy of unit vector y.
+func (unitVector) Inverse(y []float64) []float64 {
+	return append([]float64(nil), y...)
+}
+
+// Cholesky factor of correlation matrix transform
+type choleskyCorr struct{}
+
+// Cholesky factor of correlation matrix transform, singleton
+// instance
+var CholeskyCorr choleskyCorr
+
+// Observe implements the Model interface. The parameter
+// vector is unconstrained values.
+func (t choleskyCorr) Observe(x []float64) float64 {
+	k := choleskyOrder(len(x))
+	return t.Transform(make([]float64, k*k), x)
+}
+
+// Transform maps K(K-1)/2 unconstrained values x to the
+// Cholesky factor L of a K×K correlation matrix. L is stored
+// in y row by row, K×K elements, and is lower triangular with
+// unit-length rows. The values are mapped to canonical partial
+// correlations z = tanh(x), which determine the rows of L.
+func (choleskyCorr) Transform(y, x []float64) float64 {
+	k := choleskyOrder(len(x))
+	checkLengths(len(y), k*k)
+	logj := 0.
+	n := 0
+	for i := 0; i != k; i++ {
+		sumSqs := 0.
+		for j := 0; j != i; j++ {
+			// tanh(x) = 2 sigm(2x) - 1
+			z := 2*mathx.Sigm(2*x[n]) - 1
+			// log(1 - tanh(x)²), robustly
+			logj += 2*math.Log(2) - mathx.LogSumExp(0, -2*x[n]) -
+				mathx.LogSumExp(0, 2*x[n])
+			n++
+			if j > 0 {
+				logj += 0.5 * math.Log(1-sumSqs)
+			}
+			y[i*k+j] = z * math.Sqrt(1-sumSqs)
+			sumSqs += y[i*k+j] * y[i*k+j]
+		}
+		y[i*k+i] = math.Sqrt(1 - sumSqs)
+		for j := i + 1; j != k; j++ {
+			y[i*k+j] = 0
+		}
+	}
+	return logj
+}
+
+// Inverse maps the Cholesky factor of a correlation matrix,
+// stored row by row in y, to unconstrained values.
+func (choleskyCorr) Inverse(y []float64) []float64 {
+	k := int(math.Sqrt(float64(len(y))))
+	x := make([]float64, 0, k*(k-1)/2)
+	for i := 1; i < k; i++ {
+		sumSqs := 0.
+		for j := 0; j != i; j++ {
+			l := y[i*k+j]
+			x = append(x, math.Atanh(l/math.Sqrt(1-sumSqs)))
+			sumSqs += l * l
+		}
+	}
+	return x
+}
+
+// choleskyOrder returns K such that K(K-1)/2 = n, and panics
+// if there is no such K.
+func choleskyOrder(n int) int {
+	k := int(0.5 + math.Sqrt(0.25+2*float64(n)))
+	if k*(k-1)/2 != n {
+		panic(fmt.Sprintf("%d values do not form "+
+			"a Cholesky factor", n))
+	}
+	return k
+}
+
+// checkLengths panics if the number of constrained values is
+// wrong.
+func checkLengths(ly, lwant int) {
+	if ly != lwant {
+		panic(fmt.Sprintf("wrong number of constrained values: "+
+			"got %d, want %d", ly, lwant))
+	}
+}
@@ -50,19 +50,15 @@ func main() {
 	}
 
 	// Define the problem
-	m := &Model{
-		J:     8,
-		Y:     []float64{28, 8, -3, 7, -1, 1, 18, 12},
-		Sigma: []float64{15, 10, 16, 11, 9, 11, 10, 18},
-		Stau:  STAU,
-		Seta:  SETA,
-	}
-	x := make([]float64, 2+m.J)
+	m := New(
+		[]float64{28, 8, -3, 7, -1, 1, 18, 12},
+		[]float64{15, 10, 16, 11, 9, 11, 10, 18},
+		STAU, SETA)
+	p := m.Layout()
+	x := make([]float64, p.Len())
 
 	// Set a starting point
-	x[0] = rand.NormFloat64()
-	x[1] = rand.NormFloat64()
-	for i := 2; i != len(x); i++ {
+	for i := range x {
 		x[i] = rand.NormFloat64()
 	}
 	// Compute log-likelihood of the starting point,
@@ -91,9 +87,9 @@ func main() {
 		opt.Step(m, x)
 	}
 
-	mu := x[0]
-	tau := math.Exp(x[1])
-	eta := x[2:]
+	mu := p.Get(x, "mu")[0]
+	tau := math.Exp(p.Get(x, "logtau")[0])
+	eta := p.Get(x, "eta")
 	fmt.Printf("Finally:\n\tmu=%.4g\n\ttau=%.4g\n\teta=", mu, tau)
 	for _, eta := range eta {
 		fmt.Printf("%.4g ", eta)
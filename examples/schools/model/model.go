@@ -24,6 +24,7 @@ package model
 
 import (
 	. "bitbucket.org/dtolpin/infergo/dist"
+	"bitbucket.org/dtolpin/infergo/model"
 	"math"
 )
 
@@ -32,16 +33,39 @@ type Model struct {
 	Y          []float64 // estimated treatment effects
 	Sigma      []float64 // s.e. of effect estimates
 	Stau, Seta float64   // log variances of tau and eta priors
+	layout     model.Layout
+}
+
+// New returns the model for effects y with standard errors
+// sigma. The layout of the parameters, mu, logtau, eta[J], is
+// built once here rather than in Observe.
+func New(y, sigma []float64, stau, seta float64) *Model {
+	return &Model{
+		J:     len(y),
+		Y:     y,
+		Sigma: sigma,
+		Stau:  stau,
+		Seta:  seta,
+		layout: model.Layout{
+			{Name: "mu"},
+			{Name: "logtau"},
+			{Name: "eta", Size: len(y)},
+		},
+	}
+}
+
+// Layout returns the layout of the parameters.
+func (m *Model) Layout() model.Layout {
+	return m.layout
 }
 
 func (m *Model) Observe(x []float64) float64 {
-	//  There are m.J + 2 parameters:
-	// mu, logtau, eta[J]
-	mu := x[0]
-	tau := math.Exp(x[1])
-	eta := x[2:]
+	mu := m.layout.Get(x, "mu")[0]
+	logtau := m.layout.Get(x, "logtau")[0]
+	tau := math.Exp(logtau)
+	eta := m.layout.Get(x, "eta")
 
-	ll := Normal.Logp(0, m.Stau, x[1])
+	ll := Normal.Logp(0, m.Stau, logtau)
 	ll = Cauchy.Logp(0, 10, tau)
 	ll += Normal.Logps(0, m.Seta, eta...)
 	for i, y := range m.Y {
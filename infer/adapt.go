@@ -83,3 +83,186 @@ func (da *DepthAdapter) setDefaults() {
 		da.MinGrad = 0.01
 	}
 }
+
+// Adapter adapts parameters of HMC variants during sampling.
+// Adapt is called by the sampler, in the sampling goroutine,
+// after each iteration, with the step size, the mass matrix,
+// the sample and the acceptance statistic of the iteration.
+type Adapter interface {
+	Adapt(eps *float64, metric *Metric, x []float64, accept float64)
+}
+
+// Warmup is Stan-style windowed warmup
+// (https://mc-stan.org/docs/reference-manual/hmc-algorithm-parameters.html).
+// During the first NIter iterations, the step size is tuned by
+// dual averaging toward the target acceptance statistic, and
+// the mass matrix is estimated from sample variances in slow
+// windows of doubling size, between the initial and the
+// terminal buffers. Samples of warmup iterations should be
+// discarded. A Warmup adapts a single sampler.
+type Warmup struct {
+	// Parameters
+	NIter  int     // number of warmup iterations
+	Accept float64 // target acceptance statistic
+	Dense  bool    // estimate dense mass matrix
+	// Initial buffer, first slow window, terminal buffer
+	InitBuffer, Window, TermBuffer int
+	// Dual averaging: regularization scale, iteration offset,
+	// relaxation exponent
+	Gamma, T0, Kappa float64
+	// State
+	iter           int     // iteration
+	mu, hbar, xbar float64 // dual averaging
+	t              float64 // dual averaging iteration
+	window, end    int     // slow window size and end
+	n              float64 // samples in window
+	mean           []float64
+	m2             [][]float64 // sums of squared deviations
+}
+
+// Adapt implements Adapter.
+func (w *Warmup) Adapt(
+	eps *float64,
+	metric *Metric,
+	x []float64,
+	accept float64,
+) {
+	if w.iter == 0 {
+		w.setDefaults()
+		w.restart(*eps)
+		w.window = w.Window
+		w.nextWindow(w.InitBuffer)
+	}
+	if w.iter == w.NIter {
+		return
+	}
+	w.iter++
+
+	// Step size
+	w.t++
+	eta := 1 / (w.t + w.T0)
+	w.hbar = (1-eta)*w.hbar + eta*(w.Accept-accept)
+	logEps := w.mu - math.Sqrt(w.t)/w.Gamma*w.hbar
+	eta = math.Pow(w.t, -w.Kappa)
+	w.xbar = eta*logEps + (1-eta)*w.xbar
+	*eps = math.Exp(logEps)
+
+	// Mass matrix
+	if w.iter > w.InitBuffer && w.iter <= w.NIter-w.TermBuffer {
+		w.accumulate(x)
+		if w.iter == w.end {
+			if w.n > 1 {
+				*metric = w.metric()
+			}
+			w.n, w.mean, w.m2 = 0, nil, nil
+			w.window *= 2
+			w.nextWindow(w.iter)
+			w.restart(*eps)
+		}
+	}
+
+	if w.iter == w.NIter {
+		*eps = math.Exp(w.xbar)
+	}
+}
+
+// restart restarts dual averaging from step size eps.
+func (w *Warmup) restart(eps float64) {
+	w.mu = math.Log(10 * eps)
+	w.hbar, w.xbar, w.t = 0, 0, 0
+}
+
+// nextWindow computes the end of the slow window beginning
+// after iteration begin. If the following window would not
+// fit before the terminal buffer, the window is extended to
+// the terminal buffer.
+func (w *Warmup) nextWindow(begin int) {
+	last := w.NIter - w.TermBuffer
+	w.end = begin + w.window
+	if w.end+2*w.window > last {
+		w.end = last
+	}
+}
+
+// accumulate adds sample x to the variance estimate, by
+// Welford's algorithm.
+func (w *Warmup) accumulate(x []float64) {
+	if w.mean == nil {
+		w.mean = make([]float64, len(x))
+		w.m2 = make([][]float64, len(x))
+		for i := range w.m2 {
+			if w.Dense {
+				w.m2[i] = make([]float64, len(x))
+			} else {
+				w.m2[i] = make([]float64, 1)
+			}
+		}
+	}
+	w.n++
+	d := make([]float64, len(x))
+	for i := range x {
+		d[i] = x[i] - w.mean[i]
+		w.mean[i] += d[i] / w.n
+	}
+	for i := range x {
+		if w.Dense {
+			for j := range x {
+				w.m2[i][j] += d[i] * (x[j] - w.mean[j])
+			}
+		} else {
+			w.m2[i][0] += d[i] * (x[i] - w.mean[i])
+		}
+	}
+}
+
+// metric returns the mass matrix estimated from the window.
+// The variances are shrunk toward a small value for
+// stability, as in Stan.
+func (w *Warmup) metric() Metric {
+	n := w.n
+	shrink, reg := n/(n+5)/(n-1), 1e-3*5/(n+5)
+	if w.Dense {
+		invMass := make([][]float64, len(w.m2))
+		for i := range invMass {
+			invMass[i] = make([]float64, len(w.m2))
+			for j := range invMass[i] {
+				invMass[i][j] = shrink * w.m2[i][j]
+			}
+			invMass[i][i] += reg
+		}
+		return NewDenseMetric(invMass)
+	}
+	invMass := make([]float64, len(w.m2))
+	for i := range invMass {
+		invMass[i] = shrink*w.m2[i][0] + reg
+	}
+	return &DiagMetric{InvMass: invMass}
+}
+
+// setDefaults sets defaults for Warmup fields.
+func (w *Warmup) setDefaults() {
+	if w.NIter == 0 {
+		w.NIter = 1000
+	}
+	if w.Accept == 0 {
+		w.Accept = 0.8
+	}
+	if w.InitBuffer == 0 && w.Window == 0 && w.TermBuffer == 0 {
+		w.InitBuffer, w.Window, w.TermBuffer = 75, 25, 50
+		if w.InitBuffer+w.Window+w.TermBuffer > w.NIter {
+			// Too few iterations for the default windows.
+			w.InitBuffer = w.NIter * 15 / 100
+			w.TermBuffer = w.NIter / 10
+			w.Window = w.NIter - w.InitBuffer - w.TermBuffer
+		}
+	}
+	if w.Gamma == 0 {
+		w.Gamma = 0.05
+	}
+	if w.T0 == 0 {
+		w.T0 = 10
+	}
+	if w.Kappa == 0 {
+		w.Kappa = 0.75
+	}
+}
@@ -3,7 +3,9 @@ package infer
 // Testing adaptation.
 
 import (
+	"bitbucket.org/dtolpin/infergo/ad"
 	"math"
+	"math/rand"
 	"testing"
 )
 
@@ -23,3 +25,144 @@ func TestDualAveraging(t *testing.T) {
 		}
 	}
 }
+
+// A Gaussian with independent components of different scales.
+type scaledGauss struct {
+	scale []float64
+}
+
+func (m *scaledGauss) Observe(x []float64) float64 {
+	ad.Setup(x)
+	var ll float64
+	ad.Assignment(&ll, ad.Value(0))
+	for i := range x {
+		z := ad.Arithmetic(ad.OpDiv, &x[i], &m.scale[i])
+		ad.Assignment(&ll, ad.Arithmetic(ad.OpSub, &ll,
+			ad.Arithmetic(ad.OpMul, ad.Value(0.5),
+				ad.Arithmetic(ad.OpMul, z, z))))
+	}
+	return ad.Return(&ll)
+}
+
+// Warmup estimates the variances of a badly scaled model.
+func TestWarmup(t *testing.T) {
+	scale := []float64{10, 0.1}
+	for _, c := range []struct {
+		sampler func(w *Warmup) MCMC
+		dense   bool
+	}{
+		{
+			func(w *Warmup) MCMC {
+				return &HMC{
+					L:       10,
+					Eps:     0.1,
+					Adapter: w,
+					Rand:    rand.New(rand.NewSource(1)),
+				}
+			},
+			false,
+		},
+		{
+			func(w *Warmup) MCMC {
+				return &NUTS{
+					Eps:     0.1,
+					Adapter: w,
+					Rand:    rand.New(rand.NewSource(1)),
+				}
+			},
+			false,
+		},
+		{
+			func(w *Warmup) MCMC {
+				return &NUTS{
+					Eps:     0.1,
+					Adapter: w,
+					Rand:    rand.New(rand.NewSource(1)),
+				}
+			},
+			true,
+		},
+		{
+			func(w *Warmup) MCMC {
+				return &MNUTS{
+					Eps:     0.1,
+					Adapter: w,
+					Rand:    rand.New(rand.NewSource(1)),
+				}
+			},
+			false,
+		},
+	} {
+		w := &Warmup{NIter: 500, Dense: c.dense}
+		sampler := c.sampler(w)
+		m := &scaledGauss{scale}
+		samples := make(chan []float64)
+		sampler.Sample(m, []float64{1, 0.1}, samples)
+		for i := 0; i != w.NIter; i++ {
+			<-samples
+		}
+		sampler.Stop()
+		var metric Metric
+		var eps float64
+		switch sampler := sampler.(type) {
+		case *HMC:
+			metric, eps = sampler.Metric, sampler.Eps
+		case *NUTS:
+			metric, eps = sampler.Metric, sampler.Eps
+		case *MNUTS:
+			metric, eps = sampler.Metric, sampler.Eps
+		}
+		var variance []float64
+		switch metric := metric.(type) {
+		case *DiagMetric:
+			variance = metric.InvMass
+		case *DenseMetric:
+			variance = []float64{
+				metric.InvMass()[0][0], metric.InvMass()[1][1]}
+		default:
+			t.Fatalf("%T: mass matrix not adapted", sampler)
+		}
+		for i := range scale {
+			ratio := variance[i] / (scale[i] * scale[i])
+			if ratio < 0.5 || ratio > 2 {
+				t.Errorf("%T, dense=%v: wrong variance estimate: "+
+					"got %.4g, want %.4g", sampler, c.dense,
+					variance[i], scale[i]*scale[i])
+			}
+		}
+		if !(eps > 0) {
+			t.Errorf("%T, dense=%v: invalid step size %.4g",
+				sampler, c.dense, eps)
+		}
+	}
+}
+
+// RWM adapts the proposal covariance to the covariance of the
+// target by default.
+func TestRWMAdapt(t *testing.T) {
+	scale := []float64{3, 0.3}
+	rwm := &RWM{Rand: rand.New(rand.NewSource(1))}
+	m := &scaledGauss{scale}
+	samples := make(chan []float64)
+	rwm.Sample(m, []float64{0, 0}, samples)
+	<-samples
+	niter := rwm.NAdapt
+	for i := 1; i != niter; i++ {
+		<-samples
+	}
+	rwm.Stop()
+	if niter == 0 || rwm.chol == nil {
+		t.Fatalf("proposal not adapted")
+	}
+	for i := range scale {
+		variance := 0.
+		for j := 0; j <= i; j++ {
+			variance += rwm.chol[i][j] * rwm.chol[i][j]
+		}
+		ratio := variance / (scale[i] * scale[i])
+		if ratio < 0.5 || ratio > 2 {
+			t.Errorf("wrong variance estimate: got %.4g, want %.4g",
+				variance, scale[i]*scale[i])
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package infer
+
+// Automatic differentiation variational inference.
+
+import (
+	"bitbucket.org/dtolpin/infergo/model"
+	"math"
+	"math/rand"
+)
+
+// ADVI is automatic differentiation variational inference
+// (https://arxiv.org/abs/1603.00788). The posterior is
+// approximated by a Gaussian, with diagonal covariance
+// (mean-field) or, if FullRank is true, with full covariance.
+// The evidence lower bound (ELBO) is maximized by a
+// gradient-based optimizer, using Monte Carlo estimates of the
+// gradient by the reparameterization trick. Constrained
+// parameters must be transformed to the real line (see
+// dist.Positive and other transforms).
+type ADVI struct {
+	FullRank bool // approximate by a Gaussian with full covariance
+	NDraws   int  // draws per estimate of the ELBO, 1 by default
+	// Optimizer of the variational parameters, a new Adam
+	// with learning rate 0.01 for each fit if nil.
+	Opt Grad
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
+}
+
+// Fit runs niter iterations of optimization of the ELBO,
+// starting from the Gaussian centered at x with the identity
+// covariance, and returns the approximation of the posterior
+// and the estimate of the ELBO at each iteration.
+func (advi *ADVI) Fit(
+	m model.Model,
+	x []float64,
+	niter int,
+) (q *Gaussian, elbos []float64) {
+	advi.setDefaults()
+	e := &elbo{
+		m:        m,
+		rng:      advi.Rand,
+		ndraws:   advi.NDraws,
+		fullRank: advi.FullRank,
+		eta:      make([]float64, len(x)),
+		theta:    make([]float64, len(x)),
+		gtheta:   make([]float64, len(x)),
+	}
+	phi := e.init(x)
+	e.grad = make([]float64, len(phi))
+	opt := advi.Opt
+	if opt == nil {
+		opt = &Adam{Rate: 0.01}
+	}
+	elbos = make([]float64, niter)
+	for iter := range elbos {
+		elbos[iter], _ = opt.Step(e, phi)
+	}
+	return e.gaussian(phi), elbos
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (advi *ADVI) setDefaults() {
+	if advi.NDraws == 0 {
+		advi.NDraws = 1
+	}
+	advi.Rand = defaultRand(advi.Rand)
+}
+
+// elbo is the ELBO as an elemental model of the variational
+// parameters, so that the ELBO can be maximized by any Grad.
+// The variational parameters are the mean followed by either
+// the logarithms of the standard deviations (mean-field) or
+// the lower triangle of the Cholesky factor of the covariance,
+// row by row (full-rank).
+type elbo struct {
+	m        model.Model
+	rng      *rand.Rand
+	ndraws   int
+	fullRank bool
+	// Buffers
+	eta, theta, gtheta []float64
+	grad               []float64
+}
+
+// init returns the initial variational parameters, of the
+// Gaussian centered at x with the identity covariance.
+func (e *elbo) init(x []float64) []float64 {
+	phi := append([]float64(nil), x...)
+	if !e.fullRank {
+		return append(phi, make([]float64, len(x))...)
+	}
+	for i := range x {
+		for j := 0; j <= i; j++ {
+			if i == j {
+				phi = append(phi, 1)
+			} else {
+				phi = append(phi, 0)
+			}
+		}
+	}
+	return phi
+}
+
+// Observe estimates the ELBO at variational parameters phi,
+// and stores the gradient estimate.
+func (e *elbo) Observe(phi []float64) float64 {
+	d := len(e.theta)
+	mu, omega := phi[:d], phi[d:]
+	for i := range e.grad {
+		e.grad[i] = 0
+	}
+
+	// Expected log density, by the reparameterization trick.
+	ll := 0.
+	for n := 0; n != e.ndraws; n++ {
+		for i := range e.eta {
+			e.eta[i] = e.rng.NormFloat64()
+		}
+		k := 0
+		for i := range e.theta {
+			e.theta[i] = mu[i]
+			if e.fullRank {
+				for j := 0; j <= i; j++ {
+					e.theta[i] += omega[k] * e.eta[j]
+					k++
+				}
+			} else {
+				e.theta[i] += math.Exp(omega[i]) * e.eta[i]
+			}
+		}
+		ll += e.m.Observe(e.theta)
+		model.GradientInto(e.m, e.gtheta)
+		k = d
+		for i, g := range e.gtheta {
+			e.grad[i] += g
+			if e.fullRank {
+				for j := 0; j <= i; j++ {
+					e.grad[k] += g * e.eta[j]
+					k++
+				}
+			} else {
+				e.grad[d+i] += g * e.eta[i] * math.Exp(omega[i])
+			}
+		}
+	}
+	ll /= float64(e.ndraws)
+	for i := range e.grad {
+		e.grad[i] /= float64(e.ndraws)
+	}
+
+	// Entropy of the Gaussian, analytically.
+	ll += 0.5 * float64(d) * (1 + math.Log(2*math.Pi))
+	k := 0
+	for i := 0; i != d; i++ {
+		if e.fullRank {
+			k += i // the diagonal element of row i
+			ll += math.Log(math.Abs(omega[k]))
+			e.grad[d+k] += 1 / omega[k]
+			k++
+		} else {
+			ll += omega[i]
+			e.grad[d+i]++
+		}
+	}
+	return ll
+}
+
+// Gradient returns the gradient estimate of the last call to
+// Observe.
+func (e *elbo) Gradient() []float64 {
+	return e.grad
+}
+
+// gaussian returns the Gaussian with variational parameters
+// phi.
+func (e *elbo) gaussian(phi []float64) *Gaussian {
+	d := len(e.theta)
+	q := &Gaussian{
+		Mean: append([]float64(nil), phi[:d]...),
+		Chol: make([][]float64, d),
+	}
+	k := d
+	for i := range q.Chol {
+		q.Chol[i] = make([]float64, d)
+		if e.fullRank {
+			copy(q.Chol[i], phi[k:k+i+1])
+			k += i + 1
+		} else {
+			q.Chol[i][i] = math.Exp(phi[d+i])
+		}
+	}
+	// The sign of a column of the factor does not affect the
+	// covariance; make the diagonal positive.
+	for j := range q.Chol {
+		if q.Chol[j][j] < 0 {
+			for i := j; i != d; i++ {
+				q.Chol[i][j] = -q.Chol[i][j]
+			}
+		}
+	}
+	return q
+}
+
+// Gaussian is a multivariate normal approximation of the
+// posterior.
+type Gaussian struct {
+	Mean []float64
+	// Lower-triangular Cholesky factor of the covariance
+	Chol [][]float64
+}
+
+// Sample draws a sample from the Gaussian.
+func (q *Gaussian) Sample(rng *rand.Rand) []float64 {
+	rng = defaultRand(rng)
+	eta := make([]float64, len(q.Mean))
+	for i := range eta {
+		eta[i] = rng.NormFloat64()
+	}
+	x := append([]float64(nil), q.Mean...)
+	for i := range x {
+		for j := 0; j <= i; j++ {
+			x[i] += q.Chol[i][j] * eta[j]
+		}
+	}
+	return x
+}
+
+// Cov returns the covariance matrix.
+func (q *Gaussian) Cov() [][]float64 {
+	cov := make([][]float64, len(q.Chol))
+	for i := range cov {
+		cov[i] = make([]float64, len(q.Chol))
+		for j := range cov[i] {
+			for k := 0; k <= i && k <= j; k++ {
+				cov[i][j] += q.Chol[i][k] * q.Chol[j][k]
+			}
+		}
+	}
+	return cov
+}
+
+// StdDev returns the marginal standard deviations.
+func (q *Gaussian) StdDev() []float64 {
+	sd := make([]float64, len(q.Chol))
+	for i := range sd {
+		for j := 0; j <= i; j++ {
+			sd[i] += q.Chol[i][j] * q.Chol[i][j]
+		}
+		sd[i] = math.Sqrt(sd[i])
+	}
+	return sd
+}
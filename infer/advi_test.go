@@ -0,0 +1,140 @@
+package infer
+
+// Testing variational inference.
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// A multivariate Gaussian with the given mean and precision
+// matrix.
+type gaussModel struct {
+	mean []float64
+	prec [][]float64
+}
+
+func (m *gaussModel) Observe(x []float64) float64 {
+	ad.Setup(x)
+	d := make([]float64, len(x))
+	for i := range x {
+		ad.Assignment(&d[i], ad.Arithmetic(ad.OpSub,
+			&x[i], ad.Value(m.mean[i])))
+	}
+	var ll float64
+	ad.Assignment(&ll, ad.Value(0))
+	for i := range x {
+		for j := range x {
+			ad.Assignment(&ll, ad.Arithmetic(ad.OpSub, &ll,
+				ad.Arithmetic(ad.OpMul, ad.Value(0.5*m.prec[i][j]),
+					ad.Arithmetic(ad.OpMul, &d[i], &d[j]))))
+		}
+	}
+	return ad.Return(&ll)
+}
+
+// The covariance of the Gaussian model is [[1, 0.8], [0.8, 1]];
+// the mean-field approximation has the standard deviations
+// 1/sqrt(prec[i][i]) = 0.6.
+var testGauss = &gaussModel{
+	mean: []float64{1, -2},
+	prec: [][]float64{
+		{1 / 0.36, -0.8 / 0.36},
+		{-0.8 / 0.36, 1 / 0.36},
+	},
+}
+
+func TestADVI(t *testing.T) {
+	for _, c := range []struct {
+		fullRank bool
+		cov      [][]float64
+	}{
+		{false, [][]float64{{0.36, 0}, {0, 0.36}}},
+		{true, [][]float64{{1, 0.8}, {0.8, 1}}},
+	} {
+		advi := &ADVI{
+			FullRank: c.fullRank,
+			NDraws:   10,
+			Opt:      &Adam{Rate: 0.005},
+			Rand:     rand.New(rand.NewSource(1)),
+		}
+		q, elbos := advi.Fit(testGauss, []float64{0, 0}, 4000)
+		if len(elbos) != 4000 {
+			t.Errorf("wrong number of ELBO estimates: "+
+				"got %d, want 4000", len(elbos))
+		}
+		// The ELBO increases toward the log normalizing
+		// constant of the model.
+		logZ := math.Log(2 * math.Pi * 0.6)
+		last := 0.
+		for _, e := range elbos[len(elbos)-100:] {
+			last += e / 100
+		}
+		if !(elbos[0] < last && last <= logZ+0.05) {
+			t.Errorf("FullRank=%v: wrong ELBO: first %.4g, "+
+				"last %.4g, log Z %.4g",
+				c.fullRank, elbos[0], last, logZ)
+		}
+		for i := range q.Mean {
+			if math.Abs(q.Mean[i]-testGauss.mean[i]) > 0.1 {
+				t.Errorf("FullRank=%v: wrong mean: got %v, want %v",
+					c.fullRank, q.Mean, testGauss.mean)
+				break
+			}
+		}
+		cov := q.Cov()
+		for i := range cov {
+			for j := range cov {
+				if math.Abs(cov[i][j]-c.cov[i][j]) > 0.1 {
+					t.Errorf("FullRank=%v: wrong covariance: "+
+						"got %v, want %v", c.fullRank, cov, c.cov)
+				}
+			}
+		}
+	}
+}
+
+func TestGaussian(t *testing.T) {
+	q := &Gaussian{
+		Mean: []float64{1, -1},
+		Chol: [][]float64{{2, 0}, {1, 1}},
+	}
+	cov := q.Cov()
+	want := [][]float64{{4, 2}, {2, 2}}
+	for i := range cov {
+		for j := range cov {
+			if cov[i][j] != want[i][j] {
+				t.Errorf("wrong covariance: got %v, want %v",
+					cov, want)
+			}
+		}
+	}
+	sd := q.StdDev()
+	if sd[0] != 2 || math.Abs(sd[1]-math.Sqrt(2)) > 1e-12 {
+		t.Errorf("wrong standard deviations: got %v", sd)
+	}
+	// The empirical mean and covariance approach those of
+	// the Gaussian.
+	rng := rand.New(rand.NewSource(1))
+	n := 20000
+	mean := make([]float64, 2)
+	m2 := make([]float64, 3)
+	for i := 0; i != n; i++ {
+		x := q.Sample(rng)
+		mean[0] += x[0] / float64(n)
+		mean[1] += x[1] / float64(n)
+		m2[0] += (x[0] - 1) * (x[0] - 1) / float64(n)
+		m2[1] += (x[0] - 1) * (x[1] + 1) / float64(n)
+		m2[2] += (x[1] + 1) * (x[1] + 1) / float64(n)
+	}
+	if math.Abs(mean[0]-1) > 0.05 || math.Abs(mean[1]+1) > 0.05 {
+		t.Errorf("wrong sample mean: got %v, want %v",
+			mean, q.Mean)
+	}
+	if math.Abs(m2[0]-4) > 0.2 || math.Abs(m2[1]-2) > 0.1 ||
+		math.Abs(m2[2]-2) > 0.1 {
+		t.Errorf("wrong sample covariance: got %v", m2)
+	}
+}
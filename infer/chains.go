@@ -0,0 +1,157 @@
+package infer
+
+// Running multiple MCMC chains in parallel.
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/model"
+	"math/rand"
+	"sync"
+)
+
+// ChainSample is a sample labeled with the chain which
+// produced it.
+type ChainSample struct {
+	Chain int       // chain index
+	X     []float64 // sample
+}
+
+// ChainStats are the statistics of a single chain.
+type ChainStats struct {
+	NAcc, NRej int   // the number of accepted and rejected samples
+	NDiv       int   // the number of divergent transitions
+	Err        error // the error which terminated the chain
+}
+
+// Chains runs several chains of an MCMC sampler in parallel.
+// Each chain has its own sampler and random source, and
+// starts from its own initial point.
+type Chains struct {
+	// Parameters
+	N       int         // number of chains
+	Sampler func() MCMC // returns a new sampler for each chain
+	// Model, if not nil, returns the model for chain i;
+	// otherwise all chains share the model passed to Sample.
+	// Models carrying their own tape (see model.Taped) must
+	// not be shared between chains.
+	Model func(i int) model.Model
+	// The random source of chain i is seeded with Seed + i,
+	// and used for the initial point and by the sampler,
+	// unless the sampler has its own random number generator.
+	Seed int64
+	// The initial point of each chain is the initial point
+	// passed to Sample, perturbed by Gaussian noise with
+	// standard deviation Jitter.
+	Jitter float64
+	// Chain samplers, available after the call to Sample
+	Samplers []MCMC
+	done     chan struct{}
+}
+
+// randomized is implemented by samplers with a random number
+// generator.
+type randomized interface {
+	setRand(rng *rand.Rand)
+}
+
+// statistics is implemented by samplers embedding sampler.
+type statistics interface {
+	chainStats() ChainStats
+}
+
+// chainStats returns the statistics of the sampler.
+func (s *sampler) chainStats() ChainStats {
+	return ChainStats{s.NAcc, s.NRej, s.NDiv, s.err}
+}
+
+// Sample starts the chains and writes samples of all chains,
+// labeled with the chain index, to samples. samples is closed
+// when all chains terminate. Models which do not carry
+// their own tape (see model.Taped) are differentiated
+// concurrently, and Sample turns on thread-safe tapes
+// through ad.MTSafeOn; Sample panics if thread-safe tapes are
+// not supported.
+func (c *Chains) Sample(
+	m model.Model,
+	x []float64,
+	samples chan ChainSample,
+) {
+	c.setDefaults()
+	c.done = make(chan struct{})
+	c.Samplers = make([]MCMC, c.N)
+	var wg sync.WaitGroup
+	wg.Add(c.N)
+	for i := range c.Samplers {
+		mi := m
+		if c.Model != nil {
+			mi = c.Model(i)
+		}
+		if _, ok := mi.(model.Taped); !ok &&
+			!ad.IsMTSafe() && !ad.MTSafeOn() {
+			panic("thread-safe tapes are not supported")
+		}
+		rng := rand.New(rand.NewSource(c.Seed + int64(i)))
+		xi := clone(x)
+		for j := range xi {
+			xi[j] += c.Jitter * rng.NormFloat64()
+		}
+		c.Samplers[i] = c.Sampler()
+		if s, ok := c.Samplers[i].(randomized); ok {
+			s.setRand(rng)
+		}
+		chain := make(chan []float64)
+		c.Samplers[i].Sample(mi, xi, chain)
+		go func(i int) {
+			defer wg.Done()
+			for x := range chain {
+				// The sampler may update x in place
+				// after sending it.
+				select {
+				case samples <- ChainSample{i, clone(x)}:
+				case <-c.done:
+					// Stopped, the sampler exhausts the
+					// chain.
+					return
+				}
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(samples)
+	}()
+}
+
+// Stop stops all chains. As with MCMC samplers, Stop must be
+// called before further calls to differentiated code, and may
+// be called more than once.
+func (c *Chains) Stop() {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	for _, s := range c.Samplers {
+		s.Stop()
+	}
+}
+
+// Stats returns the statistics of each chain. Samplers
+// which do not embed the statistics have zero statistics.
+// Stats should be called after the chains are stopped.
+func (c *Chains) Stats() []ChainStats {
+	stats := make([]ChainStats, len(c.Samplers))
+	for i, s := range c.Samplers {
+		if s, ok := s.(statistics); ok {
+			stats[i] = s.chainStats()
+		}
+	}
+	return stats
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (c *Chains) setDefaults() {
+	if c.N == 0 {
+		c.N = 4
+	}
+}
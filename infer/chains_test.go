@@ -0,0 +1,93 @@
+package infer
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Each chain must produce samples, and the chains must agree
+// on the posterior.
+func TestChains(t *testing.T) {
+	nattempts := 10
+	niter := 100
+	prec := 1e-1
+	for _, c := range []struct {
+		sampler func() MCMC
+	}{
+		{
+			func() MCMC {
+				return &HMC{
+					L:   5,
+					Eps: 0.1,
+				}
+			},
+		},
+		{
+			func() MCMC {
+				return &NUTS{
+					Eps: 0.1,
+				}
+			},
+		},
+	} {
+		if !repeatedly(nattempts,
+			func() bool {
+				chains := &Chains{
+					N:       4,
+					Sampler: c.sampler,
+					Seed:    rand.Int63(),
+					Jitter:  0.1,
+				}
+				m := &testModel{testData}
+				samples := make(chan ChainSample)
+				chains.Sample(m, []float64{0, 0}, samples)
+				means := make([]float64, chains.N)
+				stddevs := make([]float64, chains.N)
+				counts := make([]int, chains.N)
+				for i := 0; i != 2*niter*chains.N; i++ {
+					s := <-samples
+					counts[s.Chain]++
+					if counts[s.Chain] > niter {
+						// Collect after burn-in.
+						means[s.Chain] += s.X[0]
+						stddevs[s.Chain] += math.Exp(s.X[1])
+					}
+				}
+				chains.Stop()
+				for range samples {
+					// Wait until the chains terminate.
+				}
+				// Stopping again has no effect.
+				chains.Stop()
+				for i, stats := range chains.Stats() {
+					if stats.NAcc+stats.NRej < counts[i] {
+						t.Errorf("chain %d: %d samples, "+
+							"%d accepted, %d rejected",
+							i, counts[i], stats.NAcc, stats.NRej)
+					}
+				}
+				// Pool the chains.
+				mean, stddev, n := 0., 0., 0.
+				for i := range means {
+					if counts[i] <= niter {
+						return false
+					}
+					mean += means[i]
+					stddev += stddevs[i]
+					n += float64(counts[i] - niter)
+				}
+				mean, stddev = mean/n, stddev/n
+				if math.Abs((mean-testMean)/
+					(mean+testMean)) > prec ||
+					math.Abs((stddev-testStddev)/
+						(stddev+testStddev)) > prec {
+					return false
+				}
+				return true
+			},
+			true) {
+			t.Errorf("%T chains did not converge", c.sampler())
+		}
+	}
+}
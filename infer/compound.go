@@ -0,0 +1,256 @@
+package infer
+
+// Compound sampling of discrete and continuous parameters.
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/model"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Compound samples from models with discrete parameters (see
+// model.DiscreteModel). Each iteration first applies the
+// updates of the discrete parameters, in order, given the
+// continuous parameters, and then a single iteration of the
+// continuous sampler given the discrete parameters. Each
+// sample consists of the continuous parameters followed by the
+// discrete parameters converted to float64.
+type Compound struct {
+	sampler
+	// Sampler of the continuous parameters: HMC, NUTS, MNUTS,
+	// SgHMC, RWM, or Slice. Acceptance statistics of the continuous
+	// sampler are reported by Compound.
+	Continuous MCMC
+	// Updates of the discrete parameters
+	Updates []DiscreteUpdate
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
+	// Stats, see HMC.Stats. If Stats of the continuous sampler
+	// is set, the statistics of its iterations are read by
+	// Compound and forwarded to Stats, or discarded if Stats
+	// is nil.
+	Stats chan Stats
+}
+
+// DiscreteUpdate updates the discrete parameters of model m
+// given continuous parameters x.
+type DiscreteUpdate interface {
+	Update(rng *rand.Rand, m model.DiscreteModel, x []float64)
+}
+
+// gated is implemented by samplers embedding sampler.
+type gated interface {
+	setGate(gate chan struct{})
+	statsChan() chan Stats
+}
+
+func (c *Compound) Sample(
+	m model.Model,
+	x []float64,
+	samples chan []float64,
+) {
+	c.setDefaults()
+	c.start(samples, c.Stats)
+	dm, ok := m.(model.DiscreteModel)
+	if !ok {
+		panic("model must implement model.DiscreteModel")
+	}
+	g, ok := c.Continuous.(gated)
+	if !ok {
+		panic(fmt.Sprintf("cannot compound %T", c.Continuous))
+	}
+	gate := make(chan struct{})
+	g.setGate(gate)
+	continuous := make(chan []float64)
+	c.Continuous.Sample(m, x, continuous)
+	cstats := g.statsChan()
+	go func() {
+		// On exit:
+		// * close samples, after the tape is dropped so that
+		// Stop returns when the sampler is done with the tape;
+		defer close(samples)
+		// * close stats;
+		defer c.closeStats()
+		// * drop the tape;
+		defer ad.DropTape()
+		// * stop the continuous sampler, which waits for
+		// the next iteration;
+		defer c.Continuous.Stop()
+		// * intercept errors deep inside the algorithm
+		// and report them.
+		defer c.intercept("Compound")
+
+		x := clone(x)
+		for {
+			if c.stopped() {
+				break
+			}
+
+			// Update the discrete parameters.
+			for _, u := range c.Updates {
+				u.Update(c.Rand, dm, x)
+			}
+
+			// Let the continuous sampler run a single
+			// iteration. The samplers alternate and never
+			// run the model concurrently.
+			select {
+			case gate <- struct{}{}:
+			case <-c.stop:
+				return
+			}
+			var ok bool
+			x, ok = <-continuous
+			if !ok {
+				c.err = samplerErr(c.Continuous)
+				break
+			}
+			// The continuous sampler reports the statistics
+			// after the sample, and may run the model to
+			// compute them.
+			var st Stats
+			if cstats != nil {
+				st, ok = <-cstats
+				if !ok {
+					c.err = samplerErr(c.Continuous)
+					break
+				}
+			}
+			if s, ok := c.Continuous.(statistics); ok {
+				stats := s.chainStats()
+				c.NAcc, c.NRej, c.NDiv = stats.NAcc, stats.NRej, stats.NDiv
+			}
+
+			// Write a sample to the channel.
+			z := dm.Discrete()
+			sample := make([]float64, len(x)+len(z))
+			copy(sample, x)
+			for i := range z {
+				sample[len(x)+i] = float64(z[i])
+			}
+			samples <- sample
+			if cstats != nil {
+				c.report(st)
+			}
+		}
+	}()
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (c *Compound) setDefaults() {
+	c.Rand = defaultRand(c.Rand)
+}
+
+// setRand sets the random number generator unless already set.
+func (c *Compound) setRand(rng *rand.Rand) {
+	if c.Rand == nil {
+		c.Rand = rng
+	}
+	if s, ok := c.Continuous.(randomized); ok {
+		s.setRand(rng)
+	}
+}
+
+// Gibbs samples each of the discrete parameters from the full
+// conditional distribution, computing the log density for
+// every value of the parameter.
+type Gibbs struct {
+	// Indices of the updated discrete parameters, all if nil
+	Coords []int
+	// Each of the parameters takes values 0, 1, ..., K-1;
+	// K must be at least 1.
+	K int
+}
+
+func (g *Gibbs) Update(
+	rng *rand.Rand,
+	m model.DiscreteModel,
+	x []float64,
+) {
+	if g.K < 1 {
+		panic(fmt.Sprintf("Gibbs: K must be at least 1, got %d", g.K))
+	}
+	z := m.Discrete()
+	logp := make([]float64, g.K)
+	for _, i := range coords(g.Coords, len(z)) {
+		max := math.Inf(-1)
+		for k := range logp {
+			z[i] = k
+			logp[k] = logDensity(m, x)
+			if logp[k] > max {
+				max = logp[k]
+			}
+		}
+		// Draw the value proportionally to the density.
+		sum := 0.
+		for k := range logp {
+			logp[k] = math.Exp(logp[k] - max)
+			sum += logp[k]
+		}
+		u := sum * rng.Float64()
+		z[i] = g.K - 1
+		for k := range logp {
+			u -= logp[k]
+			if u < 0 {
+				z[i] = k
+				break
+			}
+		}
+	}
+}
+
+// Metropolis updates each of the discrete parameters by a
+// Metropolis step.
+type Metropolis struct {
+	// Indices of the updated discrete parameters, all if nil
+	Coords []int
+	// Propose returns the proposed value of discrete
+	// parameter i with current value zi. The proposal must be
+	// symmetric. If nil, zi - 1 or zi + 1 is proposed with
+	// equal probability.
+	Propose func(rng *rand.Rand, i, zi int) int
+	// Statistics
+	NAcc, NRej int
+}
+
+func (mh *Metropolis) Update(
+	rng *rand.Rand,
+	m model.DiscreteModel,
+	x []float64,
+) {
+	z := m.Discrete()
+	propose := mh.Propose
+	if propose == nil {
+		propose = func(rng *rand.Rand, _, zi int) int {
+			return zi + 2*rng.Intn(2) - 1
+		}
+	}
+	l := logDensity(m, x)
+	for _, i := range coords(mh.Coords, len(z)) {
+		zi := z[i]
+		z[i] = propose(rng, i, zi)
+		l_ := logDensity(m, x)
+		if l_-l >= math.Log(1-rng.Float64()) {
+			l = l_
+			mh.NAcc++
+		} else {
+			z[i] = zi
+			mh.NRej++
+		}
+	}
+}
+
+// coords returns the indices of the updated parameters, all n
+// if indices is nil.
+func coords(indices []int, n int) []int {
+	if indices != nil {
+		return indices
+	}
+	indices = make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
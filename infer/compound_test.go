@@ -0,0 +1,175 @@
+package infer
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// A mixture of two unit normals with means -1 and 1 and
+// weights 0.25 and 0.75; the component is the discrete
+// parameter.
+type mixModel struct {
+	z []int
+}
+
+var (
+	mixMean   = []float64{-1, 1}
+	mixWeight = []float64{0.25, 0.75}
+)
+
+func (m *mixModel) Discrete() []int {
+	return m.z
+}
+
+func (m *mixModel) Observe(x []float64) float64 {
+	ad.Setup(x)
+	var d float64
+	ad.Assignment(&d, ad.Arithmetic(ad.OpSub,
+		&x[0], ad.Value(mixMean[m.z[0]])))
+	return ad.Return(ad.Arithmetic(ad.OpSub,
+		ad.Value(math.Log(mixWeight[m.z[0]])),
+		ad.Arithmetic(ad.OpMul, ad.Value(0.5),
+			ad.Arithmetic(ad.OpMul, &d, &d))))
+}
+
+func TestCompound(t *testing.T) {
+	nattempts := 5
+	niter := 2000
+	flip := func(_ *rand.Rand, _, zi int) int {
+		return 1 - zi
+	}
+	for _, c := range []struct {
+		name       string
+		continuous func() MCMC
+		update     func() DiscreteUpdate
+	}{
+		{"HMC+Gibbs",
+			func() MCMC { return &HMC{L: 5, Eps: 0.3} },
+			func() DiscreteUpdate { return &Gibbs{K: 2} }},
+		{"NUTS+Gibbs",
+			func() MCMC { return &NUTS{Eps: 0.3} },
+			func() DiscreteUpdate { return &Gibbs{K: 2} }},
+		{"HMC+Metropolis",
+			func() MCMC { return &HMC{L: 5, Eps: 0.3} },
+			func() DiscreteUpdate {
+				return &Metropolis{Propose: flip}
+			}},
+	} {
+		// E[x] = 0.5, E[z] = 0.75
+		if !repeatedly(nattempts,
+			func() bool {
+				compound := &Compound{
+					Continuous: c.continuous(),
+					Updates:    []DiscreteUpdate{c.update()},
+				}
+				samples := make(chan []float64)
+				compound.Sample(&mixModel{[]int{0}}, []float64{0},
+					samples)
+				sx, sz := 0., 0.
+				for i := 0; i != niter; i++ {
+					sample := <-samples
+					if len(sample) != 2 {
+						t.Fatalf("%s: wrong sample length: "+
+							"got %d, want 2", c.name, len(sample))
+					}
+					sx += sample[0]
+					sz += sample[1]
+				}
+				compound.Stop()
+				if compound.NAcc == 0 {
+					t.Errorf("%s: no accepted continuous proposals",
+						c.name)
+				}
+				return math.Abs(sx/float64(niter)-0.5) < 0.15 &&
+					math.Abs(sz/float64(niter)-0.75) < 0.07
+			},
+			true) {
+			t.Errorf("%s did not converge", c.name)
+		}
+	}
+
+	// The model must have discrete parameters.
+	defer func() {
+		if recover() == nil {
+			t.Errorf("model not implementing " +
+				"model.DiscreteModel did not panic")
+		}
+	}()
+	compound := &Compound{Continuous: &HMC{}}
+	compound.Sample(&testModel{testData}, []float64{0, 0},
+		make(chan []float64))
+}
+
+// Gibbs updates panic unless K is at least 1.
+func TestGibbsK(t *testing.T) {
+	for _, k := range []int{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Gibbs with K=%d did not panic", k)
+				}
+			}()
+			gibbs := &Gibbs{K: k}
+			gibbs.Update(rand.New(rand.NewSource(1)),
+				&mixModel{[]int{0}}, []float64{0})
+		}()
+	}
+}
+
+func TestCompoundStop(t *testing.T) {
+	update := &Metropolis{
+		Propose: func(_ *rand.Rand, _, zi int) int { return 1 - zi },
+	}
+	compound := &Compound{
+		Continuous: &NUTS{Eps: 0.3},
+		Updates:    []DiscreteUpdate{update},
+	}
+	samples := make(chan []float64)
+	compound.Sample(&mixModel{[]int{1}}, []float64{0}, samples)
+	for i := 0; i != 10; i++ {
+		<-samples
+	}
+	compound.Stop()
+	if _, ok := <-samples; ok {
+		t.Errorf("samples not closed after Stop")
+	}
+	if compound.Err() != nil {
+		t.Errorf("stopped sampler failed: %v", compound.Err())
+	}
+	if n := update.NAcc + update.NRej; n < 10 {
+		t.Errorf("wrong number of discrete updates: got %d, "+
+			"want at least 10", n)
+	}
+}
+
+// Statistics of the continuous sampler are forwarded, or
+// discarded if Compound has no stats channel.
+func TestCompoundStats(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		compound := &Compound{
+			Continuous: &NUTS{Eps: 0.3, Stats: make(chan Stats)},
+			Updates:    []DiscreteUpdate{&Gibbs{K: 2}},
+		}
+		if forward {
+			compound.Stats = make(chan Stats)
+		}
+		samples := make(chan []float64)
+		compound.Sample(&mixModel{[]int{0}}, []float64{0}, samples)
+		for i := 0; i != 10; i++ {
+			<-samples
+			if forward {
+				if stats := <-compound.Stats; stats.NLeapfrog == 0 {
+					t.Errorf("wrong forwarded statistics: %+v", stats)
+				}
+			}
+		}
+		compound.Stop()
+		if forward {
+			if _, ok := <-compound.Stats; ok {
+				t.Errorf("stats not closed after Stop")
+			}
+		}
+	}
+}
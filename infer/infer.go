@@ -1,5 +1,6 @@
 // Package infer contains inference algorithms: maximum
 // likelihood estimation by gradient descent and approximation
 // of the posterior by Markov Chain Monte Carlo methods (notably
-// Hamiltonian Monte Carlo family of algorithms).
+// Hamiltonian Monte Carlo family of algorithms) and by
+// variational inference.
 package infer
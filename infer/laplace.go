@@ -0,0 +1,149 @@
+package infer
+
+// Laplace approximation.
+
+import (
+	"bitbucket.org/dtolpin/infergo/model"
+	"errors"
+	"math"
+)
+
+// Laplace is the Laplace approximation of the posterior: the
+// Gaussian centered at a mode of the log density, for example
+// found by Optimize, with the covariance equal to the inverse
+// of the negated Hessian of the log density at the mode.
+type Laplace struct {
+	// Relative step of finite differences of the gradient,
+	// 1e-5 by default. The Hessian is computed by finite
+	// differences if the model is elemental and does not
+	// implement model.HessianModel, and by second-order
+	// automatic differentiation otherwise.
+	Step float64
+	// The Hessian of the log density at the mode, available
+	// after the call to Fit
+	Hessian [][]float64
+}
+
+// Fit returns the approximation of the posterior around mode
+// x and the Laplace estimate of the log evidence, the
+// logarithm of the integral of the density. Fit fails if the
+// negated Hessian at x is not positive definite, that is, x
+// is not a mode.
+func (la *Laplace) Fit(
+	m model.Model,
+	x []float64,
+) (q *Gaussian, logEvidence float64, err error) {
+	la.setDefaults()
+	l := m.Observe(x)
+	la.Hessian = la.hessian(m, x)
+
+	// Cholesky factor of the precision matrix, the negated
+	// Hessian.
+	prec := make([][]float64, len(x))
+	for i := range prec {
+		prec[i] = make([]float64, len(x))
+		for j := range prec[i] {
+			prec[i][j] = -la.Hessian[i][j]
+		}
+	}
+	lprec, ok := cholesky(prec)
+	if !ok {
+		return nil, 0, errors.New("the negated Hessian is not " +
+			"positive definite")
+	}
+
+	// The covariance is L'⁻¹L⁻¹, where LL' is the precision.
+	linv := lowerInverse(lprec)
+	cov := make([][]float64, len(x))
+	for i := range cov {
+		cov[i] = make([]float64, len(x))
+		for j := range cov[i] {
+			k := i
+			if j > k {
+				k = j
+			}
+			for ; k != len(x); k++ {
+				cov[i][j] += linv[k][i] * linv[k][j]
+			}
+		}
+	}
+	chol, ok := cholesky(cov)
+	if !ok {
+		return nil, 0, errors.New("the covariance is not " +
+			"positive definite")
+	}
+	q = &Gaussian{
+		Mean: append([]float64(nil), x...),
+		Chol: chol,
+	}
+
+	// log p(x) + d/2 log 2π - 1/2 log det(-H)
+	logEvidence = l + 0.5*float64(len(x))*math.Log(2*math.Pi)
+	for i := range lprec {
+		logEvidence -= math.Log(lprec[i][i])
+	}
+	return q, logEvidence, nil
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (la *Laplace) setDefaults() {
+	if la.Step == 0 {
+		la.Step = 1e-5
+	}
+}
+
+// hessian computes the Hessian of the log density of m at x.
+// Observe must have been called on x.
+func (la *Laplace) hessian(m model.Model, x []float64) [][]float64 {
+	_, elemental := m.(model.ElementalModel)
+	_, supplied := m.(model.HessianModel)
+	if !elemental || supplied {
+		return model.Hessian(m)
+	}
+
+	// Central differences of the gradient
+	model.DropGradient(m)
+	h := make([][]float64, len(x))
+	x_ := clone(x)
+	for j := range x {
+		step := la.Step * math.Max(1, math.Abs(x[j]))
+		x_[j] = x[j] + step
+		m.Observe(x_)
+		gp := model.Gradient(m)
+		x_[j] = x[j] - step
+		m.Observe(x_)
+		gm := model.Gradient(m)
+		x_[j] = x[j]
+		h[j] = make([]float64, len(x))
+		for i := range x {
+			h[j][i] = (gp[i] - gm[i]) / (2 * step)
+		}
+	}
+	for i := range h {
+		for j := 0; j != i; j++ {
+			hij := 0.5 * (h[i][j] + h[j][i])
+			h[i][j], h[j][i] = hij, hij
+		}
+	}
+	return h
+}
+
+// lowerInverse returns the inverse of lower-triangular matrix
+// l, by forward substitution.
+func lowerInverse(l [][]float64) [][]float64 {
+	inv := make([][]float64, len(l))
+	for i := range inv {
+		inv[i] = make([]float64, len(l))
+	}
+	for j := range l {
+		inv[j][j] = 1 / l[j][j]
+		for i := j + 1; i != len(l); i++ {
+			s := 0.
+			for k := j; k != i; k++ {
+				s -= l[i][k] * inv[k][j]
+			}
+			inv[i][j] = s / l[i][i]
+		}
+	}
+	return inv
+}
@@ -0,0 +1,92 @@
+package infer
+
+// Testing the Laplace approximation.
+
+import (
+	"bitbucket.org/dtolpin/infergo/model"
+	"math"
+	"testing"
+)
+
+// The Gaussian model with the gradient supplied, so that the
+// Hessian is computed by finite differences.
+type elementalGauss struct {
+	*gaussModel
+	grad []float64
+}
+
+func (m *elementalGauss) Observe(x []float64) float64 {
+	ll := 0.
+	m.grad = make([]float64, len(x))
+	for i := range x {
+		for j := range x {
+			ll -= 0.5 * m.prec[i][j] * (x[i] - m.mean[i]) *
+				(x[j] - m.mean[j])
+			m.grad[i] -= m.prec[i][j] * (x[j] - m.mean[j])
+		}
+	}
+	return ll
+}
+
+func (m *elementalGauss) Gradient() []float64 {
+	return m.grad
+}
+
+func TestLaplace(t *testing.T) {
+	// The approximation of a Gaussian is exact.
+	cov := [][]float64{{1, 0.8}, {0.8, 1}}
+	logZ := math.Log(2 * math.Pi * 0.6)
+	for _, c := range []struct {
+		name string
+		m    model.Model
+		prec float64
+	}{
+		{"automatic", testGauss, 1e-9},
+		{"finite differences", &elementalGauss{gaussModel: testGauss}, 1e-6},
+	} {
+		la := &Laplace{}
+		q, logEvidence, err := la.Fit(c.m, []float64{1, -2})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		for i := range q.Mean {
+			if q.Mean[i] != testGauss.mean[i] {
+				t.Errorf("%s: wrong mean: got %v, want %v",
+					c.name, q.Mean, testGauss.mean)
+			}
+		}
+		qcov := q.Cov()
+		for i := range qcov {
+			for j := range qcov {
+				if math.Abs(qcov[i][j]-cov[i][j]) > c.prec {
+					t.Errorf("%s: wrong covariance: got %v, want %v",
+						c.name, qcov, cov)
+				}
+				if math.Abs(la.Hessian[i][j]+testGauss.prec[i][j]) >
+					c.prec*10 {
+					t.Errorf("%s: wrong Hessian: got %v",
+						c.name, la.Hessian)
+				}
+			}
+		}
+		sd := q.StdDev()
+		if math.Abs(sd[0]-1) > c.prec || math.Abs(sd[1]-1) > c.prec {
+			t.Errorf("%s: wrong standard deviations: got %v, "+
+				"want [1 1]", c.name, sd)
+		}
+		if math.Abs(logEvidence-logZ) > c.prec {
+			t.Errorf("%s: wrong log evidence: got %.6g, want %.6g",
+				c.name, logEvidence, logZ)
+		}
+	}
+
+	// At a minimum, the approximation fails.
+	la := &Laplace{}
+	_, _, err := la.Fit(&gaussModel{
+		mean: []float64{0},
+		prec: [][]float64{{-1}},
+	}, []float64{0})
+	if err == nil {
+		t.Errorf("Laplace approximation at a minimum succeeded")
+	}
+}
@@ -5,10 +5,11 @@ package infer
 import (
 	"bitbucket.org/dtolpin/infergo/ad"
 	"bitbucket.org/dtolpin/infergo/model"
+	"context"
+	"fmt"
 	"log"
 	"math"
 	"math/rand"
-	"time"
 )
 
 // MCMC is the interface of MCMC samplers.
@@ -24,65 +25,256 @@ type MCMC interface {
 // sampler is the structure for embedding into concrete
 // samplers.
 type sampler struct {
-	stop    bool
+	stop    chan struct{}
 	samples chan []float64
+	stats   chan Stats
+	err     error
 	// Statistics
 	NAcc, NRej int // the number of accepted and rejected samples
+	NDiv       int // the number of divergent transitions
+	// Tempering exponent of the likelihood, see Temper
+	beta     float64
+	tempered bool
+	// If not nil, each iteration waits for a value from gate,
+	// see Compound.
+	gate chan struct{}
 }
 
 // Helper functions
 
+// Stats are the statistics of a sampler iteration. Samplers
+// write Stats to their Stats channel, if not nil, after each
+// sample.
+type Stats struct {
+	LogDensity float64 // log density of the sample
+	Accept     float64 // mean Metropolis acceptance probability
+	StepSize   float64 // step size
+	Depth      int     // tree depth
+	NLeapfrog  int     // number of leapfrog steps
+	// Energy at the beginning of the iteration, after the
+	// momentum is drawn; log density minus kinetic energy
+	Energy    float64
+	Divergent bool // true if the trajectory diverged
+}
+
+// start prepares the sampler for writing to samples and,
+// unless stats is nil, to stats.
+func (s *sampler) start(samples chan []float64, stats chan Stats) {
+	s.samples = samples // Stop needs access to samples
+	s.stats = stats
+	s.stop = make(chan struct{})
+	s.err = nil
+}
+
+// report writes the statistics of an iteration to the stats
+// channel, unless the channel is nil or the sampler is
+// stopped.
+func (s *sampler) report(stats Stats) {
+	if s.stats == nil {
+		return
+	}
+	select {
+	case s.stats <- stats:
+	case <-s.stop:
+	}
+}
+
+// closeStats closes the stats channel, unless nil.
+func (s *sampler) closeStats() {
+	if s.stats != nil {
+		close(s.stats)
+	}
+}
+
+// Temper makes the sampler sample from the tempered posterior,
+// with the likelihood raised to power beta; beta = 0
+// corresponds to the prior. The model must implement
+// model.Separable. Temper must be called before Sample.
+func (s *sampler) Temper(beta float64) {
+	s.beta, s.tempered = beta, true
+}
+
+// temper returns the model to sample from, tempered if
+// Temper was called.
+func (s *sampler) temper(m model.Model) model.Model {
+	if !s.tempered {
+		return m
+	}
+	sm, ok := m.(model.Separable)
+	if !ok {
+		panic("tempered model must implement model.Separable")
+	}
+	return model.Tempered(sm, s.beta)
+}
+
+// stopped returns true if the sampler was stopped.
+func (s *sampler) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// next returns false if the sampler was stopped. Otherwise, if
+// the sampler is gated, next waits for the permission to start
+// the next iteration.
+func (s *sampler) next() bool {
+	if s.gate == nil {
+		return !s.stopped()
+	}
+	select {
+	case <-s.gate:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// setGate makes the sampler wait for a value from gate before
+// each iteration.
+func (s *sampler) setGate(gate chan struct{}) {
+	s.gate = gate
+}
+
+// statsChan returns the stats channel of the running sampler.
+func (s *sampler) statsChan() chan Stats {
+	return s.stats
+}
+
+// intercept intercepts errors deep inside the algorithm,
+// and reports and stores them. intercept must be deferred
+// in the sampling goroutine.
+func (s *sampler) intercept(name string) {
+	if r := recover(); r != nil {
+		s.err = fmt.Errorf("%s: %v", name, r)
+		log.Printf("ERROR: %v", s.err)
+	}
+}
+
 // Stop stops a sampler gracefully, using the samples channel
 // for synchronization. Stop must be called before further calls
 // to differentiated code. A part of the MCMC interface.
 func (s *sampler) Stop() {
-	s.stop = true
+	if !s.stopped() {
+		close(s.stop)
+	}
 	// The differentiated code is not necessarily thread-safe,
 	// hence we must exhaust samples before returning from Stop,
 	// so that an Observe called afterwards does not overlap
 	// with an Observe called in the sampler.
+	for range s.samples {
+		// Discard the sample and continue.
+	}
+}
+
+// Err returns the error which terminated the sampler, or nil
+// if the sampler was stopped or is still running. Err should
+// be called after the samples channel is closed.
+func (s *sampler) Err() error {
+	return s.err
+}
+
+// failing is implemented by samplers reporting errors.
+type failing interface {
+	Err() error
+}
+
+// SampleContext runs sampler s on model m, starting from x,
+// and writes the samples to samples until ctx is done or the
+// sampler terminates. samples is closed on return.
+// SampleContext returns the error which terminated the
+// sampler, if any, ctx.Err() if the sampler was stopped
+// through ctx, and nil otherwise.
+func SampleContext(
+	ctx context.Context,
+	s MCMC,
+	m model.Model,
+	x []float64,
+	samples chan []float64,
+) error {
+	defer close(samples)
+	chain := make(chan []float64)
+	s.Sample(m, x, chain)
 	for {
 		select {
-		case _, ok := <-s.samples:
-			if !ok { // channel closed, safe to leave
-				return
+		case x, ok := <-chain:
+			if !ok {
+				return samplerErr(s)
 			}
-			// Discard the sample and continue.
-		default:
-			// No data but the channel is open, the sampler is
-			// computing a sample. Wait for the computation to
-			// complete.
-			time.Sleep(1000) // one millisecond
+			select {
+			case samples <- x:
+				continue
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+		s.Stop()
+		if err := samplerErr(s); err != nil {
+			return err
 		}
+		return ctx.Err()
+	}
+}
+
+// samplerErr returns the error of sampler s if s reports
+// errors, and nil otherwise.
+func samplerErr(s MCMC) error {
+	if s, ok := s.(failing); ok {
+		return s.Err()
+	}
+	return nil
+}
+
+// globalSource is the source of the global random number
+// generator of math/rand. Samplers without a random number
+// generator use the global generator, which is safe for
+// concurrent use.
+type globalSource struct{}
+
+func (globalSource) Int63() int64    { return rand.Int63() }
+func (globalSource) Seed(seed int64) { rand.Seed(seed) }
+
+// defaultRand returns rng if not nil, otherwise a generator
+// drawing from the global source.
+func defaultRand(rng *rand.Rand) *rand.Rand {
+	if rng == nil {
+		rng = rand.New(globalSource{})
 	}
+	return rng
+}
+
+// logDensity computes the log density of m at x and drops
+// the gradient; used by gradient-free samplers and updates.
+func logDensity(m model.Model, x []float64) float64 {
+	l := m.Observe(x)
+	model.DropGradient(m)
+	return l
 }
 
 // energy computes the energy of a particle; used
 // by HMC variants.
-func energy(l float64, r []float64) float64 {
-	k := 0.
-	for _, ri := range r {
-		k += ri * ri
-	}
-	return l - 0.5*k
+func energy(l float64, r []float64, metric Metric) float64 {
+	return l - metric.Kinetic(r)
 }
 
 // leapfrog advances x and r a single 'leapfrog'; used
-// by HMC variants.
+// by HMC variants. The gradient is updated in place. The
+// caller checks the energy for divergence.
 func leapfrog(
 	m model.Model,
+	metric Metric,
 	grad []float64,
 	x, r []float64,
 	eps float64,
 ) (l float64, _ []float64) {
 	for i := range x {
 		r[i] += 0.5 * eps * grad[i]
-		x[i] += eps * r[i]
-	}
-	l, grad = m.Observe(x), model.Gradient(m)
-	if math.IsNaN(l) {
-		panic("energy diverged")
 	}
+	drift(metric, x, r, eps)
+	l = m.Observe(x)
+	model.GradientInto(m, grad)
 	for i := range x {
 		r[i] += 0.5 * eps * grad[i]
 	}
@@ -90,6 +282,22 @@ func leapfrog(
 	return l, grad
 }
 
+// diverged returns true if a transition from energy e0 to
+// energy e diverges: e is not finite, or the energy error
+// exceeds maxError.
+func diverged(e0, e, maxError float64) bool {
+	return math.IsNaN(e) || math.IsInf(e, 0) || !(e0-e <= maxError)
+}
+
+// acceptStat returns the Metropolis acceptance probability
+// of a transition changing the energy by de.
+func acceptStat(de float64) float64 {
+	if math.IsNaN(de) {
+		return 0
+	}
+	return math.Min(1, math.Exp(de))
+}
+
 // clone clones state or momentum slice; used as poor man's
 // copy-on-write.
 func clone(x []float64) []float64 {
@@ -104,6 +312,23 @@ type HMC struct {
 	// Parameters
 	L   int     // number of leapfrog steps
 	Eps float64 // leapfrog step size
+	// Energy error above which the trajectory diverges;
+	// divergent transitions are rejected.
+	MaxEnergyError float64
+	// Mass matrix; the identity matrix is used if nil.
+	Metric Metric
+	// Adapter, if not nil, adapts the step size and the mass
+	// matrix during sampling (see Warmup).
+	Adapter Adapter
+	// Random number generator; the global generator is used
+	// if nil. A generator with a fixed seed makes the chain
+	// reproducible. A generator must not be shared between
+	// concurrently running samplers.
+	Rand *rand.Rand
+	// Stats, if not nil, receives the statistics of each
+	// iteration after the sample. Stats must be read after
+	// each sample and is closed when the sampler terminates.
+	Stats chan Stats
 }
 
 func (hmc *HMC) Sample(
@@ -112,50 +337,82 @@ func (hmc *HMC) Sample(
 	samples chan []float64,
 ) {
 	hmc.setDefaults()
-	hmc.samples = samples // Stop needs access to samples
+	hmc.start(samples, hmc.Stats)
+	m = hmc.temper(m)
 	go func() {
 		// On exit:
+		// * close samples, after the tape is dropped so that
+		// Stop returns when the sampler is done with the tape;
+		defer close(samples)
+		// * close stats;
+		defer hmc.closeStats()
 		// * drop the tape;
 		defer ad.DropTape()
-		// * close samples;
-		defer close(samples)
 		// * intercept errors deep inside the algorithm
 		// and report them.
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: HMC: %v", r)
-			}
-		}()
+		defer hmc.intercept("HMC")
 		r := make([]float64, len(x))
+		grad := make([]float64, len(x))
 		for {
-			if hmc.stop {
+			if !hmc.next() {
 				break
 			}
 			// Sample the next r.
-			for i := range r {
-				r[i] = rand.NormFloat64()
-			}
-
-			l0, grad := m.Observe(x), model.Gradient(m)
-			e0 := energy(l0, r) // initial energy
-			var l float64
+			hmc.Metric.Momentum(hmc.Rand, r)
+
+			l0 := m.Observe(x)
+			model.GradientInto(m, grad)
+			e0 := energy(l0, r, hmc.Metric) // initial energy
+			var l, e float64
+			// The trajectory is computed on a copy, so that
+			// samples already written are not modified.
 			x_ := clone(x)
-			for i := 0; i != hmc.L; i++ {
-				l, grad = leapfrog(m, grad, x, r, hmc.Eps)
+			divergent := false
+			nleapfrog := 0
+			for nleapfrog != hmc.L {
+				l, _ = leapfrog(m, hmc.Metric, grad, x_, r, hmc.Eps)
+				nleapfrog++
+				e = energy(l, r, hmc.Metric)
+				if diverged(e0, e, hmc.MaxEnergyError) {
+					divergent = true
+					break
+				}
 			}
-			e := energy(l, r) // final energy
+			// e is the final energy
 
 			// Accept with MH probability.
-			if e-e0 >= math.Log(1-rand.Float64()) {
-				hmc.NAcc++
-			} else {
-				// Rejected, restore x.
-				x = x_
+			accept := 0.
+			if divergent {
+				hmc.NDiv++
 				hmc.NRej++
+			} else {
+				accept = acceptStat(e - e0)
+				if e-e0 >= math.Log(1-hmc.Rand.Float64()) {
+					x = x_
+					l0 = l
+					hmc.NAcc++
+				} else {
+					// Rejected, keep x.
+					hmc.NRej++
+				}
+			}
+
+			// Adapt the parameters.
+			eps := hmc.Eps
+			if hmc.Adapter != nil {
+				hmc.Adapter.Adapt(&hmc.Eps, &hmc.Metric, x, accept)
 			}
 
 			// Write a sample to the channel.
 			samples <- x
+			hmc.report(Stats{
+				LogDensity: l0,
+				Accept:     accept,
+				StepSize:   eps,
+				NLeapfrog:  nleapfrog,
+				Energy:     e0,
+				Divergent:  divergent,
+			})
 		}
 	}()
 }
@@ -165,6 +422,20 @@ func (hmc *HMC) setDefaults() {
 	if hmc.L == 0 {
 		hmc.L = 10
 	}
+	if hmc.MaxEnergyError == 0 {
+		hmc.MaxEnergyError = 1000
+	}
+	if hmc.Metric == nil {
+		hmc.Metric = unitMetric{}
+	}
+	hmc.Rand = defaultRand(hmc.Rand)
+}
+
+// setRand sets the random number generator unless already set.
+func (hmc *HMC) setRand(rng *rand.Rand) {
+	if hmc.Rand == nil {
+		hmc.Rand = rng
+	}
 }
 
 // No U-Turn Sampler (https://arxiv.org/abs/1111.4246).
@@ -174,6 +445,16 @@ type NUTS struct {
 	Eps      float64 // step size
 	Delta    float64 // lower bound on energy for doubling
 	MaxDepth int     // maximum depth
+	// Energy error above which the trajectory diverges, see
+	// HMC
+	MaxEnergyError float64
+	// Mass matrix and adapter, see HMC
+	Metric  Metric
+	Adapter Adapter
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
+	// Iteration statistics, see HMC.Stats
+	Stats chan Stats
 	// Statistics
 	// Depth belief is encoded as a vector of beta-bernoulli
 	// distributions. If the depth is greater than the element's
@@ -184,6 +465,12 @@ type NUTS struct {
 	x    []float64
 	l    float64
 	grad []float64
+	// Acceptance statistic of the current iteration: initial
+	// energy, sum and number of acceptance probabilities
+	e0, alpha, nalpha float64
+	divergent         bool // the current trajectory diverged
+	// Velocities of the ends of the trajectory, see turned
+	vl, vr []float64
 }
 
 func (nuts *NUTS) Sample(
@@ -192,39 +479,44 @@ func (nuts *NUTS) Sample(
 	samples chan []float64,
 ) {
 	nuts.setDefaults()
-	nuts.samples = samples // Stop needs access to samples
-	nuts.x = nil           // invalidate gradient cache
+	nuts.start(samples, nuts.Stats)
+	m = nuts.temper(m)
+	nuts.x = nil // invalidate gradient cache
 	go func() {
 		// On exit:
+		// * close samples, after the tape is dropped so that
+		// Stop returns when the sampler is done with the tape;
+		defer close(samples)
+		// * close stats;
+		defer nuts.closeStats()
 		// * drop the tape;
 		defer ad.DropTape()
-		// * close samples;
-		defer close(samples)
 		// * intercept errors deep inside the algorithm
 		// and report them.
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: NUTS: %v", r)
-			}
-		}()
+		defer nuts.intercept("NUTS")
 
 		r := make([]float64, len(x))
 		for {
-			if nuts.stop {
+			if !nuts.next() {
 				break
 			}
+			if nuts.gate != nil {
+				// The model may have changed while the
+				// sampler was waiting.
+				nuts.x = nil
+			}
 
 			// Sample the next r.
-			for i := range r {
-				r[i] = rand.NormFloat64()
-			}
+			nuts.Metric.Momentum(nuts.Rand, r)
 
 			// Compute the energy.
 			l, _ := nuts.observe(m, x)
-			e := energy(l, r)
+			e := energy(l, r, nuts.Metric)
+			nuts.e0, nuts.alpha, nuts.nalpha = e, 0, 0
+			nuts.divergent = false
 
 			// Sample the slice variable
-			logu := math.Log((1 - rand.Float64())) + e
+			logu := math.Log((1 - nuts.Rand.Float64())) + e
 
 			// Initialize the tree
 			xl, rl, xr, rr, depth, nelem := x, r, x, r, 0, 1.
@@ -235,7 +527,7 @@ func (nuts *NUTS) Sample(
 
 				// Choose direction.
 				var dir float64
-				if rand.Float64() < 0.5 {
+				if nuts.Rand.Float64() < 0.5 {
 					dir = -1
 				} else {
 					dir = 1
@@ -254,7 +546,7 @@ func (nuts *NUTS) Sample(
 				}
 
 				// Accept or reject
-				if nelem_/nelem > rand.Float64() {
+				if nelem_/nelem > nuts.Rand.Float64() {
 					accepted = true
 					x = x_
 				}
@@ -274,10 +566,38 @@ func (nuts *NUTS) Sample(
 			} else {
 				nuts.NRej++
 			}
+			if nuts.divergent {
+				nuts.NDiv++
+			}
 			nuts.updateDepth(depth)
 
+			accept := 0.
+			if nuts.nalpha > 0 {
+				accept = nuts.alpha / nuts.nalpha
+			}
+
+			// Adapt the parameters.
+			eps := nuts.Eps
+			if nuts.Adapter != nil {
+				nuts.Adapter.Adapt(&nuts.Eps, &nuts.Metric, x, accept)
+			}
+
 			// Write a sample to the channel.
 			samples <- x
+			if nuts.Stats != nil {
+				// The model run is cached for the next
+				// iteration.
+				l, _ := nuts.observe(m, x)
+				nuts.report(Stats{
+					LogDensity: l,
+					Accept:     accept,
+					StepSize:   eps,
+					Depth:      depth,
+					NLeapfrog:  int(nuts.nalpha),
+					Energy:     e,
+					Divergent:  nuts.divergent,
+				})
+			}
 		}
 	}()
 }
@@ -301,13 +621,26 @@ func (nuts *NUTS) buildLeftOrRightTree(
 			nuts.buildTree(m, xr, rr, logu, dir, depth)
 	}
 
-	if uTurn(xl, xr, rl) || uTurn(xl, xr, rr) {
+	if nuts.turned(xl, rl, xr, rr) {
 		stop = true
 	}
 
 	return xl, rl, xr, rr, x, nelem, stop
 }
 
+// turned returns true iff the trajectory between (xl, rl) and
+// (xr, rr) makes a U-turn. The criterion is on the velocities
+// M⁻¹r, which are the momenta only with the unit metric.
+func (nuts *NUTS) turned(xl, rl, xr, rr []float64) bool {
+	if len(nuts.vl) != len(rl) {
+		nuts.vl = make([]float64, len(rl))
+		nuts.vr = make([]float64, len(rr))
+	}
+	nuts.Metric.Velocity(nuts.vl, rl)
+	nuts.Metric.Velocity(nuts.vr, rr)
+	return uTurn(xl, xr, nuts.vl) || uTurn(xl, xr, nuts.vr)
+}
+
 func (nuts *NUTS) buildTree(
 	m model.Model,
 	x, r []float64,
@@ -324,15 +657,26 @@ func (nuts *NUTS) buildTree(
 		// are copied because leapfrog modifies them in place.
 		x, r := clone(x), clone(r)
 		_, grad := nuts.observe(m, x)
-		l, grad := leapfrog(m, grad, x, r, dir*nuts.Eps)
+		l, grad := leapfrog(m, nuts.Metric, grad, x, r, dir*nuts.Eps)
 		// Cache model run inside leapfrog
 		nuts.x, nuts.l, nuts.grad = x, l, grad
-		if energy(l, r) >= logu {
+		e := energy(l, r, nuts.Metric)
+		if e >= logu {
 			nelem = 1
 		}
-		if energy(l, r)+nuts.Delta <= logu {
+		if e+nuts.Delta <= logu {
+			stop = true
+		}
+		if diverged(nuts.e0, e, nuts.MaxEnergyError) {
+			// The diverging subtree is discarded.
+			nelem = 0
 			stop = true
+			nuts.divergent = true
 		}
+		// Average acceptance probability over all visited
+		// states is the acceptance statistic.
+		nuts.alpha += acceptStat(e - nuts.e0)
+		nuts.nalpha++
 		return x, r, x, r, x, nelem, stop
 	} else {
 		depth--
@@ -349,7 +693,7 @@ func (nuts *NUTS) buildTree(
 		nelem += nelem_
 
 		// Select uniformly from nodes.
-		if nelem_/nelem > rand.Float64() {
+		if nelem_/nelem > nuts.Rand.Float64() {
 			x = x_
 		}
 
@@ -385,6 +729,20 @@ func (nuts *NUTS) setDefaults() {
 	if nuts.Delta == 0 {
 		nuts.Delta = 1e3
 	}
+	if nuts.MaxEnergyError == 0 {
+		nuts.MaxEnergyError = 1000
+	}
+	if nuts.Metric == nil {
+		nuts.Metric = unitMetric{}
+	}
+	nuts.Rand = defaultRand(nuts.Rand)
+}
+
+// setRand sets the random number generator unless already set.
+func (nuts *NUTS) setRand(rng *rand.Rand) {
+	if nuts.Rand == nil {
+		nuts.Rand = rng
+	}
 }
 
 // updateDepth updates depth beliefs.
@@ -412,12 +770,12 @@ func (nuts *NUTS) MeanDepth() float64 {
 }
 
 // uTurn returns true iff there is a u-turn.
-func uTurn(xl, xr, r []float64) bool {
-	// Dot product of changes and moment to
+func uTurn(xl, xr, v []float64) bool {
+	// Dot product of changes and velocity to
 	// stop on U-turn.
 	dot := 0.
 	for i := range xl {
-		dot += (xr[i] - xl[i]) * r[i]
+		dot += (xr[i] - xl[i]) * v[i]
 	}
 	return dot < 0
 }
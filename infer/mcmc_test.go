@@ -6,8 +6,10 @@ import (
 	"bitbucket.org/dtolpin/infergo/ad"
 	. "bitbucket.org/dtolpin/infergo/dist/ad"
 	"bitbucket.org/dtolpin/infergo/model"
+	"context"
 	"math"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,7 +29,7 @@ func TestEnergy(t *testing.T) {
 		{1, []float64{0}, 1},
 		{1, []float64{1, 3}, -4},
 	} {
-		if e := energy(c.l, c.r); math.Abs(e-c.e) > 1e-6 {
+		if e := energy(c.l, c.r, unitMetric{}); math.Abs(e-c.e) > 1e-6 {
 			t.Errorf("incorrect energy for l=%v, r=%v: "+
 				"got=%.6g, want=%.6g", c.l, c.r, e, c.e)
 		}
@@ -42,7 +44,7 @@ func TestLeapfrog(t *testing.T) {
 	x, r, eps := []float64{0, 0}, []float64{1, -1}, 0.5
 	m.Observe(x)
 	grad := model.Gradient(m)
-	_, grad = leapfrog(m, grad, x, r, eps)
+	_, grad = leapfrog(m, unitMetric{}, grad, x, r, eps)
 	xNext, rNext := []float64{0.5625, -0.3125}, []float64{1.25, -0.25}
 	for i := range x {
 		if math.Abs(x[i]-xNext[i]) > 1e-6 {
@@ -187,6 +189,28 @@ func TestUTurn(t *testing.T) {
 	}
 }
 
+// The U-turn criterion of NUTS is on the velocities rather
+// than on the momenta.
+func TestNUTSTurned(t *testing.T) {
+	xl, xr := []float64{0, 0}, []float64{1, -1}
+	r := []float64{2, 1}
+	for _, c := range []struct {
+		metric Metric
+		turned bool
+	}{
+		{unitMetric{}, false},
+		{&DiagMetric{InvMass: []float64{1, 1}}, false},
+		{&DiagMetric{InvMass: []float64{0.1, 1}}, true},
+		{NewDenseMetric([][]float64{{0.1, 0}, {0, 1}}), true},
+	} {
+		nuts := &NUTS{Metric: c.metric}
+		if nuts.turned(xl, r, xr, r) != c.turned {
+			t.Errorf("%+v: wrong U-turn criterion: got %v, want %v",
+				c.metric, !c.turned, c.turned)
+		}
+	}
+}
+
 // Basic convergence of MCMC samplers. Empirical mean and stddev
 // should be around the inferred mean and stddev.
 func TestSamplers(t *testing.T) {
@@ -211,6 +235,13 @@ func TestSamplers(t *testing.T) {
 				}
 			},
 		},
+		{
+			func() MCMC {
+				return &MNUTS{
+					Eps: 0.1,
+				}
+			},
+		},
 	} {
 		if !repeatedly(nattempts,
 			func() bool {
@@ -226,6 +257,480 @@ func TestSamplers(t *testing.T) {
 	}
 }
 
+// Samplers with random number generators seeded identically
+// produce identical chains.
+func TestReproducible(t *testing.T) {
+	niter := 20
+	for _, c := range []struct {
+		sampler func(rng *rand.Rand) MCMC
+	}{
+		{
+			func(rng *rand.Rand) MCMC {
+				return &HMC{
+					L:    5,
+					Eps:  0.1,
+					Rand: rng,
+				}
+			},
+		},
+		{
+			func(rng *rand.Rand) MCMC {
+				return &NUTS{
+					Eps:  0.1,
+					Rand: rng,
+				}
+			},
+		},
+		{
+			func(rng *rand.Rand) MCMC {
+				return &MNUTS{
+					Eps:  0.1,
+					Rand: rng,
+				}
+			},
+		},
+		{
+			func(rng *rand.Rand) MCMC {
+				return &RWM{
+					NAdapt: 10,
+					Rand:   rng,
+				}
+			},
+		},
+		{
+			func(rng *rand.Rand) MCMC {
+				return &Slice{
+					MaxSteps: 4,
+					Rand:     rng,
+				}
+			},
+		},
+		{
+			func(rng *rand.Rand) MCMC {
+				return &SgHMC{
+					L:     5,
+					Eta:   0.01,
+					Alpha: 0.1,
+					V:     1,
+					Rand:  rng,
+				}
+			},
+		},
+	} {
+		var chains [2][][]float64
+		for i := range chains {
+			m := &testModel{testData}
+			x := []float64{0.1, 0.1}
+			samples := make(chan []float64)
+			sampler := c.sampler(rand.New(rand.NewSource(1)))
+			sampler.Sample(m, x, samples)
+			for j := 0; j != niter; j++ {
+				chains[i] = append(chains[i], clone(<-samples))
+			}
+			sampler.Stop()
+		}
+		for j := range chains[0] {
+			for k := range chains[0][j] {
+				if chains[0][j][k] != chains[1][j][k] {
+					t.Errorf("%T: chains differ at sample %d: "+
+						"%v != %v", c.sampler(nil), j,
+						chains[0][j], chains[1][j])
+					break
+				}
+			}
+		}
+	}
+}
+
+// A model which fails.
+type failingModel struct{}
+
+func (m *failingModel) Observe(x []float64) float64 {
+	panic("model failed")
+}
+
+// Divergent transitions are rejected, and the chain keeps
+// running.
+func TestDivergence(t *testing.T) {
+	niter := 10
+	for _, c := range []struct {
+		sampler func(stats chan Stats) MCMC
+	}{
+		{
+			func(stats chan Stats) MCMC {
+				return &HMC{
+					L:     5,
+					Eps:   0.1,
+					Stats: stats,
+				}
+			},
+		},
+		{
+			func(stats chan Stats) MCMC {
+				return &NUTS{
+					Eps:   0.1,
+					Stats: stats,
+				}
+			},
+		},
+		{
+			func(stats chan Stats) MCMC {
+				return &MNUTS{
+					Eps:   0.1,
+					Stats: stats,
+				}
+			},
+		},
+	} {
+		// Any move from x = 0 diverges.
+		m := &constGrad{grad: []float64{math.NaN()}}
+		samples := make(chan []float64)
+		stats := make(chan Stats)
+		sampler := c.sampler(stats)
+		sampler.Sample(m, []float64{0}, samples)
+		for i := 0; i != niter; i++ {
+			x := <-samples
+			if x == nil {
+				t.Fatalf("%T: chain terminated", sampler)
+			}
+			if x[0] != 0 {
+				t.Errorf("%T: divergent transition accepted: %v",
+					sampler, x)
+			}
+			if s := <-stats; !s.Divergent {
+				t.Errorf("%T: divergence not reported", sampler)
+			}
+		}
+		sampler.Stop()
+		var ndiv int
+		switch sampler := sampler.(type) {
+		case *HMC:
+			ndiv = sampler.NDiv
+		case *NUTS:
+			ndiv = sampler.NDiv
+		case *MNUTS:
+			ndiv = sampler.NDiv
+		}
+		if ndiv < niter {
+			t.Errorf("%T: wrong number of divergences: "+
+				"got %d, want at least %d", sampler, ndiv, niter)
+		}
+		if err := samplerErr(sampler); err != nil {
+			t.Errorf("%T: unexpected error %v", sampler, err)
+		}
+	}
+}
+
+// SampleContext stops on cancellation and reports errors.
+func TestSampleContext(t *testing.T) {
+	for _, c := range []struct {
+		sampler func() MCMC
+	}{
+		{
+			func() MCMC {
+				return &HMC{
+					L:   5,
+					Eps: 0.1,
+				}
+			},
+		},
+		{
+			func() MCMC {
+				return &NUTS{
+					Eps: 0.1,
+				}
+			},
+		},
+		{
+			func() MCMC {
+				return &MNUTS{
+					Eps: 0.1,
+				}
+			},
+		},
+	} {
+		// Cancellation
+		{
+			ctx, cancel := context.WithCancel(context.Background())
+			m := &testModel{testData}
+			samples := make(chan []float64)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- SampleContext(ctx, c.sampler(),
+					m, []float64{0.1, 0.1}, samples)
+			}()
+			for i := 0; i != 10; i++ {
+				<-samples
+			}
+			cancel()
+			if err := <-errc; err != context.Canceled {
+				t.Errorf("%T: cancelled with error %v, want %v",
+					c.sampler(), err, context.Canceled)
+			}
+			if _, ok := <-samples; ok {
+				t.Errorf("%T: samples not closed", c.sampler())
+			}
+		}
+		// Error
+		{
+			m := &failingModel{}
+			samples := make(chan []float64)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- SampleContext(context.Background(),
+					c.sampler(), m, []float64{0}, samples)
+			}()
+			for range samples {
+			}
+			err := <-errc
+			if err == nil ||
+				!strings.Contains(err.Error(), "model failed") {
+				t.Errorf("%T: terminated with error %v, "+
+					"want model failed", c.sampler(), err)
+			}
+		}
+	}
+}
+
+// Samplers report iteration statistics after each sample.
+func TestStats(t *testing.T) {
+	niter := 20
+	for _, c := range []struct {
+		sampler func(stats chan Stats) MCMC
+	}{
+		{
+			func(stats chan Stats) MCMC {
+				return &HMC{
+					L:     5,
+					Eps:   0.1,
+					Stats: stats,
+				}
+			},
+		},
+		{
+			func(stats chan Stats) MCMC {
+				return &NUTS{
+					Eps:   0.1,
+					Stats: stats,
+				}
+			},
+		},
+		{
+			func(stats chan Stats) MCMC {
+				return &MNUTS{
+					Eps:   0.1,
+					Stats: stats,
+				}
+			},
+		},
+		{
+			func(stats chan Stats) MCMC {
+				return &RWM{
+					Scale:  0.1,
+					NAdapt: -1,
+					Stats:  stats,
+				}
+			},
+		},
+		{
+			func(stats chan Stats) MCMC {
+				return &Slice{
+					Width: 0.1,
+					Stats: stats,
+				}
+			},
+		},
+	} {
+		m := &testModel{testData}
+		samples := make(chan []float64)
+		stats := make(chan Stats)
+		sampler := c.sampler(stats)
+		sampler.Sample(m, []float64{0.1, 0.1}, samples)
+		var xs [][]float64
+		var ss []Stats
+		for i := 0; i != niter; i++ {
+			xs = append(xs, clone(<-samples))
+			ss = append(ss, <-stats)
+		}
+		sampler.Stop()
+		if _, ok := <-stats; ok {
+			t.Errorf("%T: stats not closed", sampler)
+		}
+		for i, s := range ss {
+			l := m.Observe(xs[i])
+			ad.Pop()
+			if math.Abs(s.LogDensity-l) > 1e-9 {
+				t.Errorf("%T: wrong log density: got %.6g, want %.6g",
+					sampler, s.LogDensity, l)
+			}
+			if s.Accept < 0 || s.Accept > 1 {
+				t.Errorf("%T: invalid acceptance statistic %.4g",
+					sampler, s.Accept)
+			}
+			if s.StepSize != 0.1 {
+				t.Errorf("%T: wrong step size: got %.4g, want 0.1",
+					sampler, s.StepSize)
+			}
+			if s.NLeapfrog < 1 || s.NLeapfrog < 1<<uint(s.Depth)-1 {
+				t.Errorf("%T: %d leapfrog steps for depth %d",
+					sampler, s.NLeapfrog, s.Depth)
+			}
+		}
+	}
+}
+
+// A separable model: the prior on x is Normal(0, 1), and a
+// single observation 2 is drawn from Normal(x, 1).
+// Differentiated by deriv from
+//
+//	func (m *sepModel) Observe(x []float64) float64 {
+//		return m.LogPrior(x) + m.LogLikelihood(x)
+//	}
+//
+//	func (m *sepModel) LogPrior(x []float64) float64 {
+//		return -0.5 * x[0] * x[0]
+//	}
+//
+//	func (m *sepModel) LogLikelihood(x []float64) float64 {
+//		d := x[0] - 2
+//		return -0.5 * d * d
+//	}
+type sepModel struct{}
+
+func (m *sepModel) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpAdd,
+		ad.Call(func(_ []float64) {
+			m.LogPrior(x)
+		}, 0),
+		ad.Call(func(_ []float64) {
+			m.LogLikelihood(x)
+		}, 0)))
+}
+
+func (m *sepModel) LogPrior(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul,
+		ad.Arithmetic(ad.OpMul, ad.Value(-0.5), &x[0]), &x[0]))
+}
+
+func (m *sepModel) LogLikelihood(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	var d float64
+	ad.Assignment(&d, ad.Arithmetic(ad.OpSub, &x[0], ad.Value(2)))
+	return ad.Return(ad.Arithmetic(ad.OpMul,
+		ad.Arithmetic(ad.OpMul, ad.Value(-0.5), &d), &d))
+}
+
+// Tempered samplers sample from the power posterior, with
+// mean 2beta/(1 + beta) and variance 1/(1 + beta).
+func TestTemper(t *testing.T) {
+	nattempts := 5
+	niter := 1000
+	for _, beta := range []float64{0, 0.25, 1} {
+		for _, sampler := range []func() MCMC{
+			func() MCMC { return &HMC{L: 5, Eps: 0.3} },
+			func() MCMC { return &NUTS{Eps: 0.3} },
+		} {
+			mean := 2 * beta / (1 + beta)
+			variance := 1 / (1 + beta)
+			if !repeatedly(nattempts,
+				func() bool {
+					s := sampler()
+					s.(interface{ Temper(float64) }).Temper(beta)
+					samples := make(chan []float64)
+					s.Sample(&sepModel{}, []float64{0}, samples)
+					s1, s2 := 0., 0.
+					for i := 0; i != niter; i++ {
+						x := (<-samples)[0]
+						s1 += x
+						s2 += x * x
+					}
+					s.Stop()
+					m := s1 / float64(niter)
+					v := s2/float64(niter) - m*m
+					return math.Abs(m-mean) < 0.15 &&
+						math.Abs(v-variance) < 0.2
+				},
+				true) {
+				t.Errorf("%T did not converge for beta=%.2g",
+					sampler(), beta)
+			}
+		}
+	}
+	// The model must be separable.
+	defer func() {
+		if recover() == nil {
+			t.Errorf("tempered model not implementing " +
+				"model.Separable did not panic")
+		}
+	}()
+	hmc := &HMC{}
+	hmc.Temper(0.5)
+	hmc.Sample(&testModel{testData}, []float64{0, 0},
+		make(chan []float64))
+}
+
+// A model which is not differentiated: the density of the
+// standard Laplace distribution, with mean 0 and variance 2.
+type laplaceModel struct{}
+
+func (m *laplaceModel) Observe(x []float64) float64 {
+	return -math.Abs(x[0])
+}
+
+func (m *laplaceModel) Gradient() []float64 {
+	panic("gradient of a non-differentiable model")
+}
+
+// Gradient-free samplers do not compute the gradient.
+func TestGradientFree(t *testing.T) {
+	nattempts := 5
+	niter := 5000
+	for _, c := range []struct {
+		sampler func() MCMC
+	}{
+		{func() MCMC { return &RWM{NAdapt: 200} }},
+		{func() MCMC { return &Slice{} }},
+		{func() MCMC { return &Slice{Width: 4, Multivariate: true} }},
+	} {
+		if !repeatedly(nattempts,
+			func() bool {
+				s := c.sampler()
+				samples := make(chan []float64)
+				s.Sample(&laplaceModel{}, []float64{0}, samples)
+				s1, s2 := 0., 0.
+				for i := 0; i != niter; i++ {
+					x := (<-samples)[0]
+					s1 += x
+					s2 += x * x
+				}
+				s.Stop()
+				if err := samplerErr(s); err != nil {
+					t.Fatalf("%T failed: %v", s, err)
+				}
+				m := s1 / float64(niter)
+				v := s2/float64(niter) - m*m
+				return math.Abs(m) < 0.2 && math.Abs(v-2) < 0.4
+			},
+			true) {
+			t.Errorf("%T did not converge", c.sampler())
+		}
+	}
+}
+
 func TestNUTSDepth(t *testing.T) {
 	nuts := &NUTS{}
 	for _, c := range []struct {
@@ -0,0 +1,180 @@
+package infer
+
+// Mass matrices of Hamiltonian Monte Carlo variants.
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Metric is the mass matrix M of HMC variants. The inverse of
+// the mass matrix should approximate the covariance of the
+// posterior.
+type Metric interface {
+	// Momentum draws momentum r from Normal(0, M).
+	Momentum(rng *rand.Rand, r []float64)
+	// Kinetic returns the kinetic energy r'M⁻¹r/2.
+	Kinetic(r []float64) float64
+	// Velocity computes v = M⁻¹r.
+	Velocity(v, r []float64)
+}
+
+// unitMetric is the identity mass matrix, used when the mass
+// matrix is not specified.
+type unitMetric struct{}
+
+func (unitMetric) Momentum(rng *rand.Rand, r []float64) {
+	for i := range r {
+		r[i] = rng.NormFloat64()
+	}
+}
+
+func (unitMetric) Kinetic(r []float64) float64 {
+	k := 0.
+	for _, ri := range r {
+		k += ri * ri
+	}
+	return 0.5 * k
+}
+
+func (unitMetric) Velocity(v, r []float64) {
+	copy(v, r)
+}
+
+// DiagMetric is a diagonal mass matrix.
+type DiagMetric struct {
+	InvMass []float64 // diagonal of the inverse mass matrix
+}
+
+func (metric *DiagMetric) Momentum(rng *rand.Rand, r []float64) {
+	for i := range r {
+		r[i] = rng.NormFloat64() / math.Sqrt(metric.InvMass[i])
+	}
+}
+
+func (metric *DiagMetric) Kinetic(r []float64) float64 {
+	k := 0.
+	for i, ri := range r {
+		k += metric.InvMass[i] * ri * ri
+	}
+	return 0.5 * k
+}
+
+func (metric *DiagMetric) Velocity(v, r []float64) {
+	for i := range r {
+		v[i] = metric.InvMass[i] * r[i]
+	}
+}
+
+// DenseMetric is a dense mass matrix, created by
+// NewDenseMetric. The inverse mass matrix is replaced through
+// SetInvMass, which keeps the Cholesky factor up to date.
+type DenseMetric struct {
+	invMass [][]float64 // inverse mass matrix
+	chol    [][]float64 // Cholesky factor of invMass
+}
+
+// NewDenseMetric returns the dense mass matrix with inverse
+// invMass.
+func NewDenseMetric(invMass [][]float64) *DenseMetric {
+	metric := &DenseMetric{}
+	metric.SetInvMass(invMass)
+	return metric
+}
+
+// InvMass returns the inverse mass matrix.
+func (metric *DenseMetric) InvMass() [][]float64 {
+	return metric.invMass
+}
+
+// SetInvMass sets the inverse mass matrix and computes its
+// Cholesky factor. SetInvMass panics if invMass is not positive
+// definite.
+func (metric *DenseMetric) SetInvMass(invMass [][]float64) {
+	chol, ok := cholesky(invMass)
+	if !ok {
+		panic("mass matrix is not positive definite")
+	}
+	metric.invMass, metric.chol = invMass, chol
+}
+
+// Momentum draws r = L'⁻¹z, where z is drawn from
+// Normal(0, I) and LL' = M⁻¹.
+func (metric *DenseMetric) Momentum(rng *rand.Rand, r []float64) {
+	l := metric.chol
+	for i := range r {
+		r[i] = rng.NormFloat64()
+	}
+	// Back substitution.
+	for i := len(r) - 1; i >= 0; i-- {
+		for j := i + 1; j != len(r); j++ {
+			r[i] -= l[j][i] * r[j]
+		}
+		r[i] /= l[i][i]
+	}
+}
+
+func (metric *DenseMetric) Kinetic(r []float64) float64 {
+	k := 0.
+	for i := range r {
+		for j := range r {
+			k += r[i] * metric.invMass[i][j] * r[j]
+		}
+	}
+	return 0.5 * k
+}
+
+func (metric *DenseMetric) Velocity(v, r []float64) {
+	for i := range r {
+		v[i] = 0
+		for j := range r {
+			v[i] += metric.invMass[i][j] * r[j]
+		}
+	}
+}
+
+// cholesky returns the lower-triangular Cholesky factor of
+// symmetric matrix a, and false if a is not positive definite.
+func cholesky(a [][]float64) ([][]float64, bool) {
+	l := make([][]float64, len(a))
+	for i := range l {
+		l[i] = make([]float64, len(a))
+	}
+	for i := range a {
+		for j := 0; j <= i; j++ {
+			s := a[i][j]
+			for k := 0; k != j; k++ {
+				s -= l[i][k] * l[j][k]
+			}
+			if i == j {
+				if !(s > 0) {
+					return nil, false
+				}
+				l[i][i] = math.Sqrt(s)
+			} else {
+				l[i][j] = s / l[j][j]
+			}
+		}
+	}
+	return l, true
+}
+
+// drift advances x by eps M⁻¹r.
+func drift(metric Metric, x, r []float64, eps float64) {
+	switch metric := metric.(type) {
+	case unitMetric:
+		for i := range x {
+			x[i] += eps * r[i]
+		}
+	case *DiagMetric:
+		for i := range x {
+			x[i] += eps * metric.InvMass[i] * r[i]
+		}
+	default:
+		v := make([]float64, len(x))
+		metric.Velocity(v, r)
+		for i := range x {
+			x[i] += eps * v[i]
+		}
+	}
+}
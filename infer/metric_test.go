@@ -0,0 +1,92 @@
+package infer
+
+// Testing mass matrices.
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	for _, c := range []struct {
+		metric  Metric
+		mass    [][]float64 // inverse of the inverse mass matrix
+		r       []float64
+		kinetic float64
+		v       []float64
+	}{
+		{
+			unitMetric{},
+			[][]float64{{1, 0}, {0, 1}},
+			[]float64{1, 2},
+			2.5,
+			[]float64{1, 2},
+		},
+		{
+			&DiagMetric{InvMass: []float64{4, 0.25}},
+			[][]float64{{0.25, 0}, {0, 4}},
+			[]float64{1, 2},
+			2.5,
+			[]float64{4, 0.5},
+		},
+		{
+			NewDenseMetric([][]float64{{2, 1}, {1, 1}}),
+			[][]float64{{1, -1}, {-1, 2}},
+			[]float64{1, 2},
+			5,
+			[]float64{4, 3},
+		},
+		{
+			// The Cholesky factor follows the inverse mass
+			// matrix when the matrix is replaced.
+			func() Metric {
+				metric := NewDenseMetric([][]float64{{1, 0}, {0, 1}})
+				metric.SetInvMass([][]float64{{2, 1}, {1, 1}})
+				return metric
+			}(),
+			[][]float64{{1, -1}, {-1, 2}},
+			[]float64{1, 2},
+			5,
+			[]float64{4, 3},
+		},
+	} {
+		kinetic := c.metric.Kinetic(c.r)
+		if math.Abs(kinetic-c.kinetic) > 1e-6 {
+			t.Errorf("%T: wrong kinetic energy of %v: "+
+				"got %.4g, want %.4g",
+				c.metric, c.r, kinetic, c.kinetic)
+		}
+		v := make([]float64, len(c.r))
+		c.metric.Velocity(v, c.r)
+		for i := range v {
+			if math.Abs(v[i]-c.v[i]) > 1e-6 {
+				t.Errorf("%T: wrong velocity of %v: got %v, want %v",
+					c.metric, c.r, v, c.v)
+				break
+			}
+		}
+		// Momentum is drawn from Normal(0, M).
+		rng := rand.New(rand.NewSource(1))
+		n := 100000
+		r := make([]float64, len(c.r))
+		cov := [][]float64{{0, 0}, {0, 0}}
+		for k := 0; k != n; k++ {
+			c.metric.Momentum(rng, r)
+			for i := range r {
+				for j := range r {
+					cov[i][j] += r[i] * r[j] / float64(n)
+				}
+			}
+		}
+		for i := range cov {
+			for j := range cov[i] {
+				if math.Abs(cov[i][j]-c.mass[i][j]) > 0.05 {
+					t.Errorf("%T: wrong momentum covariance: "+
+						"got %v, want %v", c.metric, cov, c.mass)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package infer
+
+// Multinomial No U-Turn Sampler.
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/model"
+	"math"
+	"math/rand"
+)
+
+// Multinomial No U-Turn Sampler
+// (https://arxiv.org/abs/1701.02434). The sample is drawn
+// from the trajectory with probabilities proportional to
+// the densities of the trajectory states, with biased
+// progressive sampling between subtrees. The trajectory is
+// extended until the generalized no-U-turn criterion on the
+// summed momenta is violated, the maximum depth is reached, or
+// a divergence is encountered.
+type MNUTS struct {
+	sampler
+	// Parameters
+	Eps      float64 // step size
+	MaxDepth int     // maximum depth
+	// Energy error above which the trajectory diverges
+	MaxEnergyError float64
+	// Mass matrix and adapter, see HMC
+	Metric  Metric
+	Adapter Adapter
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
+	// Iteration statistics, see HMC.Stats
+	Stats chan Stats
+	// Acceptance statistic of the current iteration: initial
+	// energy, sum and number of acceptance probabilities
+	e0, alpha, nalpha float64
+	divergent         bool // the current trajectory diverged
+}
+
+// point is a point in the phase space, with the gradient.
+type point struct {
+	x, r, grad []float64
+}
+
+// subtree summarizes a subtree of the trajectory. The ends of
+// a subtree are in the order of integration.
+type subtree struct {
+	x          []float64 // sample
+	l          float64   // log density of the sample
+	logw       float64   // log of the sum of state weights
+	rho        []float64 // sum of momenta
+	pBeg, pEnd []float64 // momenta at the ends
+	vBeg, vEnd []float64 // velocities at the ends
+}
+
+func (mnuts *MNUTS) Sample(
+	m model.Model,
+	x []float64,
+	samples chan []float64,
+) {
+	mnuts.setDefaults()
+	mnuts.start(samples, mnuts.Stats)
+	m = mnuts.temper(m)
+	go func() {
+		// On exit:
+		// * close samples, after the tape is dropped so that
+		// Stop returns when the sampler is done with the tape;
+		defer close(samples)
+		// * close stats;
+		defer mnuts.closeStats()
+		// * drop the tape;
+		defer ad.DropTape()
+		// * intercept errors deep inside the algorithm
+		// and report them.
+		defer mnuts.intercept("MNUTS")
+
+		r := make([]float64, len(x))
+		grad := make([]float64, len(x))
+		for {
+			if !mnuts.next() {
+				break
+			}
+
+			// Sample the next r.
+			mnuts.Metric.Momentum(mnuts.Rand, r)
+
+			// Compute the energy.
+			l := m.Observe(x)
+			model.GradientInto(m, grad)
+			mnuts.e0 = energy(l, r, mnuts.Metric)
+			mnuts.alpha, mnuts.nalpha = 0, 0
+			mnuts.divergent = false
+
+			// Initialize the tree.
+			v := make([]float64, len(r))
+			mnuts.Metric.Velocity(v, r)
+			tree := subtree{
+				x:    x,
+				l:    l,
+				logw: 0,
+				rho:  clone(r),
+				pBeg: clone(r), pEnd: clone(r),
+				vBeg: v, vEnd: v,
+			}
+			bck := point{clone(x), clone(r), clone(grad)}
+			fwd := point{clone(x), clone(r), clone(grad)}
+
+			accepted := false
+			depth := 0
+			for ; depth != mnuts.MaxDepth; depth++ {
+				// Extend the trajectory forward or backward.
+				// The trees are joined in the order of time.
+				var (
+					sub        subtree
+					valid      bool
+					bck_, fwd_ subtree
+				)
+				if mnuts.Rand.Float64() > 0.5 {
+					sub, valid = mnuts.buildTree(m, &fwd, 1, depth)
+					bck_, fwd_ = tree, sub
+				} else {
+					sub, valid = mnuts.buildTree(m, &bck, -1, depth)
+					bck_, fwd_ = sub.reverse(), tree
+				}
+				if !valid {
+					break
+				}
+
+				// Biased progressive sampling.
+				if mnuts.Rand.Float64() < math.Exp(sub.logw-tree.logw) {
+					accepted = true
+					tree.x, tree.l = sub.x, sub.l
+				}
+
+				var persist bool
+				x_, l_ := tree.x, tree.l
+				tree, persist = join(bck_, fwd_)
+				tree.x, tree.l = x_, l_
+				tree.logw = logSumExp(bck_.logw, fwd_.logw)
+				if !persist {
+					break
+				}
+			}
+			x = tree.x
+
+			// Collect statistics
+			if accepted {
+				mnuts.NAcc++
+			} else {
+				mnuts.NRej++
+			}
+			if mnuts.divergent {
+				mnuts.NDiv++
+			}
+
+			accept := 0.
+			if mnuts.nalpha > 0 {
+				accept = mnuts.alpha / mnuts.nalpha
+			}
+
+			// Adapt the parameters.
+			eps := mnuts.Eps
+			if mnuts.Adapter != nil {
+				mnuts.Adapter.Adapt(&mnuts.Eps, &mnuts.Metric, x, accept)
+			}
+
+			// Write a sample to the channel.
+			samples <- x
+			mnuts.report(Stats{
+				LogDensity: tree.l,
+				Accept:     accept,
+				StepSize:   eps,
+				Depth:      depth,
+				NLeapfrog:  int(mnuts.nalpha),
+				Energy:     mnuts.e0,
+				Divergent:  mnuts.divergent,
+			})
+		}
+	}()
+}
+
+// buildTree builds a subtree of the given depth from point z
+// in direction dir. z is advanced to the end of the subtree.
+// buildTree returns the subtree and false if the subtree
+// diverges or violates the no-U-turn criterion.
+func (mnuts *MNUTS) buildTree(
+	m model.Model,
+	z *point,
+	dir float64,
+	depth int,
+) (subtree, bool) {
+	if depth == 0 {
+		// Base case: single leapfrog.
+		l, _ := leapfrog(m, mnuts.Metric, z.grad, z.x, z.r,
+			dir*mnuts.Eps)
+		e := energy(l, z.r, mnuts.Metric)
+		mnuts.alpha += acceptStat(e - mnuts.e0)
+		mnuts.nalpha++
+		if diverged(mnuts.e0, e, mnuts.MaxEnergyError) {
+			mnuts.divergent = true
+			return subtree{}, false
+		}
+		p := clone(z.r)
+		v := make([]float64, len(p))
+		mnuts.Metric.Velocity(v, p)
+		return subtree{
+			x:    clone(z.x),
+			l:    l,
+			logw: e - mnuts.e0,
+			rho:  clone(p),
+			pBeg: p, pEnd: p,
+			vBeg: v, vEnd: v,
+		}, true
+	}
+
+	init, valid := mnuts.buildTree(m, z, dir, depth-1)
+	if !valid {
+		return subtree{}, false
+	}
+	final, valid := mnuts.buildTree(m, z, dir, depth-1)
+	if !valid {
+		return subtree{}, false
+	}
+
+	tree, persist := join(init, final)
+	// Multinomial sampling from the joined subtrees.
+	tree.logw = logSumExp(init.logw, final.logw)
+	tree.x, tree.l = init.x, init.l
+	if mnuts.Rand.Float64() < math.Exp(final.logw-tree.logw) {
+		tree.x, tree.l = final.x, final.l
+	}
+	return tree, persist
+}
+
+// join joins adjacent subtrees a and b, a preceding b, and
+// returns the joined subtree, without the sample and the
+// weight, and false if the joined subtree violates the
+// no-U-turn criterion. The criterion is checked for the
+// joined subtree, as well as for each subtree extended by the
+// adjacent state of the other subtree.
+func join(a, b subtree) (subtree, bool) {
+	rho := make([]float64, len(a.rho))
+	rhoA := make([]float64, len(a.rho))
+	rhoB := make([]float64, len(a.rho))
+	for i := range rho {
+		rho[i] = a.rho[i] + b.rho[i]
+		rhoA[i] = a.rho[i] + b.pBeg[i]
+		rhoB[i] = b.rho[i] + a.pEnd[i]
+	}
+	persist := noUTurn(a.vBeg, b.vEnd, rho) &&
+		noUTurn(a.vBeg, b.vBeg, rhoA) &&
+		noUTurn(a.vEnd, b.vEnd, rhoB)
+	return subtree{
+		rho:  rho,
+		pBeg: a.pBeg, pEnd: b.pEnd,
+		vBeg: a.vBeg, vEnd: b.vEnd,
+	}, persist
+}
+
+// reverse returns the subtree with the ends swapped.
+func (t subtree) reverse() subtree {
+	t.pBeg, t.pEnd = t.pEnd, t.pBeg
+	t.vBeg, t.vEnd = t.vEnd, t.vBeg
+	return t
+}
+
+// noUTurn is the generalized no-U-turn criterion: the
+// velocities at both ends point in the direction of the
+// summed momenta rho.
+func noUTurn(vBeg, vEnd, rho []float64) bool {
+	dotBeg, dotEnd := 0., 0.
+	for i := range rho {
+		dotBeg += vBeg[i] * rho[i]
+		dotEnd += vEnd[i] * rho[i]
+	}
+	return dotBeg > 0 && dotEnd > 0
+}
+
+// logSumExp returns log(exp(a) + exp(b)).
+func logSumExp(a, b float64) float64 {
+	if math.IsInf(a, -1) {
+		return b
+	}
+	if math.IsInf(b, -1) {
+		return a
+	}
+	m := math.Max(a, b)
+	return m + math.Log(math.Exp(a-m)+math.Exp(b-m))
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (mnuts *MNUTS) setDefaults() {
+	if mnuts.MaxDepth == 0 {
+		mnuts.MaxDepth = 10
+	}
+	if mnuts.MaxEnergyError == 0 {
+		mnuts.MaxEnergyError = 1000
+	}
+	if mnuts.Metric == nil {
+		mnuts.Metric = unitMetric{}
+	}
+	mnuts.Rand = defaultRand(mnuts.Rand)
+}
+
+// setRand sets the random number generator unless already set.
+func (mnuts *MNUTS) setRand(rng *rand.Rand) {
+	if mnuts.Rand == nil {
+		mnuts.Rand = rng
+	}
+}
@@ -0,0 +1,78 @@
+package infer
+
+// Testing multinomial NUTS helpers.
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNoUTurn(t *testing.T) {
+	for _, c := range []struct {
+		vBeg, vEnd, rho []float64
+		noUTurn         bool
+	}{
+		{
+			[]float64{1, 0}, []float64{1, 1},
+			[]float64{2, 1},
+			true,
+		},
+		{
+			[]float64{1, 0}, []float64{-1, 0},
+			[]float64{1, 0},
+			false,
+		},
+		{
+			[]float64{-1, 0}, []float64{1, 0},
+			[]float64{1, 0},
+			false,
+		},
+	} {
+		if noUTurn(c.vBeg, c.vEnd, c.rho) != c.noUTurn {
+			t.Errorf("wrong criterion for %+v", c)
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	a := subtree{
+		rho:  []float64{1, 0},
+		pBeg: []float64{1, 0}, pEnd: []float64{1, 0},
+		vBeg: []float64{1, 0}, vEnd: []float64{1, 0},
+	}
+	b := subtree{
+		rho:  []float64{1, 1},
+		pBeg: []float64{1, 1}, pEnd: []float64{0, 1},
+		vBeg: []float64{1, 1}, vEnd: []float64{0, 1},
+	}
+	tree, persist := join(a, b)
+	if !persist {
+		t.Errorf("false U-turn")
+	}
+	if tree.rho[0] != 2 || tree.rho[1] != 1 {
+		t.Errorf("wrong sum of momenta: got %v, want %v",
+			tree.rho, []float64{2, 1})
+	}
+	// A U-turn inside b extended by the end of a.
+	b.vBeg = []float64{-1, 0}
+	b.rho = []float64{-1, 0}
+	if _, persist := join(a, b); persist {
+		t.Errorf("missed U-turn between subtrees")
+	}
+}
+
+func TestLogSumExp(t *testing.T) {
+	for _, c := range []struct {
+		a, b, s float64
+	}{
+		{0, 0, math.Log(2)},
+		{math.Inf(-1), 1, 1},
+		{1, math.Inf(-1), 1},
+		{-1000, -1000, -1000 + math.Log(2)},
+	} {
+		if s := logSumExp(c.a, c.b); math.Abs(s-c.s) > 1e-9 {
+			t.Errorf("wrong logSumExp(%v, %v): got %.6g, want %.6g",
+				c.a, c.b, s, c.s)
+		}
+	}
+}
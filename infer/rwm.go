@@ -0,0 +1,198 @@
+package infer
+
+// Adaptive random-walk Metropolis.
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/model"
+	"math"
+	"math/rand"
+)
+
+// RWM is adaptive random-walk Metropolis
+// (https://doi.org/10.2307/3318737). The proposal is drawn
+// from a Gaussian centered at the current state. During the
+// first NAdapt iterations, the covariance of the proposal is
+// adapted to the covariance of the chain, and the scale of the
+// proposal is adapted toward the target acceptance rate.
+// Samples of adaptation iterations should be discarded. A
+// negative NAdapt turns the adaptation off.
+//
+// RWM does not use the gradient and is suitable for models
+// which cannot be differentiated; the gradient computed by
+// Observe is dropped.
+type RWM struct {
+	sampler
+	// Parameters
+	Scale        float64 // proposal scale, 2.38/sqrt(len(x)) by default
+	NAdapt       int     // number of adaptation iterations, 500 by default
+	TargetAccept float64 // target acceptance rate, 0.234 by default
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
+	// Stats, see HMC.Stats; StepSize is the proposal scale
+	Stats chan Stats
+	// Adaptation state
+	n    float64     // number of adaptation samples
+	mean []float64   // mean of samples
+	m2   [][]float64 // sums of squared deviations
+	chol [][]float64 // Cholesky factor of the proposal covariance
+}
+
+func (rwm *RWM) Sample(
+	m model.Model,
+	x []float64,
+	samples chan []float64,
+) {
+	rwm.setDefaults(len(x))
+	rwm.start(samples, rwm.Stats)
+	m = rwm.temper(m)
+	go func() {
+		// On exit:
+		// * close samples, after the tape is dropped so that
+		// Stop returns when the sampler is done with the tape;
+		defer close(samples)
+		// * close stats;
+		defer rwm.closeStats()
+		// * drop the tape;
+		defer ad.DropTape()
+		// * intercept errors deep inside the algorithm
+		// and report them.
+		defer rwm.intercept("RWM")
+
+		step := make([]float64, len(x))
+		l := 0.
+		for iter := 0; ; iter++ {
+			if !rwm.next() {
+				break
+			}
+			if iter == 0 || rwm.gate != nil {
+				// The model may have changed while the
+				// sampler was waiting.
+				l = logDensity(m, x)
+			}
+
+			// Propose a move.
+			rwm.propose(step)
+			x_ := clone(x)
+			for i := range x_ {
+				x_[i] += rwm.Scale * step[i]
+			}
+			l_ := logDensity(m, x_)
+
+			// Accept with MH probability.
+			accept := acceptStat(l_ - l)
+			if l_-l >= math.Log(1-rwm.Rand.Float64()) {
+				x = x_
+				l = l_
+				rwm.NAcc++
+			} else {
+				rwm.NRej++
+			}
+
+			// Adapt the proposal.
+			scale := rwm.Scale
+			if iter < rwm.NAdapt {
+				rwm.adapt(x, accept)
+			}
+
+			// Write a sample to the channel.
+			samples <- x
+			rwm.report(Stats{
+				LogDensity: l,
+				Accept:     accept,
+				StepSize:   scale,
+				NLeapfrog:  1,
+				Energy:     l,
+			})
+		}
+	}()
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (rwm *RWM) setDefaults(n int) {
+	if rwm.Scale == 0 {
+		rwm.Scale = 2.38 / math.Sqrt(float64(n))
+	}
+	if rwm.NAdapt == 0 {
+		// Half of the default warmup, see Warmup.
+		rwm.NAdapt = 500
+	}
+	if rwm.TargetAccept == 0 {
+		rwm.TargetAccept = 0.234
+	}
+	rwm.Rand = defaultRand(rwm.Rand)
+}
+
+// setRand sets the random number generator unless already set.
+func (rwm *RWM) setRand(rng *rand.Rand) {
+	if rwm.Rand == nil {
+		rwm.Rand = rng
+	}
+}
+
+// propose draws the proposal step from Normal(0, Σ), where Σ
+// is the adapted covariance, or the identity matrix before
+// the covariance is estimated.
+func (rwm *RWM) propose(step []float64) {
+	for i := range step {
+		step[i] = rwm.Rand.NormFloat64()
+	}
+	if rwm.chol == nil {
+		return
+	}
+	// Multiply by the lower-triangular factor in place, from
+	// the last row up.
+	for i := len(step) - 1; i >= 0; i-- {
+		s := 0.
+		for j := 0; j <= i; j++ {
+			s += rwm.chol[i][j] * step[j]
+		}
+		step[i] = s
+	}
+}
+
+// adapt updates the proposal scale by stochastic
+// approximation toward the target acceptance rate, and the
+// proposal covariance by Welford's algorithm. The covariance
+// is used once there are more samples than twice the number
+// of parameters.
+func (rwm *RWM) adapt(x []float64, accept float64) {
+	if rwm.mean == nil {
+		rwm.mean = make([]float64, len(x))
+		rwm.m2 = make([][]float64, len(x))
+		for i := range rwm.m2 {
+			rwm.m2[i] = make([]float64, len(x))
+		}
+	}
+	rwm.n++
+	rwm.Scale *= math.Exp((accept - rwm.TargetAccept) /
+		math.Pow(rwm.n, 0.6))
+
+	delta := make([]float64, len(x))
+	for i := range x {
+		delta[i] = x[i] - rwm.mean[i]
+		rwm.mean[i] += delta[i] / rwm.n
+	}
+	for i := range x {
+		for j := range x {
+			rwm.m2[i][j] += delta[i] * (x[j] - rwm.mean[j])
+		}
+	}
+	if rwm.n <= float64(2*len(x)) {
+		return
+	}
+
+	cov := make([][]float64, len(x))
+	for i := range cov {
+		cov[i] = make([]float64, len(x))
+		for j := range cov[i] {
+			cov[i][j] = rwm.m2[i][j] / (rwm.n - 1)
+		}
+		// Regularize, so that the covariance is positive
+		// definite when the chain is stuck.
+		cov[i][i] += 1e-6
+	}
+	if chol, ok := cholesky(cov); ok {
+		rwm.chol = chol
+	}
+}
@@ -5,7 +5,6 @@ package infer
 import (
 	"bitbucket.org/dtolpin/infergo/ad"
 	"bitbucket.org/dtolpin/infergo/model"
-	"log"
 	"math"
 	"math/rand"
 )
@@ -20,6 +19,8 @@ type SgHMC struct {
 	Eta   float64 // learning rate
 	Alpha float64 // friction (1 - momentum)
 	V     float64 // diffusion
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
 }
 
 func (sghmc *SgHMC) Sample(
@@ -28,20 +29,18 @@ func (sghmc *SgHMC) Sample(
 	samples chan []float64,
 ) {
 	sghmc.setDefaults()
-	sghmc.samples = samples // Stop needs access to samples
+	sghmc.start(samples, nil)
+	m = sghmc.temper(m)
 	go func() {
 		// On exit:
+		// * close samples, after the tape is dropped so that
+		// Stop returns when the sampler is done with the tape;
+		defer close(samples)
 		// * drop the tape;
 		defer ad.DropTape()
-		// * close samples;
-		defer close(samples)
 		// * intercept errors deep inside the algorithm
 		// and report them.
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("ERROR: SgHMC: %v", r)
-			}
-		}()
+		defer sghmc.intercept("SgHMC")
 
 		var sigma float64
 		{
@@ -56,7 +55,7 @@ func (sghmc *SgHMC) Sample(
 
 		r := make([]float64, len(x))
 		for {
-			if sghmc.stop {
+			if !sghmc.next() {
 				break
 			}
 			// For compatibility with HMC, we advance L steps
@@ -65,14 +64,15 @@ func (sghmc *SgHMC) Sample(
 				_, grad := m.Observe(x), model.Gradient(m)
 				for j := range r {
 					r[j] += sghmc.Eta*grad[j] - sghmc.Alpha*r[j] +
-						rand.NormFloat64()*sigma
+						sghmc.Rand.NormFloat64()*sigma
 					x[j] += r[j]
 				}
 			}
 			sghmc.NAcc++
 
-			// Write a sample to the channel.
-			samples <- x
+			// Write a sample to the channel. x is updated in
+			// place, hence a copy is written.
+			samples <- clone(x)
 		}
 	}()
 }
@@ -82,4 +82,12 @@ func (sghmc *SgHMC) setDefaults() {
 	if sghmc.L == 0 {
 		sghmc.L = 10
 	}
+	sghmc.Rand = defaultRand(sghmc.Rand)
+}
+
+// setRand sets the random number generator unless already set.
+func (sghmc *SgHMC) setRand(rng *rand.Rand) {
+	if sghmc.Rand == nil {
+		sghmc.Rand = rng
+	}
 }
@@ -0,0 +1,201 @@
+package infer
+
+// Slice sampling.
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"bitbucket.org/dtolpin/infergo/model"
+	"math"
+	"math/rand"
+)
+
+// Slice is slice sampling (https://doi.org/10.1214/aos/1056562461).
+// By default, the coordinates are updated in turn, each by
+// univariate slice sampling with stepping out and shrinkage.
+// If Multivariate is true, all coordinates are updated at once
+// within a hyperrectangle, which is shrunk toward the current
+// state.
+//
+// Slice does not use the gradient and is suitable for models
+// which cannot be differentiated; the gradient computed by
+// Observe is dropped.
+type Slice struct {
+	sampler
+	// Parameters
+	Width        float64 // initial width of the interval, 1 by default
+	MaxSteps     int     // maximum steps out, unlimited if 0
+	Multivariate bool    // update all coordinates at once
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
+	// Stats, see HMC.Stats; NLeapfrog is the number of
+	// evaluations of the model
+	Stats chan Stats
+}
+
+func (slice *Slice) Sample(
+	m model.Model,
+	x []float64,
+	samples chan []float64,
+) {
+	slice.setDefaults()
+	slice.start(samples, slice.Stats)
+	m = slice.temper(m)
+	go func() {
+		// On exit:
+		// * close samples, after the tape is dropped so that
+		// Stop returns when the sampler is done with the tape;
+		defer close(samples)
+		// * close stats;
+		defer slice.closeStats()
+		// * drop the tape;
+		defer ad.DropTape()
+		// * intercept errors deep inside the algorithm
+		// and report them.
+		defer slice.intercept("Slice")
+
+		for {
+			if !slice.next() {
+				break
+			}
+			l := logDensity(m, x)
+			if math.IsNaN(l) || math.IsInf(l, -1) {
+				panic("zero density at the current state")
+			}
+			// The update is computed on a copy, so that samples
+			// already written are not modified.
+			x = clone(x)
+			var nevals int
+			if slice.Multivariate {
+				l, nevals = slice.updateAll(m, x, l)
+			} else {
+				for i := range x {
+					var n int
+					l, n = slice.update(m, x, i, l)
+					nevals += n
+				}
+			}
+			slice.NAcc++
+
+			// Write a sample to the channel.
+			samples <- x
+			slice.report(Stats{
+				LogDensity: l,
+				Accept:     1,
+				StepSize:   slice.Width,
+				NLeapfrog:  nevals,
+				Energy:     l,
+			})
+		}
+	}()
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (slice *Slice) setDefaults() {
+	if slice.Width == 0 {
+		slice.Width = 1
+	}
+	slice.Rand = defaultRand(slice.Rand)
+}
+
+// setRand sets the random number generator unless already set.
+func (slice *Slice) setRand(rng *rand.Rand) {
+	if slice.Rand == nil {
+		slice.Rand = rng
+	}
+}
+
+// update updates coordinate i of x, with log density l, in
+// place, and returns the log density of the updated state and
+// the number of evaluations of the model.
+func (slice *Slice) update(
+	m model.Model,
+	x []float64,
+	i int,
+	l float64,
+) (float64, int) {
+	nevals := 0
+	xi := x[i]
+	logp := func(xi_ float64) float64 {
+		nevals++
+		x[i] = xi_
+		return logDensity(m, x)
+	}
+
+	// Draw the slice level.
+	logy := l - slice.Rand.ExpFloat64()
+
+	// Step out.
+	left := xi - slice.Width*slice.Rand.Float64()
+	right := left + slice.Width
+	if slice.MaxSteps == 0 {
+		for logp(left) > logy {
+			left -= slice.Width
+		}
+		for logp(right) > logy {
+			right += slice.Width
+		}
+	} else {
+		j := slice.Rand.Intn(slice.MaxSteps)
+		k := slice.MaxSteps - 1 - j
+		for ; j > 0 && logp(left) > logy; j-- {
+			left -= slice.Width
+		}
+		for ; k > 0 && logp(right) > logy; k-- {
+			right += slice.Width
+		}
+	}
+
+	// Shrink.
+	for {
+		xi_ := left + (right-left)*slice.Rand.Float64()
+		l_ := logp(xi_)
+		if l_ > logy {
+			return l_, nevals
+		}
+		if xi_ < xi {
+			left = xi_
+		} else {
+			right = xi_
+		}
+	}
+}
+
+// updateAll updates all coordinates of x, with log density l,
+// in place, and returns the log density of the updated state
+// and the number of evaluations of the model.
+func (slice *Slice) updateAll(
+	m model.Model,
+	x []float64,
+	l float64,
+) (float64, int) {
+	x0 := clone(x)
+
+	// Draw the slice level.
+	logy := l - slice.Rand.ExpFloat64()
+
+	// Position the hyperrectangle randomly around x.
+	left := make([]float64, len(x))
+	right := make([]float64, len(x))
+	for i := range x {
+		left[i] = x[i] - slice.Width*slice.Rand.Float64()
+		right[i] = left[i] + slice.Width
+	}
+
+	// Shrink.
+	for nevals := 1; ; nevals++ {
+		for i := range x {
+			x[i] = left[i] + (right[i]-left[i])*slice.Rand.Float64()
+		}
+		l_ := logDensity(m, x)
+		if l_ > logy {
+			return l_, nevals
+		}
+		for i := range x {
+			if x[i] < x0[i] {
+				left[i] = x[i]
+			} else {
+				right[i] = x[i]
+			}
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package infer
+
+// Sequential Monte Carlo.
+
+import (
+	"bitbucket.org/dtolpin/infergo/model"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// SMC is sequential Monte Carlo with likelihood tempering
+// (https://doi.org/10.1111/j.1467-9868.2006.00553.x). The
+// particles, drawn from the prior, are annealed to the
+// posterior through a sequence of tempered posteriors, with
+// the likelihood raised to power beta increasing from 0 to 1
+// (see HMC.Temper). At each stage, the next beta is chosen so
+// that the conditional effective sample size of the
+// reweighted particles is TargetESS; the particles are
+// resampled if the effective sample size falls below
+// ResampleESS, and then moved by NMoves iterations of an MCMC
+// sampler targeting the tempered posterior. SMC explores
+// multimodal posteriors on which a single chain gets stuck,
+// and estimates the marginal likelihood.
+type SMC struct {
+	// Relative target conditional ESS, 0.9 by default
+	TargetESS float64
+	// Relative ESS below which the particles are resampled,
+	// 0.5 by default
+	ResampleESS float64
+	// Number of MCMC iterations per particle and stage, 5 by
+	// default
+	NMoves int
+	// Move returns a new sampler for moving a particle; the
+	// sampler must support tempering. If nil, the particles
+	// are moved by random-walk Metropolis with the proposal
+	// covariance estimated from the particles.
+	Move func() MCMC
+	// Random number generator, see HMC.Rand
+	Rand *rand.Rand
+	// Tempering schedule, available after the call to Run
+	Betas []float64
+}
+
+// tempering is implemented by samplers supporting tempering.
+type tempering interface {
+	Temper(beta float64)
+}
+
+// Run anneals particles x, drawn from the prior of model m,
+// to the posterior, and returns the weighted particles, the
+// normalized log weights, and the estimate of the log
+// marginal likelihood. The prior of m must be normalized for
+// the estimate to be the log marginal likelihood, but the
+// particles are correctly weighted regardless. Run returns an
+// error if a sampler moving the particles fails.
+func (smc *SMC) Run(
+	m model.Separable,
+	x [][]float64,
+) (
+	particles [][]float64,
+	logWeights []float64,
+	logEvidence float64,
+	err error,
+) {
+	smc.setDefaults()
+	n := len(x)
+	particles = make([][]float64, n)
+	logWeights = make([]float64, n)
+	ll := make([]float64, n)
+	for i := range x {
+		particles[i] = clone(x[i])
+		logWeights[i] = -math.Log(float64(n))
+		ll[i] = logLikelihood(m, particles[i])
+	}
+
+	beta := 0.
+	smc.Betas = []float64{beta}
+	for beta < 1 {
+		// Reweight the particles.
+		dbeta := smc.nextStep(logWeights, ll, 1-beta)
+		beta += dbeta
+		if 1-beta < 1e-12 {
+			beta = 1
+		}
+		smc.Betas = append(smc.Betas, beta)
+		for i := range logWeights {
+			if !math.IsNaN(ll[i]) {
+				logWeights[i] += dbeta * ll[i]
+			} else {
+				logWeights[i] = math.Inf(-1)
+			}
+		}
+		logZ := math.Inf(-1)
+		for _, lw := range logWeights {
+			logZ = logSumExp(logZ, lw)
+		}
+		if math.IsInf(logZ, -1) {
+			return nil, nil, logZ,
+				fmt.Errorf("all particles have zero weight "+
+					"at beta=%.4g", beta)
+		}
+		logEvidence += logZ
+		for i := range logWeights {
+			logWeights[i] -= logZ
+		}
+
+		// Resample the particles.
+		if ess(logWeights) < smc.ResampleESS*float64(n) {
+			particles, ll = smc.resample(particles, ll, logWeights)
+			for i := range logWeights {
+				logWeights[i] = -math.Log(float64(n))
+			}
+		}
+
+		// Move the particles.
+		move := smc.Move
+		if move == nil {
+			move = smc.rwm(particles, logWeights)
+		}
+		for i := range particles {
+			particles[i], err = smc.move(move(), m, beta, particles[i])
+			if err != nil {
+				return nil, nil, logEvidence, err
+			}
+			ll[i] = logLikelihood(m, particles[i])
+		}
+	}
+	return particles, logWeights, logEvidence, nil
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (smc *SMC) setDefaults() {
+	if smc.TargetESS == 0 {
+		smc.TargetESS = 0.9
+	}
+	if smc.ResampleESS == 0 {
+		smc.ResampleESS = 0.5
+	}
+	if smc.NMoves == 0 {
+		smc.NMoves = 5
+	}
+	smc.Rand = defaultRand(smc.Rand)
+}
+
+// nextStep returns the increment of beta, at most max, for
+// which the relative conditional ESS is TargetESS, by
+// bisection.
+func (smc *SMC) nextStep(logWeights, ll []float64, max float64) float64 {
+	if cess(logWeights, ll, max) >= smc.TargetESS {
+		return max
+	}
+	lo, hi := 0., max
+	for iter := 0; iter != 50; iter++ {
+		mid := 0.5 * (lo + hi)
+		if cess(logWeights, ll, mid) >= smc.TargetESS {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	// Advance even if the particles degenerate.
+	if lo == 0 {
+		lo = hi
+	}
+	return lo
+}
+
+// resample resamples the particles and their log-likelihoods
+// by systematic resampling.
+func (smc *SMC) resample(
+	particles [][]float64,
+	ll, logWeights []float64,
+) ([][]float64, []float64) {
+	n := len(particles)
+	particles_ := make([][]float64, n)
+	ll_ := make([]float64, n)
+	u := smc.Rand.Float64() / float64(n)
+	cdf := 0.
+	j := 0
+	for i := range logWeights {
+		cdf += math.Exp(logWeights[i])
+		for j != n && u < cdf {
+			particles_[j] = clone(particles[i])
+			ll_[j] = ll[i]
+			u += 1 / float64(n)
+			j++
+		}
+	}
+	// Rounding errors may leave the last positions empty.
+	for ; j != n; j++ {
+		particles_[j] = clone(particles[n-1])
+		ll_[j] = ll[n-1]
+	}
+	return particles_, ll_
+}
+
+// rwm returns the constructor of random-walk Metropolis
+// samplers with the proposal covariance estimated from the
+// weighted particles. The proposal is not adapted, so that the
+// moves leave the tempered posterior invariant.
+func (smc *SMC) rwm(
+	particles [][]float64,
+	logWeights []float64,
+) func() MCMC {
+	d := len(particles[0])
+	mean := make([]float64, d)
+	for i, x := range particles {
+		w := math.Exp(logWeights[i])
+		for k := range x {
+			mean[k] += w * x[k]
+		}
+	}
+	cov := make([][]float64, d)
+	for k := range cov {
+		cov[k] = make([]float64, d)
+	}
+	for i, x := range particles {
+		w := math.Exp(logWeights[i])
+		for k := range x {
+			for l := range x {
+				cov[k][l] += w * (x[k] - mean[k]) * (x[l] - mean[l])
+			}
+		}
+	}
+	for k := range cov {
+		// Regularize, so that the covariance is positive
+		// definite when the particles degenerate.
+		cov[k][k] += 1e-6
+	}
+	chol, _ := cholesky(cov)
+	return func() MCMC {
+		return &RWM{NAdapt: -1, chol: chol}
+	}
+}
+
+// move moves particle x by sampler s targeting the posterior
+// tempered by beta.
+func (smc *SMC) move(
+	s MCMC,
+	m model.Model,
+	beta float64,
+	x []float64,
+) ([]float64, error) {
+	t, ok := s.(tempering)
+	if !ok {
+		panic(fmt.Sprintf("cannot temper %T", s))
+	}
+	t.Temper(beta)
+	if r, ok := s.(randomized); ok {
+		r.setRand(smc.Rand)
+	}
+	samples := make(chan []float64)
+	s.Sample(m, x, samples)
+	for i := 0; i != smc.NMoves; i++ {
+		x_, ok := <-samples
+		if !ok {
+			if err := samplerErr(s); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%T terminated", s)
+		}
+		x = x_
+	}
+	s.Stop()
+	return x, nil
+}
+
+// logLikelihood computes the log-likelihood of m at x and
+// drops the gradient.
+func logLikelihood(m model.Separable, x []float64) float64 {
+	ll := m.LogLikelihood(x)
+	model.DropGradient(m)
+	return ll
+}
+
+// cess returns the relative conditional effective sample size
+// (https://doi.org/10.1080/10618600.2015.1060885) of the
+// particles reweighted by increment dbeta.
+func cess(logWeights, ll []float64, dbeta float64) float64 {
+	max := math.Inf(-1)
+	for i := range ll {
+		if !math.IsNaN(ll[i]) && dbeta*ll[i] > max {
+			max = dbeta * ll[i]
+		}
+	}
+	s1, s2 := 0., 0.
+	for i := range ll {
+		if math.IsNaN(ll[i]) {
+			continue
+		}
+		w := math.Exp(dbeta*ll[i] - max)
+		s1 += math.Exp(logWeights[i]) * w
+		s2 += math.Exp(logWeights[i]) * w * w
+	}
+	return s1 * s1 / s2
+}
+
+// ess returns the effective sample size of the particles with
+// normalized log weights.
+func ess(logWeights []float64) float64 {
+	s2 := 0.
+	for _, lw := range logWeights {
+		s2 += math.Exp(2 * lw)
+	}
+	return 1 / s2
+}
@@ -0,0 +1,249 @@
+package infer
+
+// Testing sequential Monte Carlo.
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	. "bitbucket.org/dtolpin/infergo/dist/ad"
+	"bitbucket.org/dtolpin/infergo/mathx"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// A bimodal posterior: the prior on x is Normal(0, 1), and the
+// likelihood is exp(-(x² - 4)²), with modes near -2 and 2
+// separated by a deep trough. Differentiated by deriv from
+//
+//	func (m *bimodalModel) Observe(x []float64) float64 {
+//		return m.LogPrior(x) + m.LogLikelihood(x)
+//	}
+//
+//	func (m *bimodalModel) LogPrior(x []float64) float64 {
+//		return -0.5 * x[0] * x[0]
+//	}
+//
+//	func (m *bimodalModel) LogLikelihood(x []float64) float64 {
+//		d := x[0]*x[0] - 4
+//		return -d * d
+//	}
+type bimodalModel struct{}
+
+func (m *bimodalModel) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpAdd,
+		ad.Call(func(_ []float64) {
+			m.LogPrior(x)
+		}, 0),
+		ad.Call(func(_ []float64) {
+			m.LogLikelihood(x)
+		}, 0)))
+}
+
+func (m *bimodalModel) LogPrior(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul,
+		ad.Arithmetic(ad.OpMul, ad.Value(-0.5), &x[0]), &x[0]))
+}
+
+func (m *bimodalModel) LogLikelihood(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	var d float64
+	ad.Assignment(&d, ad.Arithmetic(ad.OpSub,
+		ad.Arithmetic(ad.OpMul, &x[0], &x[0]), ad.Value(4)))
+	return ad.Return(ad.Arithmetic(ad.OpMul,
+		ad.Arithmetic(ad.OpNeg, &d), &d))
+}
+
+// A mixture of two unit-variance Gaussians with equal weights;
+// the prior on the means is Normal(0, 10). The posterior has
+// two modes, the means swapped. Differentiated by deriv from
+//
+//	func (m *gmmModel) Observe(x []float64) float64 {
+//		return m.LogPrior(x) + m.LogLikelihood(x)
+//	}
+//
+//	func (m *gmmModel) LogPrior(x []float64) float64 {
+//		return Normal.Logps(0, 10, x...)
+//	}
+//
+//	func (m *gmmModel) LogLikelihood(x []float64) float64 {
+//		ll := 0.
+//		for i := range m.data {
+//			ll += mathx.LogSumExp(
+//				Normal.Logp(x[0], 1, m.data[i]),
+//				Normal.Logp(x[1], 1, m.data[i]))
+//		}
+//		return ll
+//	}
+type gmmModel struct {
+	data []float64
+}
+
+func (m *gmmModel) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpAdd,
+		ad.Call(func(_ []float64) {
+			m.LogPrior(x)
+		}, 0),
+		ad.Call(func(_ []float64) {
+			m.LogLikelihood(x)
+		}, 0)))
+}
+
+func (m *gmmModel) LogPrior(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Call(func(_ []float64) {
+		Normal.Logps(0, 0, x...)
+	}, 2, ad.Value(0), ad.Value(10)))
+}
+
+func (m *gmmModel) LogLikelihood(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	var ll float64
+	ad.Assignment(&ll, ad.Value(0.))
+	for i := range m.data {
+		ad.Assignment(&ll, ad.Arithmetic(ad.OpAdd, &ll,
+			ad.Elemental(mathx.LogSumExp,
+				ad.Call(func(_ []float64) {
+					Normal.Logp(0, 0, 0)
+				}, 3, &x[0], ad.Value(1), &m.data[i]),
+				ad.Call(func(_ []float64) {
+					Normal.Logp(0, 0, 0)
+				}, 3, &x[1], ad.Value(1), &m.data[i]))))
+	}
+	return ad.Return(&ll)
+}
+
+// priorParticles draws n particles from Normal(0, 1).
+func priorParticles(rng *rand.Rand, n int) [][]float64 {
+	x := make([][]float64, n)
+	for i := range x {
+		x[i] = []float64{rng.NormFloat64()}
+	}
+	return x
+}
+
+func TestSMC(t *testing.T) {
+	// The posterior of sepModel is Normal(1, 0.5); the prior
+	// density lacks the normalization constant of
+	// Normal(0, 1), hence the evidence is the integral of
+	// exp(-x²/2 - (x-2)²/2)/sqrt(2π).
+	logZ := -1 - 0.5*math.Log(2)
+	for _, c := range []struct {
+		name string
+		move func() MCMC
+	}{
+		{"RWM", nil},
+		{"HMC", func() MCMC { return &HMC{L: 5, Eps: 0.3} }},
+	} {
+		rng := rand.New(rand.NewSource(1))
+		smc := &SMC{Move: c.move, Rand: rng}
+		particles, logWeights, logEvidence, err := smc.Run(
+			&sepModel{}, priorParticles(rng, 1000))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(smc.Betas) < 2 || smc.Betas[0] != 0 ||
+			smc.Betas[len(smc.Betas)-1] != 1 {
+			t.Errorf("%s: wrong schedule: %v", c.name, smc.Betas)
+		}
+		mean, variance := 0., 0.
+		for i, x := range particles {
+			mean += math.Exp(logWeights[i]) * x[0]
+			variance += math.Exp(logWeights[i]) * x[0] * x[0]
+		}
+		variance -= mean * mean
+		if math.Abs(mean-1) > 0.1 || math.Abs(variance-0.5) > 0.1 {
+			t.Errorf("%s: wrong posterior: got mean %.4g, "+
+				"variance %.4g, want 1, 0.5",
+				c.name, mean, variance)
+		}
+		if math.Abs(logEvidence-logZ) > 0.1 {
+			t.Errorf("%s: wrong log evidence: got %.4g, want %.4g",
+				c.name, logEvidence, logZ)
+		}
+	}
+}
+
+// SMC populates both modes of a bimodal posterior.
+func TestSMCBimodal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	smc := &SMC{Rand: rng}
+	particles, logWeights, _, err := smc.Run(
+		&bimodalModel{}, priorParticles(rng, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	positive := 0.
+	for i, x := range particles {
+		if x[0] > 0 {
+			positive += math.Exp(logWeights[i])
+		}
+	}
+	if positive < 0.35 || positive > 0.65 {
+		t.Errorf("wrong weight of the positive mode: "+
+			"got %.4g, want 0.5", positive)
+	}
+}
+
+// SMC populates both modes of the Gaussian mixture, on which a
+// single chain stays in one mode.
+func TestSMCMixture(t *testing.T) {
+	m := &gmmModel{
+		data: []float64{-2.5, -2.2, -2, -1.8, -1.5,
+			1.5, 1.8, 2, 2.2, 2.5},
+	}
+	rng := rand.New(rand.NewSource(1))
+	x := make([][]float64, 200)
+	for i := range x {
+		x[i] = []float64{10 * rng.NormFloat64(),
+			10 * rng.NormFloat64()}
+	}
+	smc := &SMC{Rand: rng}
+	particles, logWeights, _, err := smc.Run(m, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In either mode, the means are near -2 and 2.
+	ordered, lo, hi := 0., 0., 0.
+	for i, x := range particles {
+		w := math.Exp(logWeights[i])
+		if x[0] < x[1] {
+			ordered += w
+		}
+		lo += w * math.Min(x[0], x[1])
+		hi += w * math.Max(x[0], x[1])
+	}
+	if ordered < 0.3 || ordered > 0.7 {
+		t.Errorf("wrong weight of the mode with ordered means: "+
+			"got %.4g, want 0.5", ordered)
+	}
+	if math.Abs(lo+2) > 0.3 || math.Abs(hi-2) > 0.3 {
+		t.Errorf("wrong means: got %.4g, %.4g, want -2, 2", lo, hi)
+	}
+}
@@ -13,11 +13,11 @@ func Sigm(x float64) float64 {
 }
 
 func init() {
-	ad.RegisterElemental(Sigm,
+	ad.RegisterElementalInto(Sigm,
 		// dSigm / dx = Exp(-x) / (1 + Exp(-x))^2
 		//            = Sigm(x) * (1 - Sigm(x))
-		func(value float64, _ ...float64) []float64 {
-			return []float64{value * (1. - value)}
+		func(grad []float64, value float64, _ ...float64) {
+			grad[0] = value * (1. - value)
 		})
 }
 
@@ -35,11 +35,11 @@ func init() {
 	//                  = 1 / 1 + exp(y - x)
 	// d lse(x, y) / dy = exp(y) / exp(x) + exp(y)
 	//                  = exp(y - x) / 1 + exp(y - x)
-	ad.RegisterElemental(LogSumExp,
-		func(_ float64, params ...float64) []float64 {
+	ad.RegisterElementalInto(LogSumExp,
+		func(grad []float64, _ float64, params ...float64) {
 			z := math.Exp(params[1] - params[0])
 			t := 1 / (1 + z)
-			return []float64{t, t * z}
+			grad[0], grad[1] = t, t*z
 		})
 }
 
@@ -87,8 +87,8 @@ func digamma(x float64) float64 {
 }
 
 func init() {
-	ad.RegisterElemental(LogGamma,
-		func(_ float64, params ...float64) []float64 {
-			return []float64{digamma(params[0])}
+	ad.RegisterElementalInto(LogGamma,
+		func(grad []float64, _ float64, params ...float64) {
+			grad[0] = digamma(params[0])
 		})
 }
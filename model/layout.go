@@ -0,0 +1,152 @@
+package model
+
+// Named parameter layout.
+
+import (
+	"fmt"
+)
+
+// Block is a named block of parameters, a scalar if Size is
+// 0 and a vector of Size elements otherwise.
+type Block struct {
+	Name string
+	Size int
+}
+
+// Len returns the number of parameters in the block.
+func (b Block) Len() int {
+	if b.Size == 0 {
+		return 1
+	}
+	return b.Size
+}
+
+// Layout describes the parameter vector of a model as a
+// sequence of named blocks. Rather than destructuring the
+// parameter vector by position, a model can declare the
+// layout, for example
+//
+//	var layout = model.Layout{
+//	    {Name: "mu"},
+//	    {Name: "tau"},
+//	    {Name: "theta", Size: 8},
+//	}
+//
+// and access the blocks by name:
+//
+//	theta := layout.Get(x, "theta")
+//
+// Get and Unpack return slices of the parameter vector, so
+// that the gradient is computed through the blocks.
+type Layout []Block
+
+// A model with named parameters implements Parameterized.
+type Parameterized interface {
+	Model
+	Layout() Layout
+}
+
+// Len returns the number of parameters.
+func (l Layout) Len() int {
+	n := 0
+	for _, b := range l {
+		n += b.Len()
+	}
+	return n
+}
+
+// Names returns the name of each parameter. Scalars are named
+// by the block name, vector elements follow the Stan
+// convention: theta.1, theta.2, ...
+func (l Layout) Names() []string {
+	names := make([]string, 0, l.Len())
+	for _, b := range l {
+		if b.Size == 0 {
+			names = append(names, b.Name)
+			continue
+		}
+		for i := 0; i != b.Size; i++ {
+			names = append(names, fmt.Sprintf("%s.%d", b.Name, i+1))
+		}
+	}
+	return names
+}
+
+// Offset returns the offset of block name in the parameter
+// vector and the block length, or -1 and 0 if there is no such
+// block.
+func (l Layout) Offset(name string) (offset, length int) {
+	for _, b := range l {
+		if b.Name == name {
+			return offset, b.Len()
+		}
+		offset += b.Len()
+	}
+	return -1, 0
+}
+
+// Get returns block name of parameter vector x; the block
+// shares the storage with x. Get panics if there is no such
+// block.
+func (l Layout) Get(x []float64, name string) []float64 {
+	offset, length := l.Offset(name)
+	if offset < 0 {
+		panic(fmt.Sprintf("no parameter block %q", name))
+	}
+	return x[offset : offset+length]
+}
+
+// Set copies values to block name of parameter vector x.
+// Set panics if there is no such block or the number of values
+// differs from the block length.
+func (l Layout) Set(x []float64, name string, values ...float64) {
+	block := l.Get(x, name)
+	if len(values) != len(block) {
+		panic(fmt.Sprintf("block %q: got %d values, want %d",
+			name, len(values), len(block)))
+	}
+	copy(block, values)
+}
+
+// Unpack returns the blocks of parameter vector x, in the
+// order of the layout; the blocks share the storage with x.
+func (l Layout) Unpack(x []float64) [][]float64 {
+	if len(x) != l.Len() {
+		panic(fmt.Sprintf("got %d parameters, want %d",
+			len(x), l.Len()))
+	}
+	blocks := make([][]float64, len(l))
+	for i, b := range l {
+		blocks[i] = Shift(&x, b.Len())
+	}
+	return blocks
+}
+
+// Pack returns a new parameter vector composed of blocks, in
+// the order of the layout. Pack panics if the block lengths do
+// not match the layout.
+func (l Layout) Pack(blocks ...[]float64) []float64 {
+	if len(blocks) != len(l) {
+		panic(fmt.Sprintf("got %d blocks, want %d",
+			len(blocks), len(l)))
+	}
+	x := make([]float64, 0, l.Len())
+	for i, b := range l {
+		if len(blocks[i]) != b.Len() {
+			panic(fmt.Sprintf("block %q: got %d values, want %d",
+				b.Name, len(blocks[i]), b.Len()))
+		}
+		x = append(x, blocks[i]...)
+	}
+	return x
+}
+
+// Names returns the parameter names of model m with n
+// parameters: the names of the layout if m is Parameterized,
+// and x.1, x.2, ... otherwise.
+func Names(m Model, n int) []string {
+	if m, ok := m.(Parameterized); ok {
+		return m.Layout().Names()
+	}
+	return Layout{{Name: "x", Size: n}}.Names()
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"bitbucket.org/dtolpin/infergo/ad"
+	"reflect"
+	"testing"
+)
+
+var testLayout = Layout{
+	{Name: "mu"},
+	{Name: "theta", Size: 3},
+	{Name: "tau"},
+}
+
+func TestLayout(t *testing.T) {
+	if n := testLayout.Len(); n != 5 {
+		t.Errorf("wrong length: got %d, want 5", n)
+	}
+	names := []string{"mu", "theta.1", "theta.2", "theta.3", "tau"}
+	if got := testLayout.Names(); !reflect.DeepEqual(got, names) {
+		t.Errorf("wrong names: got %v, want %v", got, names)
+	}
+	for _, c := range []struct {
+		name           string
+		offset, length int
+	}{
+		{"mu", 0, 1},
+		{"theta", 1, 3},
+		{"tau", 4, 1},
+		{"sigma", -1, 0},
+	} {
+		offset, length := testLayout.Offset(c.name)
+		if offset != c.offset || length != c.length {
+			t.Errorf("wrong offset of %q: got %d, %d, want %d, %d",
+				c.name, offset, length, c.offset, c.length)
+		}
+	}
+}
+
+func TestPack(t *testing.T) {
+	x := testLayout.Pack([]float64{1}, []float64{2, 3, 4}, []float64{5})
+	if !reflect.DeepEqual(x, []float64{1, 2, 3, 4, 5}) {
+		t.Errorf("wrong packed vector: %v", x)
+	}
+	blocks := testLayout.Unpack(x)
+	if !reflect.DeepEqual(blocks,
+		[][]float64{{1}, {2, 3, 4}, {5}}) {
+		t.Errorf("wrong unpacked blocks: %v", blocks)
+	}
+	// The blocks share the storage with the vector.
+	blocks[1][2] = 6
+	testLayout.Set(x, "tau", 7)
+	if !reflect.DeepEqual(x, []float64{1, 2, 3, 6, 7}) {
+		t.Errorf("blocks do not share storage: %v", x)
+	}
+	if theta := testLayout.Get(x, "theta"); !reflect.DeepEqual(theta,
+		[]float64{2, 3, 6}) {
+		t.Errorf("wrong block theta: %v", theta)
+	}
+
+	for _, c := range []struct {
+		name string
+		f    func()
+	}{
+		{"Get", func() { testLayout.Get(x, "sigma") }},
+		{"Set", func() { testLayout.Set(x, "theta", 1) }},
+		{"Unpack", func() { testLayout.Unpack(x[1:]) }},
+		{"Pack", func() { testLayout.Pack([]float64{1}) }},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s did not panic", c.name)
+				}
+			}()
+			c.f()
+		}()
+	}
+}
+
+// A model with named parameters and the gradient of
+// mu*theta[1].
+type layoutModel struct{ tape *ad.Tape }
+
+func (m *layoutModel) Tape() *ad.Tape {
+	return m.tape
+}
+
+func (m *layoutModel) Layout() Layout {
+	return testLayout
+}
+
+func (m *layoutModel) Observe(x []float64) float64 {
+	m.tape.Setup(x)
+	mu := m.Layout().Get(x, "mu")
+	theta := m.Layout().Get(x, "theta")
+	return m.tape.Return(m.tape.Arithmetic(ad.OpMul, &mu[0], &theta[1]))
+}
+
+func TestNames(t *testing.T) {
+	m := &layoutModel{ad.NewTape()}
+	if names := Names(m, 5); !reflect.DeepEqual(names,
+		testLayout.Names()) {
+		t.Errorf("wrong names of %T: %v", m, names)
+	}
+	if names := Names(&adModel{}, 2); !reflect.DeepEqual(names,
+		[]string{"x.1", "x.2"}) {
+		t.Errorf("wrong names of %T: %v", &adModel{}, names)
+	}
+
+	// The gradient is computed through the blocks.
+	m.Observe([]float64{2, 3, 4, 5, 6})
+	grad := Gradient(m)
+	if !reflect.DeepEqual(grad, []float64{4, 0, 2, 0, 0}) {
+		t.Errorf("wrong gradient: %v", grad)
+	}
+}
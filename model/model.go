@@ -21,6 +21,55 @@ type ElementalModel interface {
 	Gradient() []float64
 }
 
+// An elemental model may also supply the Hessian instead of
+// second-order automatic differentiation.
+type HessianModel interface {
+	ElementalModel
+	Hessian() [][]float64
+}
+
+// A model differentiated with an explicit tape (see
+// ad.Explicit) carries the tape and implements Taped.
+// Differentiation of models with different tapes is
+// goroutine-safe.
+type Taped interface {
+	Tape() *ad.Tape
+}
+
+// A model with a separate prior and likelihood implements
+// Separable, in addition to Observe returning the sum of the
+// log prior and the log-likelihood. LogPrior and LogLikelihood
+// are differentiated as Observe.
+type Separable interface {
+	Model
+	LogPrior(parameters []float64) float64
+	LogLikelihood(parameters []float64) float64
+}
+
+// A model with discrete parameters implements DiscreteModel.
+// Observe computes the log density of the continuous
+// parameters given the current values of the discrete
+// parameters, returned by Discrete. Samplers update the
+// discrete parameters in place.
+type DiscreteModel interface {
+	Model
+	Discrete() []int
+}
+
+// A float32 model implements Model32 instead of Model. Float32
+// arithmetic halves the memory footprint of the tape and of the
+// parameters.
+type Model32 interface {
+	Observe(parameters []float32) float32
+}
+
+// A float32 elemental model uses a supplied gradient instead of
+// automatic differentiation.
+type ElementalModel32 interface {
+	Model32
+	Gradient() []float32
+}
+
 // Shift shifts n parameters from x, useful for destructuring
 // the parameter vector.
 func Shift(px *[]float64, n int) []float64 {
@@ -35,19 +84,206 @@ func Gradient(m Model) []float64 {
 	switch m := m.(type) {
 	case ElementalModel:
 		return m.Gradient()
+	case Taped:
+		return m.Tape().Gradient()
 	default:
 		return ad.Gradient()
 	}
 }
 
+// GradientInto is Gradient which stores the gradient in grad
+// instead of allocating a new vector; see ad.GradientInto.
+func GradientInto(m Model, grad []float64) {
+	switch m := m.(type) {
+	case ElementalModel:
+		copy(grad, m.Gradient())
+	case Taped:
+		m.Tape().GradientInto(grad)
+	default:
+		ad.GradientInto(grad)
+	}
+}
+
+// Hessian automatically selects either supplied or automatic
+// Hessian. Hessian is called instead of Gradient. An elemental
+// model must implement HessianModel.
+func Hessian(m Model) [][]float64 {
+	switch m := m.(type) {
+	case HessianModel:
+		return m.Hessian()
+	case ElementalModel:
+		panic("elemental model does not supply the Hessian")
+	case Taped:
+		return m.Tape().Hessian()
+	default:
+		return ad.Hessian()
+	}
+}
+
+// HessianVector computes the product of the Hessian and vector
+// v. HessianVector is called instead of Gradient.
+func HessianVector(m Model, v []float64) []float64 {
+	switch m := m.(type) {
+	case HessianModel:
+		h := m.Hessian()
+		hv := make([]float64, len(v))
+		for i := range h {
+			for j := range v {
+				hv[i] += h[i][j] * v[j]
+			}
+		}
+		return hv
+	case ElementalModel:
+		panic("elemental model does not supply the Hessian")
+	case Taped:
+		return m.Tape().HessianVector(v)
+	default:
+		return ad.HessianVector(v)
+	}
+}
+
+// Gradient32 automatically selects either supplied or automatic
+// gradient of a float32 model.
+func Gradient32(m Model32) []float32 {
+	switch m := m.(type) {
+	case ElementalModel32:
+		return m.Gradient()
+	case Taped:
+		return m.Tape().Gradient32()
+	default:
+		return ad.Gradient32()
+	}
+}
+
+// DropGradient32 is DropGradient for float32 models.
+func DropGradient32(m Model32) {
+	switch m := m.(type) {
+	case ElementalModel32:
+		// nothing has to be cleared
+	case Taped:
+		m.Tape().Pop()
+	default:
+		ad.Pop()
+	}
+}
+
+// Float64 adapts a float32 model to Model, so that the float32
+// model can be passed to inference algorithms. Parameters are
+// converted to float32 on each call to Observe, and the gradient
+// is converted back to float64.
+func Float64(m Model32) ElementalModel {
+	return &float64Model{m: m}
+}
+
+// float64Model is the adapter returned by Float64.
+type float64Model struct {
+	m Model32
+	x []float32
+}
+
+func (m *float64Model) Observe(x []float64) float64 {
+	// The parameters are allocated anew because the tape
+	// refers to their locations until the gradient is
+	// computed.
+	m.x = make([]float32, len(x))
+	for i := range x {
+		m.x[i] = float32(x[i])
+	}
+	return float64(m.m.Observe(m.x))
+}
+
+func (m *float64Model) Gradient() []float64 {
+	grad32 := Gradient32(m.m)
+	grad := make([]float64, len(grad32))
+	for i := range grad32 {
+		grad[i] = float64(grad32[i])
+	}
+	return grad
+}
+
+// Tempered adapts a separable model to the tempered model with
+// the likelihood raised to power beta, for power posteriors,
+// thermodynamic integration, or, with beta = 0, sampling from
+// the prior. The model must not be elemental.
+func Tempered(m Separable, beta float64) ElementalModel {
+	if _, ok := m.(ElementalModel); ok {
+		panic("elemental model cannot be tempered")
+	}
+	return &temperedModel{m: m, beta: beta}
+}
+
+// temperedModel is the adapter returned by Tempered. The
+// gradients of the prior and of the likelihood are computed
+// lazily, when the gradient is requested, and the frames are
+// popped without differentiation by DropGradient.
+type temperedModel struct {
+	m       Separable
+	beta    float64
+	grad    []float64
+	pending bool // the frames of the last Observe are on the tape
+}
+
+func (m *temperedModel) Observe(x []float64) float64 {
+	// The frames of an earlier call are dropped if the
+	// gradient was not requested.
+	m.drop()
+	// The prior and the likelihood are differentiated
+	// separately, and the gradients are combined. The frame of
+	// the likelihood is above the frame of the prior.
+	lp := m.m.LogPrior(x)
+	m.pending = true
+	if m.beta == 0 {
+		// Sampling from the prior, the likelihood is not
+		// computed.
+		return lp
+	}
+	ll := m.m.LogLikelihood(x)
+	return lp + m.beta*ll
+}
+
+func (m *temperedModel) Gradient() []float64 {
+	if !m.pending {
+		return m.grad
+	}
+	m.pending = false
+	var grad []float64
+	if m.beta != 0 {
+		grad = Gradient(m.m)
+	}
+	m.grad = Gradient(m.m)
+	for i := range grad {
+		m.grad[i] += m.beta * grad[i]
+	}
+	return m.grad
+}
+
+// drop pops the frames of the last Observe if the gradient was
+// not computed.
+func (m *temperedModel) drop() {
+	if !m.pending {
+		return
+	}
+	m.pending = false
+	if m.beta != 0 {
+		DropGradient(m.m)
+	}
+	DropGradient(m.m)
+}
+
 // DropGradient can be called instead of Gradient when the gradient
 // is not required. For automaticall differentated models DropGradient
 // will pop the frame from the tape; for elemental models it will
 // do nothing.
 func DropGradient(m Model) {
-	switch m.(type) {
+	switch m := m.(type) {
+	case *float64Model:
+		DropGradient32(m.m)
+	case *temperedModel:
+		m.drop()
 	case ElementalModel:
 		// nothing has to be cleared
+	case Taped:
+		m.Tape().Pop()
 	default:
 		ad.Pop()
 	}
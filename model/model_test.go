@@ -2,7 +2,10 @@ package model
 
 import (
 	"bitbucket.org/dtolpin/infergo/ad"
+	dist "bitbucket.org/dtolpin/infergo/dist/adx"
+	"math"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -26,6 +29,18 @@ func (m *elModel) Gradient() []float64 {
 	return m.grad
 }
 
+// A model with an explicit tape and the gradient of x*y.
+type tapedModel struct{ tape *ad.Tape }
+
+func (m *tapedModel) Tape() *ad.Tape {
+	return m.tape
+}
+
+func (m *tapedModel) Observe(x []float64) float64 {
+	m.tape.Setup(x)
+	return m.tape.Return(m.tape.Arithmetic(ad.OpMul, &x[0], &x[1]))
+}
+
 func TestGradient(t *testing.T) {
 	for i, c := range []struct {
 		m    Model
@@ -42,6 +57,11 @@ func TestGradient(t *testing.T) {
 			[]float64{2., 1.},
 			[]float64{2., 1.},
 		},
+		{
+			&tapedModel{ad.NewTape()},
+			[]float64{3., 4.},
+			[]float64{4., 3.},
+		},
 	} {
 		c.m.Observe(c.x)
 		grad := Gradient(c.m)
@@ -51,6 +71,191 @@ func TestGradient(t *testing.T) {
 					i, c.m, grad, c.grad)
 			}
 		}
+		c.m.Observe(c.x)
+		grad = make([]float64, len(c.x))
+		GradientInto(c.m, grad)
+		if !reflect.DeepEqual(grad, c.grad) {
+			t.Errorf("%d: wrong gradient stored for %T: got %v, want %v",
+				i, c.m, grad, c.grad)
+		}
+	}
+}
+
+// A float32 model with the gradient of x*y.
+type adProd32Model struct{}
+
+func (*adProd32Model) Observe(x []float32) float32 {
+	ad.Setup32(x)
+	return ad.Return32(ad.Arithmetic32(ad.OpMul, &x[0], &x[1]))
+}
+
+// A float32 elemental model with identity gradient.
+type el32Model struct{ grad []float32 }
+
+func (m *el32Model) Observe(x []float32) float32 {
+	m.grad = x
+	return 0.
+}
+
+func (m *el32Model) Gradient() []float32 {
+	return m.grad
+}
+
+// A model calling dist.Normal, differentiated by deriv with
+// -explicit.
+type normalModel struct {
+	data []float64
+	tape *ad.Tape
+}
+
+func (m *normalModel) Tape() *ad.Tape {
+	return m.tape
+}
+
+func (m *normalModel) Observe(x []float64) float64 {
+	_tape := m.Tape()
+	if _tape.Called() {
+		_tape.Enter()
+	} else {
+		_tape.Setup(x)
+	}
+	return _tape.Return(_tape.Call(func(_ []float64) {
+		dist.Normal.Logps(_tape, 0, 0, m.data...)
+	}, 2, &x[0], &x[1]))
+}
+
+// Models with explicit tapes calling into dist/adx are
+// differentiated concurrently without MTSafeOn.
+func TestExplicitConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i != 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := &normalModel{
+				data: []float64{float64(i), float64(i) + 1},
+				tape: ad.NewTape(),
+			}
+			for j := 0; j != 100; j++ {
+				mu, sigma := float64(j)/100, 1+float64(i)/10
+				m.Observe([]float64{mu, sigma})
+				grad := Gradient(m)
+				var dmu, dsigma float64
+				for _, y := range m.data {
+					d := y - mu
+					dmu += d / (sigma * sigma)
+					dsigma += d*d/(sigma*sigma*sigma) - 1/sigma
+				}
+				if math.Abs(grad[0]-dmu) > 1e-9 ||
+					math.Abs(grad[1]-dsigma) > 1e-9 {
+					t.Errorf("%d: wrong gradient at (%v, %v): "+
+						"got %v, want [%v %v]",
+						i, mu, sigma, grad, dmu, dsigma)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestGradient32(t *testing.T) {
+	for i, c := range []struct {
+		m    Model32
+		x    []float32
+		grad []float32
+	}{
+		{
+			&adProd32Model{},
+			[]float32{1., 2.},
+			[]float32{2., 1.},
+		},
+		{
+			&el32Model{},
+			[]float32{2., 1.},
+			[]float32{2., 1.},
+		},
+	} {
+		c.m.Observe(c.x)
+		grad := Gradient32(c.m)
+		if !reflect.DeepEqual(grad, c.grad) {
+			t.Errorf("%d: wrong gradient for %T: got %v, want %v",
+				i, c.m, grad, c.grad)
+		}
+		// The adapter computes the same gradient in float64.
+		x := make([]float64, len(c.x))
+		for j := range x {
+			x[j] = float64(c.x[j])
+		}
+		m := Float64(c.m)
+		m.Observe(x)
+		grad64 := Gradient(m)
+		for j := range grad64 {
+			if grad64[j] != float64(c.grad[j]) {
+				t.Errorf("%d: wrong adapted gradient for %T: "+
+					"got %v, want %v",
+					i, c.m, grad64, c.grad)
+			}
+		}
+		m.Observe(x)
+		DropGradient(m)
+	}
+}
+
+// A model with the Hessian of x*y.
+type adProdModel struct{}
+
+func (*adProdModel) Observe(x []float64) float64 {
+	ad.Setup(x)
+	return ad.Return(ad.Arithmetic(ad.OpMul, &x[0], &x[1]))
+}
+
+// An elemental model with the Hessian of x*y.
+type hessModel struct{ elModel }
+
+func (m *hessModel) Hessian() [][]float64 {
+	return [][]float64{{0, 1}, {1, 0}}
+}
+
+func TestHessian(t *testing.T) {
+	for i, c := range []struct {
+		m    Model
+		x    []float64
+		hess [][]float64
+		hv   []float64
+	}{
+		{
+			&adModel{},
+			[]float64{1., 2.},
+			[][]float64{{0., 0.}, {0., 0.}},
+			[]float64{0., 0.},
+		},
+		{
+			&adProdModel{},
+			[]float64{1., 2.},
+			[][]float64{{0., 1.}, {1., 0.}},
+			[]float64{2., 1.},
+		},
+		{
+			&hessModel{},
+			[]float64{2., 1.},
+			[][]float64{{0., 1.}, {1., 0.}},
+			[]float64{2., 1.},
+		},
+	} {
+		c.m.Observe(c.x)
+		hess := Hessian(c.m)
+		if !reflect.DeepEqual(hess, c.hess) {
+			t.Errorf("%d: wrong Hessian for %T: got %v, want %v",
+				i, c.m, hess, c.hess)
+		}
+		c.m.Observe(c.x)
+		hv := HessianVector(c.m, []float64{1., 2.})
+		if !reflect.DeepEqual(hv, c.hv) {
+			t.Errorf("%d: wrong Hessian-vector product for %T: "+
+				"got %v, want %v",
+				i, c.m, hv, c.hv)
+		}
 	}
 }
 
@@ -86,3 +291,89 @@ func TestShift(t *testing.T) {
 		}
 	}
 }
+
+// A separable model with log prior x*y and log-likelihood x*x,
+// differentiated by deriv from
+//
+//	func (m *sepModel) Observe(x []float64) float64 {
+//		return m.LogPrior(x) + m.LogLikelihood(x)
+//	}
+//
+//	func (m *sepModel) LogPrior(x []float64) float64 {
+//		return x[0] * x[1]
+//	}
+//
+//	func (m *sepModel) LogLikelihood(x []float64) float64 {
+//		return x[0] * x[0]
+//	}
+type sepModel struct{}
+
+func (m *sepModel) Observe(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpAdd,
+		ad.Call(func(_ []float64) {
+			m.LogPrior(x)
+		}, 0),
+		ad.Call(func(_ []float64) {
+			m.LogLikelihood(x)
+		}, 0)))
+}
+
+func (m *sepModel) LogPrior(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul, &x[0], &x[1]))
+}
+
+func (m *sepModel) LogLikelihood(x []float64) float64 {
+	if ad.Called() {
+		ad.Enter()
+	} else {
+		ad.Setup(x)
+	}
+	return ad.Return(ad.Arithmetic(ad.OpMul, &x[0], &x[0]))
+}
+
+func TestTempered(t *testing.T) {
+	x := []float64{2, 3}
+	for _, c := range []struct {
+		beta float64
+		y    float64
+		grad []float64
+	}{
+		{0, 6, []float64{3, 2}},
+		{0.5, 8, []float64{5, 2}},
+		{1, 10, []float64{7, 2}},
+	} {
+		m := Tempered(&sepModel{}, c.beta)
+		// The gradient is computed only when requested; the
+		// frames of an Observe without Gradient are dropped.
+		m.Observe([]float64{1, 1})
+		DropGradient(m)
+		m.Observe([]float64{1, 1})
+		y := m.Observe(x)
+		if y != c.y {
+			t.Errorf("wrong value for beta=%.2g: got %.4g, want %.4g",
+				c.beta, y, c.y)
+		}
+		grad := Gradient(m)
+		if !reflect.DeepEqual(grad, c.grad) {
+			t.Errorf("wrong gradient for beta=%.2g: got %v, want %v",
+				c.beta, grad, c.grad)
+		}
+	}
+	// The untempered model is the joint.
+	m := &sepModel{}
+	y := m.Observe(x)
+	grad := Gradient(m)
+	if y != 10 || !reflect.DeepEqual(grad, []float64{7, 2}) {
+		t.Errorf("wrong joint: got %.4g, %v", y, grad)
+	}
+}
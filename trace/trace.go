@@ -0,0 +1,323 @@
+// Package trace records samples of MCMC samplers. The draws
+// are streamed to a Stan-compatible CSV file or to a file of
+// JSON lines, and are summarized per parameter.
+package trace
+
+import (
+	"bitbucket.org/dtolpin/infergo/diag"
+	"bitbucket.org/dtolpin/infergo/infer"
+	"bitbucket.org/dtolpin/infergo/model"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Format is the output format of the trace.
+type Format int
+
+const (
+	// CSV is the format of Stan output files: a header line
+	// followed by a line per draw.
+	CSV Format = iota
+	// JSON is a JSON object per line, with the column names
+	// as keys.
+	JSON
+)
+
+// Trace consumes samples of an MCMC sampler, writes the draws
+// to Output, and keeps them for the summary.
+type Trace struct {
+	// Parameter names, see model.Names; if nil, the
+	// parameters are named x.1, x.2, ...
+	Names []string
+	// Statistics channel of the sampler (see infer.HMC.Stats);
+	// if not nil, the statistics are read after each sample
+	// and written in Stan metadata columns (lp__, accept_stat__,
+	// ...) before the parameters.
+	Stats chan infer.Stats
+	// Output, if not nil, receives the draws in Format.
+	Output io.Writer
+	Format Format
+	// Probabilities of the quantiles in the summary, 5%, 50%,
+	// and 95% by default.
+	Probs []float64
+	// Draws of each chain
+	Draws [][][]float64
+
+	columns []string // written columns, nil before the header
+	chains  bool     // the chain column is written
+	csv     *csv.Writer
+}
+
+// Stan metadata columns
+var statColumns = []string{
+	"lp__", "accept_stat__", "stepsize__",
+	"treedepth__", "n_leapfrog__", "divergent__", "energy__",
+}
+
+// Record reads n samples, or until samples is closed if n is
+// 0, and records them as the draws of chain 0. Record can be
+// called repeatedly, for example once for the warmup and once
+// for the draws kept.
+func (t *Trace) Record(samples <-chan []float64, n int) error {
+	for i := 0; n == 0 || i != n; i++ {
+		x, ok := <-samples
+		if !ok {
+			break
+		}
+		var stats *infer.Stats
+		if t.Stats != nil {
+			s, ok := <-t.Stats
+			if ok {
+				stats = &s
+			}
+		}
+		if err := t.record(-1, x, stats); err != nil {
+			return err
+		}
+	}
+	return t.flush()
+}
+
+// RecordChains reads n samples of multiple chains (see
+// infer.Chains), or until samples is closed if n is 0. The
+// chain of each draw is written in column chain__. Sampler
+// statistics are not recorded.
+func (t *Trace) RecordChains(
+	samples <-chan infer.ChainSample,
+	n int,
+) error {
+	for i := 0; n == 0 || i != n; i++ {
+		s, ok := <-samples
+		if !ok {
+			break
+		}
+		if err := t.record(s.Chain, s.X, nil); err != nil {
+			return err
+		}
+	}
+	return t.flush()
+}
+
+// record records draw x of the chain; chain is negative for a
+// single chain.
+func (t *Trace) record(chain int, x []float64, stats *infer.Stats) error {
+	c := chain
+	if c < 0 {
+		c = 0
+	}
+	for len(t.Draws) <= c {
+		t.Draws = append(t.Draws, nil)
+	}
+	t.Draws[c] = append(t.Draws[c], append([]float64(nil), x...))
+
+	if t.Output == nil {
+		return nil
+	}
+	if t.columns == nil {
+		t.chains = chain >= 0
+		if err := t.writeHeader(len(x)); err != nil {
+			return err
+		}
+	}
+	var values []float64
+	if t.chains {
+		values = append(values, float64(c))
+	}
+	if t.Stats != nil {
+		if stats == nil {
+			stats = &infer.Stats{
+				LogDensity: math.NaN(),
+				Accept:     math.NaN(),
+				StepSize:   math.NaN(),
+				Energy:     math.NaN(),
+			}
+		}
+		divergent := 0.
+		if stats.Divergent {
+			divergent = 1
+		}
+		values = append(values,
+			stats.LogDensity,
+			stats.Accept,
+			stats.StepSize,
+			float64(stats.Depth),
+			float64(stats.NLeapfrog),
+			divergent,
+			// Stan reports the Hamiltonian, the negated energy.
+			-stats.Energy)
+	}
+	values = append(values, x...)
+	return t.writeValues(values)
+}
+
+// writeHeader determines the columns and, for CSV, writes the
+// header.
+func (t *Trace) writeHeader(nparams int) error {
+	if t.chains {
+		t.columns = append(t.columns, "chain__")
+	}
+	if t.Stats != nil {
+		t.columns = append(t.columns, statColumns...)
+	}
+	t.columns = append(t.columns, t.names(nparams)...)
+	if t.Format == CSV {
+		t.csv = csv.NewWriter(t.Output)
+		return t.csv.Write(t.columns)
+	}
+	return nil
+}
+
+// writeValues writes the values of a draw.
+func (t *Trace) writeValues(values []float64) error {
+	switch t.Format {
+	case CSV:
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = formatFloat(v)
+		}
+		return t.csv.Write(record)
+	case JSON:
+		var line strings.Builder
+		line.WriteString("{")
+		for i, v := range values {
+			if i > 0 {
+				line.WriteString(",")
+			}
+			key, _ := json.Marshal(t.columns[i])
+			line.Write(key)
+			line.WriteString(":")
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				// Not representable in JSON
+				line.WriteString("null")
+			} else {
+				line.WriteString(formatFloat(v))
+			}
+		}
+		line.WriteString("}\n")
+		_, err := io.WriteString(t.Output, line.String())
+		return err
+	default:
+		return fmt.Errorf("unknown format %d", t.Format)
+	}
+}
+
+// flush flushes buffered output.
+func (t *Trace) flush() error {
+	if t.csv == nil {
+		return nil
+	}
+	t.csv.Flush()
+	return t.csv.Error()
+}
+
+// names returns the names of nparams parameters.
+func (t *Trace) names(nparams int) []string {
+	if t.Names == nil {
+		return model.Layout{{Name: "x", Size: nparams}}.Names()
+	}
+	return t.Names
+}
+
+// formatFloat formats v with the minimum number of digits
+// needed to represent v exactly.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Summary summarizes the draws of a parameter.
+type Summary struct {
+	Name      string
+	Mean, SD  float64
+	Quantiles []float64 // quantiles at Trace.Probs
+	MCSE      float64   // Monte Carlo standard error of the mean
+	// Bulk and tail effective sample sizes, and R-hat, see
+	// package diag.
+	BulkESS, TailESS, RHat float64
+}
+
+// Summary returns the summary of each parameter. The
+// diagnostics of multiple chains are computed on the draws
+// up to the length of the shortest chain.
+func (t *Trace) Summary() []Summary {
+	t.setDefaults()
+	var chains [][][]float64
+	for _, draws := range t.Draws {
+		if len(draws) > 0 {
+			chains = append(chains, draws)
+		}
+	}
+	if len(chains) == 0 {
+		return nil
+	}
+	n := len(chains[0])
+	for _, draws := range chains {
+		if len(draws) < n {
+			n = len(draws)
+		}
+	}
+	names := t.names(len(chains[0][0]))
+	summary := make([]Summary, len(names))
+	for i := range summary {
+		var pooled []float64
+		param := make([][]float64, len(chains))
+		for j, draws := range chains {
+			x := diag.Param(draws, i)
+			pooled = append(pooled, x...)
+			param[j] = x[:n]
+		}
+		mean, sd := 0., 0.
+		for _, x := range pooled {
+			mean += x
+		}
+		mean /= float64(len(pooled))
+		for _, x := range pooled {
+			sd += (x - mean) * (x - mean)
+		}
+		sd = math.Sqrt(sd / float64(len(pooled)-1))
+		summary[i] = Summary{
+			Name:      names[i],
+			Mean:      mean,
+			SD:        sd,
+			Quantiles: diag.Quantiles(pooled, t.Probs...),
+			MCSE:      diag.MCSE(param),
+			BulkESS:   diag.BulkESS(param),
+			TailESS:   diag.TailESS(param),
+			RHat:      diag.RHat(param),
+		}
+	}
+	return summary
+}
+
+// WriteSummary writes the summary of each parameter to w as
+// a table.
+func (t *Trace) WriteSummary(w io.Writer) error {
+	t.setDefaults()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "\tmean\tsd")
+	for _, p := range t.Probs {
+		fmt.Fprintf(tw, "\t%s%%", formatFloat(100*p))
+	}
+	fmt.Fprint(tw, "\tmcse\tess_bulk\tess_tail\trhat\t\n")
+	for _, s := range t.Summary() {
+		fmt.Fprintf(tw, "%s\t%.4g\t%.4g", s.Name, s.Mean, s.SD)
+		for _, q := range s.Quantiles {
+			fmt.Fprintf(tw, "\t%.4g", q)
+		}
+		fmt.Fprintf(tw, "\t%.2g\t%.0f\t%.0f\t%.3f\t\n",
+			s.MCSE, s.BulkESS, s.TailESS, s.RHat)
+	}
+	return tw.Flush()
+}
+
+// setDefaults sets the default value for auxiliary parameters.
+func (t *Trace) setDefaults() {
+	if t.Probs == nil {
+		t.Probs = []float64{0.05, 0.5, 0.95}
+	}
+}
@@ -0,0 +1,198 @@
+package trace
+
+import (
+	"bitbucket.org/dtolpin/infergo/infer"
+	"math"
+	"strings"
+	"testing"
+)
+
+// feed writes draws and, unless stats is nil, the statistics
+// to the channels, and closes the channels.
+func feed(
+	draws [][]float64,
+	samples chan []float64,
+	stats chan infer.Stats,
+) {
+	go func() {
+		for i, x := range draws {
+			samples <- x
+			if stats != nil {
+				stats <- infer.Stats{
+					LogDensity: float64(-i),
+					Accept:     0.5,
+					StepSize:   0.1,
+					Depth:      2,
+					NLeapfrog:  3,
+					Energy:     -float64(i) - 1,
+					Divergent:  i == 1,
+				}
+			}
+		}
+		close(samples)
+		if stats != nil {
+			close(stats)
+		}
+	}()
+}
+
+var testDraws = [][]float64{
+	{1, 2},
+	{3, -4.5},
+	{5, 6},
+}
+
+func TestCSV(t *testing.T) {
+	for _, c := range []struct {
+		names []string
+		stats bool
+		n     int
+		out   string
+	}{
+		{
+			nil, false, 0,
+			"x.1,x.2\n1,2\n3,-4.5\n5,6\n",
+		},
+		{
+			[]string{"mu", "tau"}, false, 2,
+			"mu,tau\n1,2\n3,-4.5\n",
+		},
+		{
+			[]string{"mu", "tau"}, true, 0,
+			"lp__,accept_stat__,stepsize__,treedepth__," +
+				"n_leapfrog__,divergent__,energy__,mu,tau\n" +
+				"0,0.5,0.1,2,3,0,1,1,2\n" +
+				"-1,0.5,0.1,2,3,1,2,3,-4.5\n" +
+				"-2,0.5,0.1,2,3,0,3,5,6\n",
+		},
+	} {
+		samples := make(chan []float64)
+		var out strings.Builder
+		tr := &Trace{Names: c.names, Output: &out}
+		if c.stats {
+			tr.Stats = make(chan infer.Stats)
+		}
+		feed(testDraws, samples, tr.Stats)
+		if err := tr.Record(samples, c.n); err != nil {
+			t.Fatalf("error recording samples: %v", err)
+		}
+		if out.String() != c.out {
+			t.Errorf("wrong output for %+v: got\n%s", c, out.String())
+		}
+		want := len(testDraws)
+		if c.n != 0 {
+			want = c.n
+			// Drain the channels.
+			for range samples {
+				if tr.Stats != nil {
+					<-tr.Stats
+				}
+			}
+		}
+		if len(tr.Draws) != 1 || len(tr.Draws[0]) != want {
+			t.Errorf("wrong number of draws: got %d, want %d",
+				len(tr.Draws[0]), want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	samples := make(chan []float64)
+	var out strings.Builder
+	tr := &Trace{
+		Names:  []string{"mu", "tau"},
+		Output: &out,
+		Format: JSON,
+	}
+	feed([][]float64{{1, 2}, {math.NaN(), -4.5}}, samples, nil)
+	if err := tr.Record(samples, 0); err != nil {
+		t.Fatalf("error recording samples: %v", err)
+	}
+	want := `{"mu":1,"tau":2}` + "\n" +
+		`{"mu":null,"tau":-4.5}` + "\n"
+	if out.String() != want {
+		t.Errorf("wrong output: got\n%s", out.String())
+	}
+}
+
+func TestRecordChains(t *testing.T) {
+	samples := make(chan infer.ChainSample)
+	go func() {
+		for i, x := range testDraws {
+			samples <- infer.ChainSample{Chain: i % 2, X: x}
+		}
+		close(samples)
+	}()
+	var out strings.Builder
+	tr := &Trace{Output: &out}
+	if err := tr.RecordChains(samples, 0); err != nil {
+		t.Fatalf("error recording samples: %v", err)
+	}
+	want := "chain__,x.1,x.2\n0,1,2\n1,3,-4.5\n0,5,6\n"
+	if out.String() != want {
+		t.Errorf("wrong output: got\n%s", out.String())
+	}
+	if len(tr.Draws) != 2 ||
+		len(tr.Draws[0]) != 2 || len(tr.Draws[1]) != 1 {
+		t.Errorf("wrong draws: %v", tr.Draws)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	// Draws 1..10 of x.1 and 10..1 of x.2, in two chains.
+	tr := &Trace{}
+	for i := 0; i != 10; i++ {
+		x := []float64{float64(i + 1), float64(10 - i)}
+		tr.record(i/5, x, nil)
+	}
+	summary := tr.Summary()
+	if len(summary) != 2 {
+		t.Fatalf("wrong number of parameters: got %d, want 2",
+			len(summary))
+	}
+	for i, s := range summary {
+		if s.Name != []string{"x.1", "x.2"}[i] {
+			t.Errorf("wrong name: got %q", s.Name)
+		}
+		if s.Mean != 5.5 {
+			t.Errorf("wrong mean of %s: got %.4g, want 5.5",
+				s.Name, s.Mean)
+		}
+		if sd := math.Sqrt(55. / 6); math.Abs(s.SD-sd) > 1e-9 {
+			t.Errorf("wrong sd of %s: got %.4g, want %.4g",
+				s.Name, s.SD, sd)
+		}
+		for j, q := range []float64{1.45, 5.5, 9.55} {
+			if math.Abs(s.Quantiles[j]-q) > 1e-9 {
+				t.Errorf("wrong quantile %d of %s: got %.4g, want %.4g",
+					j, s.Name, s.Quantiles[j], q)
+			}
+		}
+		// The chains do not overlap.
+		if s.RHat < 1.1 {
+			t.Errorf("wrong R-hat of %s: got %.4g", s.Name, s.RHat)
+		}
+	}
+
+	var out strings.Builder
+	if err := tr.WriteSummary(&out); err != nil {
+		t.Fatalf("error writing summary: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("wrong number of lines in summary: got\n%s",
+			out.String())
+	}
+	for _, column := range []string{
+		"mean", "sd", "5%", "50%", "95%",
+		"mcse", "ess_bulk", "ess_tail", "rhat",
+	} {
+		if !strings.Contains(lines[0], column) {
+			t.Errorf("missing column %s in summary:\n%s",
+				column, out.String())
+		}
+	}
+	if !strings.HasPrefix(strings.TrimSpace(lines[1]), "x.1") {
+		t.Errorf("wrong summary line: %s", lines[1])
+	}
+}